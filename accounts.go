@@ -0,0 +1,148 @@
+package zoneawareness
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// assumeRole is an IAM role in another account whose subnets are discovered, as set by the assume_role option.
+type assumeRole struct {
+	arn        string
+	externalID string
+	region     string // empty for the discovered region
+}
+
+// account returns the account ID of the role, e.g. "123456789012" for "arn:aws:iam::123456789012:role/zoneawareness".
+func (r assumeRole) account() string {
+	return strings.Split(r.arn, ":")[4]
+}
+
+// parseAssumeRole parses the arguments of the assume_role option: the role ARN followed by optional external_id=ID
+// and region=REGION arguments.
+func parseAssumeRole(args []string) (assumeRole, error) {
+	if len(args) == 0 {
+		return assumeRole{}, fmt.Errorf("missing role ARN")
+	}
+	role := assumeRole{arn: args[0]}
+	parts := strings.Split(role.arn, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "iam" || parts[4] == "" || !strings.HasPrefix(parts[5], "role/") {
+		return assumeRole{}, fmt.Errorf("'%s' is not an IAM role ARN", role.arn)
+	}
+
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || value == "" {
+			return assumeRole{}, fmt.Errorf("expected external_id=ID or region=REGION, got '%s'", arg)
+		}
+		switch key {
+		case "external_id":
+			role.externalID = value
+		case "region":
+			role.region = value
+		default:
+			return assumeRole{}, fmt.Errorf("unknown argument '%s'", key)
+		}
+	}
+	return role, nil
+}
+
+// assumeRoleProvider describes the subnets in the zone of the node that the account of a role can see, e.g. subnets
+// of an account linked through Transit Gateway. Zone IDs are the same in every account, so these subnets are merged
+// into the zone of the node. For a role in another region, all subnets of that region are described instead and
+// placed below their region and zone, as the regions option does.
+type assumeRoleProvider struct {
+	role   assumeRole
+	filter *subnetFilter
+
+	getSubnets func(ctx context.Context, azID string, region string, role assumeRole) ([]types.Subnet, error)
+}
+
+func (p *assumeRoleProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *assumeRoleProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	region := loc.awsRegion()
+	if region == "" {
+		return nil, nil
+	}
+	var prefixes []Prefix
+	if p.role.region == "" || p.role.region == region {
+		subnets, err := p.getSubnets(ctx, loc.Zone, region, p.role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe subnets in account %s: %w", p.role.account(), err)
+		}
+		log.Infof("Found %d subnet(s) in account %s", len(subnets), p.role.account())
+		prefixes = ec2SubnetPrefixes(loc.Zone, subnets, p.filter)
+	} else {
+		// The zone of the node only exists in its own region, so all subnets of the other region are described
+		subnets, err := p.getSubnets(ctx, "", p.role.region, p.role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe subnets in account %s: %w", p.role.account(), err)
+		}
+		log.Infof("Found %d subnet(s) in account %s in region '%s'", len(subnets), p.role.account(), p.role.region)
+		prefixes = regionSubnetPrefixes(p.role.region, subnets, nil, p.filter)
+	}
+	for _, prefix := range prefixes {
+		prefix.Metadata["account-id"] = p.role.account()
+	}
+	return prefixes, nil
+}
+
+// regional places the subnets of a role in another region below their region.
+func (p *assumeRoleProvider) regional() bool {
+	return p.role.region != ""
+}
+
+// source names the provider of each role by the account of the role, as the option can be repeated.
+func (p *assumeRoleProvider) source() string {
+	return "assume_role/" + p.role.account()
+}
+
+// getSubnetsFromRole assumes role using the default credentials and fetches the subnets in the Availability Zone ID
+// that the role's account can see in region, including subnets shared with it through RAM. Zone IDs, unlike zone
+// names, are the same in every account. Without azID the subnets of all zones of the region are fetched.
+func getSubnetsFromRole(ctx context.Context, azID string, region string, role assumeRole) ([]types.Subnet, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS SDK config: %w", err)
+	}
+
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), role.arn, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = pluginName
+		if role.externalID != "" {
+			o.ExternalID = aws.String(role.externalID)
+		}
+	})
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+
+	ec2Client := ec2.NewFromConfig(cfg)
+
+	input := &ec2.DescribeSubnetsInput{}
+	if azID != "" {
+		input.Filters = []types.Filter{
+			{
+				Name:   aws.String("availability-zone-id"),
+				Values: []string{azID},
+			},
+		}
+	}
+	var subnets []types.Subnet
+	paginator := ec2.NewDescribeSubnetsPaginator(ec2Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe subnets in region '%s' as %s: %w", region, role.arn, err)
+		}
+		subnets = append(subnets, page.Subnets...)
+	}
+	return subnets, nil
+}
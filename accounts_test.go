@@ -0,0 +1,140 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+func TestGetSubnetsFromRole(t *testing.T) {
+	stsRequests := newFakeAWSAPI(t, "STS", map[string]string{
+		"AssumeRole": `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAASSUMED</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::210987654321:assumed-role/zoneawareness/zoneawareness</Arn>
+      <AssumedRoleId>AROA:zoneawareness</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+  <ResponseMetadata><RequestId>1</RequestId></ResponseMetadata>
+</AssumeRoleResponse>`,
+	})
+	ec2Requests := newFakeAWSAPI(t, "EC2", map[string]string{
+		"DescribeSubnets": `<DescribeSubnetsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>2</requestId>
+  <subnetSet>
+    <item>
+      <subnetId>subnet-shared</subnetId>
+      <ownerId>210987654321</ownerId>
+      <availabilityZoneId>use1-az1</availabilityZoneId>
+      <cidrBlock>10.20.1.0/24</cidrBlock>
+    </item>
+  </subnetSet>
+</DescribeSubnetsResponse>`,
+	})
+
+	role, err := parseAssumeRole([]string{"arn:aws:iam::210987654321:role/zoneawareness", "external_id=secret-id", "region=us-east-1"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if role.account() != "210987654321" {
+		t.Errorf("Expected account 210987654321, got %s", role.account())
+	}
+
+	subnets, err := getSubnetsFromRole(context.Background(), "use1-az1", "us-east-1", role)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(subnets) != 1 || aws.ToString(subnets[0].CidrBlock) != "10.20.1.0/24" {
+		t.Errorf("Unexpected subnets: %v", subnets)
+	}
+
+	assumed := stsRequests()
+	if len(assumed) != 1 {
+		t.Fatalf("Expected one AssumeRole call, got %v", assumed)
+	}
+	if assumed[0].Get("RoleArn") != role.arn || assumed[0].Get("ExternalId") != "secret-id" || assumed[0].Get("RoleSessionName") != pluginName {
+		t.Errorf("Unexpected AssumeRole request: %v", assumed[0])
+	}
+
+	described := ec2Requests()
+	if len(described) != 1 || described[0].Get("Filter.1.Name") != "availability-zone-id" || described[0].Get("Filter.1.Value.1") != "use1-az1" {
+		t.Errorf("Unexpected DescribeSubnets requests: %v", described)
+	}
+}
+
+func TestSetupAssumeRole(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return []types.Subnet{{SubnetId: aws.String("subnet-local"), CidrBlock: aws.String("10.0.1.0/24")}}, nil
+		}
+	})
+
+	var assumed []assumeRole
+	patchProvider(t, "assume_role", func(p *assumeRoleProvider) {
+		p.getSubnets = func(ctx context.Context, azID string, region string, role assumeRole) ([]types.Subnet, error) {
+			assumed = append(assumed, role)
+			switch role.account() {
+			case "222222222222":
+				return nil, errors.New("access denied")
+			case "333333333333":
+				if azID != "" || region != "us-west-2" {
+					t.Errorf("Expected all subnets of us-west-2, got zone '%s' in region '%s'", azID, region)
+				}
+				return []types.Subnet{{SubnetId: aws.String("subnet-west"), AvailabilityZoneId: aws.String("usw2-az1"), CidrBlock: aws.String("10.30.1.0/24")}}, nil
+			}
+			return []types.Subnet{{SubnetId: aws.String("subnet-remote"), OwnerId: aws.String("111111111111"), CidrBlock: aws.String("10.20.1.0/24")}}, nil
+		}
+	})
+
+	c := caddy.NewTestController("dns", `zoneawareness {
+	assume_role arn:aws:iam::111111111111:role/dns external_id=abc
+	assume_role arn:aws:iam::222222222222:role/dns region=us-east-1
+	assume_role arn:aws:iam::333333333333:role/dns region=us-west-2
+}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(assumed) != 3 || assumed[0].externalID != "abc" || assumed[1].account() != "222222222222" || assumed[2].region != "us-west-2" {
+		t.Errorf("Unexpected roles assumed: %+v", assumed)
+	}
+
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+
+	// A role in another region places the local zone below its region
+	local := za.localPath()
+	if !slices.Equal(local, []string{"us-east-1", "use1-az1"}) {
+		t.Fatalf("Expected the local zone below its region, got %v", local)
+	}
+	for _, ip := range []string{"10.0.1.5", "10.20.1.5"} {
+		if rank := za.rankIP(net.ParseIP(ip), local); rank != len(local) {
+			t.Errorf("Expected %s to be in the local zone, got rank %d", ip, rank)
+		}
+	}
+	// The subnets of the role in another region share no level with the local zone
+	if rank := za.rankIP(net.ParseIP("10.30.1.5"), local); rank != 0 {
+		t.Errorf("Expected 10.30.1.5 in another region, got rank %d", rank)
+	}
+	if _, ok := za.Zones["usw2-az1"]; !ok {
+		t.Errorf("Expected the zone of the other region, got %v", slices.Collect(maps.Keys(za.Zones)))
+	}
+}
@@ -0,0 +1,325 @@
+package zoneawareness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Azure Instance Metadata Service and Azure Resource Manager endpoints, replaced in tests.
+// https://learn.microsoft.com/en-us/azure/virtual-machines/instance-metadata-service
+var (
+	azureIMDSEndpoint = "http://169.254.169.254"
+	azureARMEndpoint  = "https://management.azure.com"
+)
+
+// API versions of the Azure endpoints used by this plugin.
+const (
+	azureIMDSAPIVersion    = "2021-02-01"
+	azureComputeAPIVersion = "2024-07-01"
+	azureNetworkAPIVersion = "2024-05-01"
+	azureVMSSNICAPIVersion = "2018-10-01"
+)
+
+// defaultAzureInterval is how often the VMs and VMSS instances of the resource groups are listed.
+const defaultAzureInterval = 5 * time.Minute
+
+// azureOptions configures the azure option.
+type azureOptions struct {
+	resourceGroups []string // empty for the resource group of the instance
+	subscription   string   // empty for the subscription of the instance
+	interval       time.Duration
+}
+
+// parseAzureOptions parses the arguments of the azure option: resource groups followed by optional subscription=ID
+// and interval=INTERVAL arguments.
+func parseAzureOptions(args []string) (*azureOptions, error) {
+	opts := &azureOptions{interval: defaultAzureInterval}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			opts.resourceGroups = append(opts.resourceGroups, arg)
+			continue
+		}
+		if value == "" {
+			return nil, fmt.Errorf("expected a resource group, subscription=ID or interval=INTERVAL, got '%s'", arg)
+		}
+		switch key {
+		case "subscription":
+			opts.subscription = value
+		case "interval":
+			interval, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			if interval <= 0 {
+				return nil, fmt.Errorf("refresh interval must be positive, got %s", interval)
+			}
+			opts.interval = interval
+		default:
+			return nil, fmt.Errorf("expected a resource group, subscription=ID or interval=INTERVAL, got '%s'", arg)
+		}
+	}
+	return opts, nil
+}
+
+// azureInstance is the subset of the compute metadata of an Azure VM used by this plugin.
+type azureInstance struct {
+	Location          string `json:"location"`
+	Zone              string `json:"zone"`
+	SubscriptionID    string `json:"subscriptionId"`
+	ResourceGroupName string `json:"resourceGroupName"`
+}
+
+// azureZone names an Azure availability zone by its topology path, location/location-zone, matching the zone label
+// AKS sets on nodes such as "eastus-1". Resources without a zone are placed at the location.
+func azureZone(location string, zone string) string {
+	if zone == "" {
+		return location
+	}
+	return location + "/" + location + "-" + zone
+}
+
+// getConfigFromAzureIMDS fetches the location, zone, subscription and resource group of the VM from Azure IMDS.
+func getConfigFromAzureIMDS() (*azureInstance, error) {
+	const imdsTimeout = 2 * time.Second // Short timeout to fail fast
+
+	ctx, cancel := context.WithTimeout(context.Background(), imdsTimeout)
+	defer cancel()
+
+	instance := &azureInstance{}
+	query := url.Values{"api-version": {azureIMDSAPIVersion}}
+	if err := getAzureIMDS(ctx, "/metadata/instance/compute", query, instance); err != nil {
+		return nil, err
+	}
+	if instance.Location == "" {
+		return nil, fmt.Errorf("compute metadata has no location")
+	}
+	return instance, nil
+}
+
+// getAzureIMDS fetches path from Azure IMDS and decodes the JSON response into v.
+func getAzureIMDS(ctx context.Context, path string, query url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, azureIMDSEndpoint+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create IMDS request: %w", err)
+	}
+	req.Header.Set("Metadata", "true")
+	return doAzureRequest(req, v)
+}
+
+// doAzureRequest sends req and decodes the JSON response into v.
+func doAzureRequest(req *http.Request, v any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status for %s: %s", req.URL.Path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", req.URL.Path, err)
+	}
+	return nil
+}
+
+// azureClient lists Azure Resource Manager resources with the token of the managed identity of the VM.
+type azureClient struct {
+	token        string
+	subscription string
+}
+
+// list fetches every page of the ARM collection at path below the subscription, decoding the items of each page
+// with handle.
+func (a *azureClient) list(ctx context.Context, path string, apiVersion string, handle func(json.RawMessage) error) error {
+	next := azureARMEndpoint + "/subscriptions/" + url.PathEscape(a.subscription) + path + "?api-version=" + apiVersion
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create request for %s: %w", path, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+a.token)
+
+		var page struct {
+			Value    []json.RawMessage `json:"value"`
+			NextLink string            `json:"nextLink"`
+		}
+		if err := doAzureRequest(req, &page); err != nil {
+			return err
+		}
+		for _, item := range page.Value {
+			if err := handle(item); err != nil {
+				return fmt.Errorf("failed to decode %s: %w", path, err)
+			}
+		}
+		next = page.NextLink
+	}
+	return nil
+}
+
+// azureVM is the subset of a VM or VMSS instance used by this plugin.
+type azureVM struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Location string   `json:"location"`
+	Zones    []string `json:"zones"`
+}
+
+// zone returns the zone of the VM as named by azureZone.
+func (vm azureVM) zone() string {
+	zone := ""
+	if len(vm.Zones) > 0 {
+		zone = vm.Zones[0]
+	}
+	return azureZone(vm.Location, zone)
+}
+
+// azureNIC is the subset of a network interface used by this plugin.
+type azureNIC struct {
+	Properties struct {
+		VirtualMachine *struct {
+			ID string `json:"id"`
+		} `json:"virtualMachine"`
+		IPConfigurations []struct {
+			Properties struct {
+				PrivateIPAddress string `json:"privateIPAddress"`
+			} `json:"properties"`
+		} `json:"ipConfigurations"`
+	} `json:"properties"`
+}
+
+// getAzureAddresses lists the VMs and VMSS instances of the resource groups and returns the private IPs of their
+// network interfaces, mapped to the zone of the VM. With Azure CNI the pod IPs of AKS nodes are secondary IP
+// configurations of the node interfaces and are included. The access token of the managed identity of the VM is
+// read from IMDS.
+func getAzureAddresses(ctx context.Context, instance *azureInstance, opts *azureOptions) ([]zonalAddress, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureARMEndpoint + "/"}}
+	if err := getAzureIMDS(ctx, "/metadata/identity/oauth2/token", query, &token); err != nil {
+		return nil, err
+	}
+
+	client := &azureClient{token: token.AccessToken, subscription: opts.subscription}
+	if client.subscription == "" {
+		client.subscription = instance.SubscriptionID
+	}
+	resourceGroups := opts.resourceGroups
+	if len(resourceGroups) == 0 {
+		resourceGroups = []string{instance.ResourceGroupName}
+	}
+
+	// VMs and NICs are joined by VM resource ID, which ARM does not report in a consistent case.
+	zones := make(map[string]string)
+	addVM := func(item json.RawMessage) error {
+		var vm azureVM
+		if err := json.Unmarshal(item, &vm); err != nil {
+			return err
+		}
+		zones[strings.ToLower(vm.ID)] = vm.zone()
+		return nil
+	}
+	var nics []azureNIC
+	addNIC := func(item json.RawMessage) error {
+		var nic azureNIC
+		if err := json.Unmarshal(item, &nic); err != nil {
+			return err
+		}
+		nics = append(nics, nic)
+		return nil
+	}
+
+	for _, group := range resourceGroups {
+		base := "/resourceGroups/" + url.PathEscape(group) + "/providers/"
+		if err := client.list(ctx, base+"Microsoft.Compute/virtualMachines", azureComputeAPIVersion, addVM); err != nil {
+			return nil, err
+		}
+		if err := client.list(ctx, base+"Microsoft.Network/networkInterfaces", azureNetworkAPIVersion, addNIC); err != nil {
+			return nil, err
+		}
+
+		var scaleSets []azureVM
+		err := client.list(ctx, base+"Microsoft.Compute/virtualMachineScaleSets", azureComputeAPIVersion, func(item json.RawMessage) error {
+			var vmss azureVM
+			if err := json.Unmarshal(item, &vmss); err != nil {
+				return err
+			}
+			scaleSets = append(scaleSets, vmss)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, vmss := range scaleSets {
+			path := base + "Microsoft.Compute/virtualMachineScaleSets/" + url.PathEscape(vmss.Name)
+			if err := client.list(ctx, path+"/virtualMachines", azureComputeAPIVersion, addVM); err != nil {
+				return nil, err
+			}
+			if err := client.list(ctx, path+"/networkInterfaces", azureVMSSNICAPIVersion, addNIC); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var addresses []zonalAddress
+	for _, nic := range nics {
+		if nic.Properties.VirtualMachine == nil {
+			continue
+		}
+		zone, ok := zones[strings.ToLower(nic.Properties.VirtualMachine.ID)]
+		if !ok {
+			continue
+		}
+		for _, ipConfig := range nic.Properties.IPConfigurations {
+			addr, err := netip.ParseAddr(ipConfig.Properties.PrivateIPAddress)
+			if err != nil {
+				log.Warningf("Invalid private IP '%s' of VM %s: %v", ipConfig.Properties.PrivateIPAddress, nic.Properties.VirtualMachine.ID, err)
+				continue
+			}
+			addresses = append(addresses, zonalAddress{addr: addr, zone: zone})
+		}
+	}
+	return addresses, nil
+}
+
+// startAzure maps the private IPs of the VMs and VMSS instances in the resource groups, listed with getAddresses, to
+// their zones, passing them to update when they change, and refreshes them every interval until ctx is done. A failed
+// refresh keeps the addresses found before. The VMs are listed with the subscription and resource group of the
+// instance returned by getInstance, which is asked again until it succeeds.
+func startAzure(ctx context.Context, getInstance func() (*azureInstance, error), opts *azureOptions, getAddresses func(ctx context.Context, instance *azureInstance, opts *azureOptions) ([]zonalAddress, error), update func([]Prefix)) error {
+	var (
+		instance *azureInstance
+		mapped   []zonalAddress
+		loaded   bool
+	)
+	load := func(ctx context.Context) ([]Prefix, bool, error) {
+		if instance == nil {
+			i, err := getInstance()
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to read the instance from Azure IMDS: %w", err)
+			}
+			instance = i
+		}
+		addresses, err := getAddresses(ctx, instance, opts)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to list Azure VMs: %w", err)
+		}
+		if loaded && slices.Equal(addresses, mapped) {
+			return nil, false, nil
+		}
+		mapped, loaded = addresses, true
+		log.Infof("Mapped %d Azure VM address(es) to their zones", len(addresses))
+		return zonalAddressPrefixes(addresses), true, nil
+	}
+	startMapSource(ctx, "azure", opts.interval, load, update)
+	return nil
+}
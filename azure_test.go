@@ -0,0 +1,269 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+// newFakeAzure starts a stand-in for Azure IMDS and the Azure Resource Manager API, serving responses keyed by path.
+// ARM pages after the first are keyed by path and the page query parameter, e.g. "/subscriptions/s/...?page=2".
+func newFakeAzure(t *testing.T, responses map[string]string) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path
+		if strings.HasPrefix(key, "/metadata/") {
+			if r.Header.Get("Metadata") != "true" {
+				http.Error(w, "missing Metadata header", http.StatusBadRequest)
+				return
+			}
+		} else {
+			if r.Header.Get("Authorization") != "Bearer test-token" || r.URL.Query().Get("api-version") == "" {
+				http.Error(w, "unauthenticated", http.StatusUnauthorized)
+				return
+			}
+			if page := r.URL.Query().Get("page"); page != "" {
+				key += "?page=" + page
+			}
+		}
+		body, ok := responses[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(strings.ReplaceAll(body, "SERVER", "http://"+r.Host)))
+	}))
+	t.Cleanup(server.Close)
+
+	origIMDS, origARM := azureIMDSEndpoint, azureARMEndpoint
+	azureIMDSEndpoint, azureARMEndpoint = server.URL, server.URL
+	t.Cleanup(func() { azureIMDSEndpoint, azureARMEndpoint = origIMDS, origARM })
+}
+
+func TestGetConfigFromAzureIMDS(t *testing.T) {
+	newFakeAzure(t, map[string]string{
+		"/metadata/instance/compute": `{"location":"eastus","zone":"2","subscriptionId":"sub-1","resourceGroupName":"MC_rg_aks_eastus","vmSize":"Standard_D4s_v5"}`,
+	})
+
+	instance, err := getConfigFromAzureIMDS()
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if instance.Location != "eastus" || instance.Zone != "2" || instance.SubscriptionID != "sub-1" || instance.ResourceGroupName != "MC_rg_aks_eastus" {
+		t.Errorf("Unexpected instance metadata: %+v", instance)
+	}
+	if zone := azureZone(instance.Location, instance.Zone); zone != "eastus/eastus-2" {
+		t.Errorf("Expected zone eastus/eastus-2, got %s", zone)
+	}
+}
+
+func TestGetAzureAddresses(t *testing.T) {
+	const rg = "/subscriptions/sub-1/resourceGroups/MC_rg/providers/"
+	newFakeAzure(t, map[string]string{
+		"/metadata/identity/oauth2/token": `{"access_token":"test-token","token_type":"Bearer"}`,
+		rg + "Microsoft.Compute/virtualMachines": `{"value": [
+  {"id": "/subscriptions/sub-1/resourceGroups/MC_rg/providers/Microsoft.Compute/virtualMachines/vm-1", "name": "vm-1", "location": "eastus", "zones": ["1"]},
+  {"id": "/subscriptions/sub-1/resourceGroups/MC_rg/providers/Microsoft.Compute/virtualMachines/vm-2", "name": "vm-2", "location": "eastus"}
+], "nextLink": "SERVER` + rg + `Microsoft.Compute/virtualMachines?api-version=2024-07-01&page=2"}`,
+		rg + "Microsoft.Compute/virtualMachines?page=2": `{"value": [
+  {"id": "/subscriptions/sub-1/resourceGroups/MC_rg/providers/Microsoft.Compute/virtualMachines/vm-3", "name": "vm-3", "location": "eastus", "zones": ["3"]}
+]}`,
+		rg + "Microsoft.Network/networkInterfaces": `{"value": [
+  {"properties": {"virtualMachine": {"id": "/subscriptions/sub-1/resourceGroups/mc_rg/providers/Microsoft.Compute/virtualMachines/vm-1"},
+   "ipConfigurations": [{"properties": {"privateIPAddress": "10.224.0.4"}}, {"properties": {"privateIPAddress": "10.224.0.5"}}]}},
+  {"properties": {"virtualMachine": {"id": "/subscriptions/sub-1/resourceGroups/MC_rg/providers/Microsoft.Compute/virtualMachines/vm-2"},
+   "ipConfigurations": [{"properties": {"privateIPAddress": "10.224.0.6"}}]}},
+  {"properties": {"virtualMachine": {"id": "/subscriptions/sub-1/resourceGroups/MC_rg/providers/Microsoft.Compute/virtualMachines/vm-3"},
+   "ipConfigurations": [{"properties": {"privateIPAddress": "10.224.0.7"}}]}},
+  {"properties": {"ipConfigurations": [{"properties": {"privateIPAddress": "10.224.0.8"}}]}}
+]}`,
+		rg + "Microsoft.Compute/virtualMachineScaleSets": `{"value": [{"id": "/subscriptions/sub-1/resourceGroups/MC_rg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-pool", "name": "aks-pool", "location": "eastus", "zones": ["1", "2", "3"]}]}`,
+		rg + "Microsoft.Compute/virtualMachineScaleSets/aks-pool/virtualMachines": `{"value": [
+  {"id": "/subscriptions/sub-1/resourceGroups/MC_rg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-pool/virtualMachines/0", "name": "aks-pool_0", "location": "eastus", "zones": ["2"]}
+]}`,
+		rg + "Microsoft.Compute/virtualMachineScaleSets/aks-pool/networkInterfaces": `{"value": [
+  {"properties": {"virtualMachine": {"id": "/subscriptions/sub-1/resourceGroups/MC_rg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-pool/virtualMachines/0"},
+   "ipConfigurations": [{"properties": {"privateIPAddress": "10.224.1.4"}}]}}
+]}`,
+	})
+
+	instance := &azureInstance{Location: "eastus", Zone: "1", SubscriptionID: "sub-1", ResourceGroupName: "MC_rg"}
+	addresses, err := getAzureAddresses(context.Background(), instance, &azureOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	expected := map[string]string{
+		"10.224.0.4": "eastus/eastus-1",
+		"10.224.0.5": "eastus/eastus-1",
+		"10.224.0.6": "eastus",
+		"10.224.0.7": "eastus/eastus-3",
+		"10.224.1.4": "eastus/eastus-2",
+	}
+	got := addressZones(addresses)
+	if len(got) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	for addr, zone := range expected {
+		if got[addr] != zone {
+			t.Errorf("Expected %s in zone '%s', got '%s'", addr, zone, got[addr])
+		}
+	}
+}
+
+func TestParseAzureOptions(t *testing.T) {
+	opts, err := parseAzureOptions([]string{"rg-1", "rg-2", "subscription=sub-1"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !slices.Equal(opts.resourceGroups, []string{"rg-1", "rg-2"}) || opts.subscription != "sub-1" || opts.interval != defaultAzureInterval {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+	opts, err = parseAzureOptions([]string{"interval=1m"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(opts.resourceGroups) != 0 || opts.interval != time.Minute {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+	for _, args := range [][]string{{"subscription="}, {"tenant=t-1"}, {"interval=0s"}, {"interval=soon"}} {
+		if _, err := parseAzureOptions(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestSetupAzure(t *testing.T) {
+	setupTest(t)
+
+	var (
+		mu       sync.Mutex
+		scaleSet = "10.224.0.5"
+		provider *azureProvider
+	)
+	patchProvider(t, "azure", func(p *azureProvider) {
+		p.getConfig = func() (*azureInstance, error) {
+			return &azureInstance{Location: "eastus", Zone: "1", SubscriptionID: "sub-1", ResourceGroupName: "MC_rg"}, nil
+		}
+		p.getAddresses = func(ctx context.Context, instance *azureInstance, opts *azureOptions) ([]zonalAddress, error) {
+			if !slices.Equal(opts.resourceGroups, []string{"rg-nodes"}) {
+				t.Errorf("Expected the configured resource group, got %v", opts.resourceGroups)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			return []zonalAddress{
+				{addr: netip.MustParseAddr("10.224.0.4"), zone: "eastus/eastus-1"},
+				{addr: netip.MustParseAddr(scaleSet), zone: "eastus/eastus-2"},
+				{addr: netip.MustParseAddr("10.225.0.4"), zone: "westus2/westus2-1"},
+			}, nil
+		}
+		provider = p
+	})
+
+	c := caddy.NewTestController("dns", "zoneawareness {\n\tazure rg-nodes interval=10ms\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+	if local := za.localPath(); !slices.Equal(local, []string{"eastus", "eastus-1"}) {
+		t.Errorf("Expected local path eastus/eastus-1, got %v", local)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := provider.Watch(ctx, Location{}, func(prefixes []Prefix) { za.setProviderPrefixes("azure", prefixes) }); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	rank := func(ip string) int {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.rankIP(net.ParseIP(ip), za.localPath())
+	}
+	for ip, expected := range map[string]int{"10.224.0.4": 2, "10.224.0.5": 1, "10.225.0.4": 0} {
+		if got := rank(ip); got != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, got)
+		}
+	}
+
+	// A scale set instance is replaced and comes up with another address
+	mu.Lock()
+	scaleSet = "10.224.0.6"
+	mu.Unlock()
+	waitFor(t, "the VMs to be listed again", func() bool { return rank("10.224.0.6") == 1 && rank("10.224.0.5") == 0 })
+}
+
+func TestAzureWatchReadsInstanceWhenLocatedElsewhere(t *testing.T) {
+	var reads atomic.Int32
+	provider := &azureProvider{
+		opts: &azureOptions{interval: 10 * time.Millisecond},
+		getConfig: func() (*azureInstance, error) {
+			// IMDS is not reachable on the first read
+			if reads.Add(1) == 1 {
+				return nil, errors.New("connection refused")
+			}
+			return &azureInstance{Location: "eastus", Zone: "1", SubscriptionID: "sub-1", ResourceGroupName: "MC_rg"}, nil
+		},
+		getAddresses: func(ctx context.Context, instance *azureInstance, opts *azureOptions) ([]zonalAddress, error) {
+			if instance.SubscriptionID != "sub-1" {
+				t.Errorf("Expected the instance read from IMDS, got %+v", instance)
+			}
+			return []zonalAddress{{addr: netip.MustParseAddr("10.224.0.4"), zone: "eastus/eastus-1"}}, nil
+		},
+	}
+
+	var (
+		mu      sync.Mutex
+		updates [][]Prefix
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	// The node was located by the topology option, which doesn't know the cloud
+	loc := Location{Zone: "eastus-1", Path: []string{"eastus", "eastus-1"}}
+	if err := provider.Watch(ctx, loc, func(prefixes []Prefix) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, prefixes)
+	}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	waitFor(t, "the VMs to be listed", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(updates) > 0
+	})
+	// The addresses don't change, so they are passed on once
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(updates) != 1 || len(updates[0]) != 1 || updates[0][0].Zone != "eastus/eastus-1" {
+		t.Errorf("Expected one update with the VM, got %v", updates)
+	}
+	if got := reads.Load(); got != 2 {
+		t.Errorf("Expected the instance to be read until it succeeded, got %d reads", got)
+	}
+
+	// Another cloud has no Azure VMs to list
+	if err := (&azureProvider{opts: provider.opts}).Watch(ctx, Location{Zone: "use1-az1", Cloud: CloudAWS}, func(prefixes []Prefix) {
+		t.Errorf("Expected no update on AWS, got %v", prefixes)
+	}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package zoneawareness
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCacheMaxAge = 24 * time.Hour
+
+// mapCache keeps the location of the node and the prefixes discovered by the providers in a file. A node starting
+// while discovery fails, e.g. because the EC2 API is throttled or unreachable, falls back to what was discovered last
+// instead of running without the discovered subnets.
+type mapCache struct {
+	path   string
+	maxAge time.Duration // cached entries older than this are ignored
+
+	mu    sync.Mutex
+	doc   cacheDocument
+	dirty bool // doc changed since it was last written
+}
+
+// cacheDocument is the JSON document of the cache file.
+type cacheDocument struct {
+	Location *cachedLocation `json:"location,omitempty"`
+	Sources  []cachedSource  `json:"sources,omitempty"`
+}
+
+// cachedLocation is the location of the node when it was last located.
+type cachedLocation struct {
+	Updated time.Time `json:"updated"`
+	Zone    string    `json:"zone"`
+	Region  string    `json:"region,omitempty"`
+	Cloud   string    `json:"cloud,omitempty"`
+	Path    []string  `json:"path,omitempty"`
+}
+
+// cachedSource is the prefixes last discovered by the provider Source.
+type cachedSource struct {
+	Source   string         `json:"source"`
+	Updated  time.Time      `json:"updated"`
+	Prefixes []cachedPrefix `json:"prefixes"`
+}
+
+// cachedPrefix is a Prefix as written to the cache file.
+type cachedPrefix struct {
+	Prefix   netip.Prefix      `json:"prefix"`
+	Zone     string            `json:"zone"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// parseCacheOptions parses the arguments of the cache option: the path of the cache file and an optional
+// max_age=DURATION after which cached entries are ignored.
+func parseCacheOptions(args []string) (*mapCache, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected the path of the cache file")
+	}
+	cache := &mapCache{path: args[0], maxAge: defaultCacheMaxAge}
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("expected KEY=VALUE, got '%s'", arg)
+		}
+		switch key {
+		case "max_age":
+			maxAge, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			if maxAge <= 0 {
+				return nil, fmt.Errorf("max age must be positive, got %s", maxAge)
+			}
+			cache.maxAge = maxAge
+		default:
+			return nil, fmt.Errorf("unknown argument '%s'", key)
+		}
+	}
+	return cache, nil
+}
+
+// load reads the cache file. A missing file is an empty cache, as on the first start of a node.
+func (c *mapCache) load() error {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var doc cacheDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid cache file %s: %w", c.path, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.doc = doc
+	return nil
+}
+
+// fresh reports whether an entry updated at updated is not older than the max age.
+func (c *mapCache) fresh(updated time.Time) bool {
+	return time.Since(updated) <= c.maxAge
+}
+
+// locate returns loc, or the cached location if no provider located the node. The cached prefixes are dropped when
+// the node is located in another zone than the cached one, as they were discovered for another node. A nil cache
+// returns loc.
+func (c *mapCache) locate(loc Location) Location {
+	if c == nil {
+		return loc
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached := c.doc.Location
+	if loc.Zone == "" {
+		if cached == nil {
+			return loc
+		}
+		if !c.fresh(cached.Updated) {
+			log.Infof("Ignoring the location cached in %s at %s: older than %s", c.path, cached.Updated.Format(time.RFC3339), c.maxAge)
+			return loc
+		}
+		log.Infof("Using zone '%s' and region '%s' cached in %s at %s.", cached.Zone, cached.Region, c.path, cached.Updated.Format(time.RFC3339))
+		return Location{Zone: cached.Zone, Region: cached.Region, Cloud: cached.Cloud, Path: cached.Path}
+	}
+
+	if cached != nil && cached.Zone != loc.Zone {
+		log.Infof("Discarding the cache in %s of zone '%s' in zone '%s'", c.path, cached.Zone, loc.Zone)
+		c.doc.Sources = nil
+	}
+	c.doc.Location = &cachedLocation{Updated: time.Now(), Zone: loc.Zone, Region: loc.Region, Cloud: loc.Cloud, Path: loc.Path}
+	c.dirty = true
+	return loc
+}
+
+// prefixes returns the prefixes cached for source, if they are not older than the max age. A nil cache has none.
+func (c *mapCache) prefixes(source string) ([]Prefix, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := slices.IndexFunc(c.doc.Sources, func(s cachedSource) bool { return s.Source == source })
+	if i < 0 {
+		return nil, false
+	}
+	cached := c.doc.Sources[i]
+	if !c.fresh(cached.Updated) {
+		log.Infof("Ignoring the prefixes of provider %s cached in %s at %s: older than %s", source, c.path, cached.Updated.Format(time.RFC3339), c.maxAge)
+		return nil, false
+	}
+	prefixes := make([]Prefix, 0, len(cached.Prefixes))
+	for _, p := range cached.Prefixes {
+		prefixes = append(prefixes, Prefix{Prefix: p.Prefix, Zone: p.Zone, Metadata: maps.Clone(p.Metadata)})
+	}
+	log.Infof("Using %d prefix(es) of provider %s cached in %s at %s.", len(prefixes), source, c.path, cached.Updated.Format(time.RFC3339))
+	return prefixes, true
+}
+
+// store replaces the cached prefixes of source with prefixes it discovered now. A nil cache stores nothing.
+func (c *mapCache) store(source string, prefixes []Prefix) {
+	if c == nil {
+		return
+	}
+	entry := cachedSource{Source: source, Updated: time.Now(), Prefixes: make([]cachedPrefix, 0, len(prefixes))}
+	for _, p := range prefixes {
+		entry.Prefixes = append(entry.Prefixes, cachedPrefix{Prefix: p.Prefix, Zone: p.Zone, Metadata: p.Metadata})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i := slices.IndexFunc(c.doc.Sources, func(s cachedSource) bool { return s.Source == source }); i >= 0 {
+		c.doc.Sources[i] = entry
+	} else {
+		c.doc.Sources = append(c.doc.Sources, entry)
+	}
+	c.dirty = true
+}
+
+// save writes the cache file if the cache changed. The file is replaced through a rename, so that a node stopping
+// while it is written does not leave a partial file behind. A nil cache writes nothing.
+func (c *mapCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(c.doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
@@ -0,0 +1,164 @@
+package zoneawareness
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+func TestParseCacheOptions(t *testing.T) {
+	cache, err := parseCacheOptions([]string{"/var/cache/zoneawareness.json", "max_age=1h"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if cache.path != "/var/cache/zoneawareness.json" || cache.maxAge != time.Hour {
+		t.Errorf("Unexpected cache: %+v", cache)
+	}
+	if cache, _ := parseCacheOptions([]string{"cache.json"}); cache.maxAge != defaultCacheMaxAge {
+		t.Errorf("Expected the default max age, got %s", cache.maxAge)
+	}
+	for _, args := range [][]string{{}, {"cache.json", "max_age=0s"}, {"cache.json", "max_age"}, {"cache.json", "ttl=1h"}} {
+		if _, err := parseCacheOptions(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestMapCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	cache := &mapCache{path: path, maxAge: time.Hour}
+	if err := cache.load(); err != nil {
+		t.Fatalf("Expected a missing cache file to be empty, got: %v", err)
+	}
+	if loc := cache.locate(Location{}); loc.Zone != "" {
+		t.Errorf("Expected no cached location, got %+v", loc)
+	}
+
+	cache.locate(Location{Zone: "use1-az1", Region: "us-east-1", Cloud: CloudAWS})
+	cache.store("aws", []Prefix{{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Zone: "use1-az1", Metadata: map[string]string{MetadataName: "private"}}})
+	if err := cache.save(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	loaded := &mapCache{path: path, maxAge: time.Hour}
+	if err := loaded.load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if loc := loaded.locate(Location{}); loc.Zone != "use1-az1" || loc.Region != "us-east-1" || loc.Cloud != CloudAWS {
+		t.Errorf("Expected the cached location, got %+v", loc)
+	}
+	prefixes, ok := loaded.prefixes("aws")
+	if !ok || len(prefixes) != 1 || prefixes[0].Prefix.String() != "10.0.1.0/24" || prefixes[0].Metadata[MetadataName] != "private" {
+		t.Errorf("Expected the cached prefixes, got %+v", prefixes)
+	}
+	if _, ok := loaded.prefixes("netbox"); ok {
+		t.Error("Expected no cached prefixes of another provider")
+	}
+
+	// Entries older than the max age are ignored.
+	loaded.maxAge = time.Nanosecond
+	if loc := loaded.locate(Location{}); loc.Zone != "" {
+		t.Errorf("Expected an expired location to be ignored, got %+v", loc)
+	}
+	if _, ok := loaded.prefixes("aws"); ok {
+		t.Error("Expected expired prefixes to be ignored")
+	}
+
+	// Prefixes cached in another zone belong to another node.
+	loaded.maxAge = time.Hour
+	loaded.locate(Location{Zone: "use1-az2"})
+	if _, ok := loaded.prefixes("aws"); ok {
+		t.Error("Expected the prefixes of another zone to be discarded")
+	}
+}
+
+func TestMapCacheInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&mapCache{path: path}).load(); err == nil {
+		t.Error("Expected an error for an invalid cache file")
+	}
+}
+
+func TestSetupCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	corefile := "zoneawareness {\n\tcache " + path + " max_age=1h\n}"
+
+	setupZone := func(t *testing.T) *Zoneawareness {
+		t.Helper()
+		c := caddy.NewTestController("dns", corefile)
+		if err := setup(c); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+		plugins := dnsserver.GetConfig(c).Plugin
+		if len(plugins) == 0 {
+			return nil
+		}
+		return plugins[0](nil).(*Zoneawareness)
+	}
+
+	// A successful discovery is written to the cache.
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return []types.Subnet{{SubnetId: aws.String("subnet-1"), CidrBlock: aws.String("10.0.1.0/24")}}, nil
+		}
+	})
+	if za := setupZone(t); za == nil {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	var doc cacheDocument
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected the cache file to be written: %v", err)
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Expected a valid cache file: %v", err)
+	}
+	if doc.Location == nil || doc.Location.Zone != "use1-az1" || len(doc.Sources) == 0 || doc.Sources[0].Source != "aws" {
+		t.Errorf("Unexpected cache file: %s", data)
+	}
+
+	// Without IMDS and the EC2 API the cached location and subnets are used.
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "", "", errors.New("IMDS not available in test") }
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return nil, errors.New("throttled")
+		}
+	})
+	za := setupZone(t)
+	if za == nil {
+		t.Fatal("Expected plugin to be added from the cache, but it wasn't")
+	}
+	if za.currentAvailabilityZoneId != "use1-az1" {
+		t.Errorf("Expected the cached zone use1-az1, got %s", za.currentAvailabilityZoneId)
+	}
+	if rank := za.rankIP(net.ParseIP("10.0.1.5"), za.localPath()); rank != 1 {
+		t.Errorf("Expected 10.0.1.5 to be in the local zone, got rank %d", rank)
+	}
+
+	// A cache older than the max age is ignored.
+	doc.Location.Updated = time.Now().Add(-2 * time.Hour)
+	doc.Sources[0].Updated = doc.Location.Updated
+	data, _ = json.Marshal(doc)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if za := setupZone(t); za != nil && (za.located() || za.Ready()) {
+		t.Errorf("Expected the node not to be located from an expired cache, got zone %s", za.currentAvailabilityZoneId)
+	}
+}
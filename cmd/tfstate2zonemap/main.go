@@ -0,0 +1,41 @@
+// Command tfstate2zonemap converts the aws_subnet resources of Terraform state files into a zone map for the file
+// option of the zoneawareness plugin, for environments that read the map from disk instead of the state files.
+//
+//	tfstate2zonemap terraform.tfstate [network.tfstate...] > /etc/zoneawareness/map.yaml
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/toredash/zoneawareness"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: tfstate2zonemap STATE-FILE...")
+		os.Exit(2)
+	}
+
+	var prefixes []zoneawareness.Prefix
+	for _, path := range os.Args[1:] {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		statePrefixes, err := zoneawareness.ParseTerraformState(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		prefixes = append(prefixes, statePrefixes...)
+	}
+
+	data, err := zoneawareness.MarshalZoneMap(prefixes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(data)
+}
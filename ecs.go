@@ -0,0 +1,133 @@
+package zoneawareness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// ecsMetadataEnv is set by the ECS agent (and Fargate) to the base URL of the task metadata endpoint v4.
+// https://docs.aws.amazon.com/AmazonECS/latest/developerguide/task-metadata-endpoint-v4.html
+const ecsMetadataEnv = "ECS_CONTAINER_METADATA_URI_V4"
+
+// ecsTaskMetadata is the subset of the task metadata v4 response used by this plugin.
+type ecsTaskMetadata struct {
+	TaskARN          string `json:"TaskARN"`
+	AvailabilityZone string `json:"AvailabilityZone"`
+	Containers       []struct {
+		Networks []struct {
+			IPv4SubnetCIDRBlock string `json:"IPv4SubnetCIDRBlock"`
+			IPv6SubnetCIDRBlock string `json:"IPv6SubnetCIDRBlock"`
+		} `json:"Networks"`
+	} `json:"Containers"`
+}
+
+// getConfigFromECS fetches the availability zone ID, region and the subnets of the running task from the ECS
+// task metadata endpoint. The endpoint only reports the availability zone name, which is translated to a zone ID
+// with zoneID.
+func getConfigFromECS(zoneID zoneIDFunc) (string, string, []types.Subnet, error) {
+	const (
+		ecsTimeout = 2 * time.Second  // Short timeout to fail fast when not running on ECS
+		ec2Timeout = 10 * time.Second // Loading credentials and calling the EC2 API takes longer
+	)
+
+	baseURL := os.Getenv(ecsMetadataEnv)
+	if baseURL == "" {
+		return "", "", nil, fmt.Errorf("%s is not set (not running on ECS)", ecsMetadataEnv)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ecsTimeout)
+	task, err := fetchECSTaskMetadata(ctx, baseURL)
+	cancel()
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if task.AvailabilityZone == "" {
+		return "", "", nil, fmt.Errorf("task metadata has no AvailabilityZone")
+	}
+
+	region := regionFromARN(task.TaskARN)
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return "", "", nil, fmt.Errorf("could not determine region from task ARN '%s' or AWS_REGION", task.TaskARN)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), ec2Timeout)
+	defer cancel()
+
+	azID, err := zoneID(ctx, task.AvailabilityZone, region)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if !awsZoneIDPattern.MatchString(azID) {
+		return "", "", nil, fmt.Errorf("zone ID '%s' for availability zone '%s' has an invalid format", azID, task.AvailabilityZone)
+	}
+
+	return azID, region, task.subnets(), nil
+}
+
+// fetchECSTaskMetadata reads the task metadata document below baseURL.
+func fetchECSTaskMetadata(ctx context.Context, baseURL string) (*ecsTaskMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/task", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create task metadata request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task metadata: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from task metadata endpoint: %s", resp.Status)
+	}
+
+	task := &ecsTaskMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(task); err != nil {
+		return nil, fmt.Errorf("failed to decode task metadata: %w", err)
+	}
+	return task, nil
+}
+
+// subnets returns the subnets the task's network interfaces are attached to, in the form returned by the EC2 API.
+func (t *ecsTaskMetadata) subnets() []types.Subnet {
+	var subnets []types.Subnet
+	for _, container := range t.Containers {
+		for _, network := range container.Networks {
+			if network.IPv4SubnetCIDRBlock == "" && network.IPv6SubnetCIDRBlock == "" {
+				continue
+			}
+			subnet := types.Subnet{SubnetId: aws.String("ecs-task")}
+			if network.IPv4SubnetCIDRBlock != "" {
+				subnet.CidrBlock = aws.String(network.IPv4SubnetCIDRBlock)
+			}
+			if network.IPv6SubnetCIDRBlock != "" {
+				subnet.Ipv6CidrBlockAssociationSet = []types.SubnetIpv6CidrBlockAssociation{
+					{Ipv6CidrBlock: aws.String(network.IPv6SubnetCIDRBlock)},
+				}
+			}
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets
+}
+
+// regionFromARN returns the region field of an ARN such as "arn:aws:ecs:us-east-1:123456789012:task/default/abc".
+func regionFromARN(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 6 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[3]
+}
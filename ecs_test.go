@@ -0,0 +1,153 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const testECSTaskMetadata = `{
+  "Cluster": "default",
+  "TaskARN": "arn:aws:ecs:us-east-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+  "AvailabilityZone": "us-east-2b",
+  "LaunchType": "FARGATE",
+  "Containers": [
+    {
+      "Name": "coredns",
+      "Networks": [
+        {
+          "NetworkMode": "awsvpc",
+          "IPv4Addresses": ["10.0.1.108"],
+          "IPv4SubnetCIDRBlock": "10.0.1.0/24",
+          "IPv6SubnetCIDRBlock": "2001:db8:1::/64"
+        }
+      ]
+    }
+  ]
+}`
+
+func TestGetConfigFromECS(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		unsetEnv      bool
+		mockZoneID    func(ctx context.Context, zoneName string, region string) (string, error)
+		expectedErr   string
+		expectedAZ    string
+		expectedCIDRs []string
+	}{
+		{
+			name:   "Fargate task",
+			status: http.StatusOK,
+			body:   testECSTaskMetadata,
+			mockZoneID: func(ctx context.Context, zoneName string, region string) (string, error) {
+				if zoneName != "us-east-2b" || region != "us-east-2" {
+					return "", errors.New("unexpected zone " + zoneName + " in " + region)
+				}
+				// The translation has its own deadline, longer than the metadata fetch.
+				if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) <= 2*time.Second {
+					return "", errors.New("expected a deadline longer than the metadata timeout")
+				}
+				return "use2-az2", nil
+			},
+			expectedAZ:    "use2-az2",
+			expectedCIDRs: []string{"10.0.1.0/24", "2001:db8:1::/64"},
+		},
+		{
+			name:        "Not running on ECS",
+			unsetEnv:    true,
+			expectedErr: "ECS_CONTAINER_METADATA_URI_V4 is not set",
+		},
+		{
+			name:        "Metadata endpoint error",
+			status:      http.StatusInternalServerError,
+			expectedErr: "unexpected status",
+		},
+		{
+			name:        "No availability zone",
+			status:      http.StatusOK,
+			body:        `{"TaskARN": "arn:aws:ecs:us-east-2:111122223333:task/default/abc"}`,
+			expectedErr: "no AvailabilityZone",
+		},
+		{
+			name:   "Zone ID lookup fails",
+			status: http.StatusOK,
+			body:   testECSTaskMetadata,
+			mockZoneID: func(ctx context.Context, zoneName string, region string) (string, error) {
+				return "", errors.New("access denied")
+			},
+			expectedErr: "access denied",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v4/task" {
+					http.NotFound(w, r)
+					return
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			if tc.unsetEnv {
+				t.Setenv(ecsMetadataEnv, "")
+			} else {
+				t.Setenv(ecsMetadataEnv, server.URL+"/v4")
+			}
+			azID, region, subnets, err := getConfigFromECS(tc.mockZoneID)
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Fatalf("Expected error containing '%s', but got: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+
+			if azID != tc.expectedAZ {
+				t.Errorf("Expected zone ID '%s', got '%s'", tc.expectedAZ, azID)
+			}
+			if region != "us-east-2" {
+				t.Errorf("Expected region 'us-east-2', got '%s'", region)
+			}
+
+			var gotCIDRs []string
+			for _, subnet := range subnets {
+				if subnet.CidrBlock != nil {
+					gotCIDRs = append(gotCIDRs, aws.ToString(subnet.CidrBlock))
+				}
+				for _, assoc := range subnet.Ipv6CidrBlockAssociationSet {
+					gotCIDRs = append(gotCIDRs, aws.ToString(assoc.Ipv6CidrBlock))
+				}
+			}
+			if strings.Join(gotCIDRs, ",") != strings.Join(tc.expectedCIDRs, ",") {
+				t.Errorf("Expected CIDRs %v, got %v", tc.expectedCIDRs, gotCIDRs)
+			}
+		})
+	}
+}
+
+func TestRegionFromARN(t *testing.T) {
+	tests := map[string]string{
+		"arn:aws:ecs:us-east-2:111122223333:task/default/abc": "us-east-2",
+		"arn:aws-cn:ecs:cn-north-1:111122223333:task/abc":     "cn-north-1",
+		"not-an-arn": "",
+		"":           "",
+	}
+	for arn, expected := range tests {
+		if got := regionFromARN(arn); got != expected {
+			t.Errorf("regionFromARN(%q) = %q, expected %q", arn, got, expected)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package zoneawareness
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// defaultENIInterval is how often the network interfaces are described again.
+const defaultENIInterval = 5 * time.Minute
+
+// eniOptions selects the network interfaces described by the network_interfaces option.
+type eniOptions struct {
+	vpcIDs   []string
+	tags     map[string]string
+	interval time.Duration
+}
+
+// parseENIOptions parses the arguments of the network_interfaces option: VPC IDs, KEY=VALUE tag filters and
+// interval=INTERVAL. The interval key is taken as the refresh interval, not as a tag filter.
+func parseENIOptions(args []string) (*eniOptions, error) {
+	opts := &eniOptions{tags: make(map[string]string), interval: defaultENIInterval}
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "vpc-"):
+			opts.vpcIDs = append(opts.vpcIDs, arg)
+		case strings.HasPrefix(arg, "interval="):
+			interval, err := time.ParseDuration(strings.TrimPrefix(arg, "interval="))
+			if err != nil {
+				return nil, err
+			}
+			if interval <= 0 {
+				return nil, fmt.Errorf("refresh interval must be positive, got %s", interval)
+			}
+			opts.interval = interval
+		case strings.Contains(arg, "="):
+			key, value, _ := strings.Cut(arg, "=")
+			if key == "" {
+				return nil, fmt.Errorf("empty tag key in '%s'", arg)
+			}
+			opts.tags[key] = value
+		default:
+			return nil, fmt.Errorf("expected a VPC ID or KEY=VALUE tag filter, got '%s'", arg)
+		}
+	}
+	return opts, nil
+}
+
+// eniProvider maps the private addresses of the network interfaces in the region to the zone of each interface, and
+// their delegated prefixes to the zone as CIDRs. The interfaces are described again periodically, as they are created
+// and deleted on scale-out and replacement.
+type eniProvider struct {
+	opts *eniOptions
+
+	getInterfaces func(ctx context.Context, region string, opts *eniOptions) ([]types.NetworkInterface, error)
+}
+
+func (p *eniProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *eniProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *eniProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	region := loc.awsRegion()
+	if region == "" {
+		return nil
+	}
+	var (
+		mapped []Prefix
+		loaded bool
+	)
+	load := func(ctx context.Context) ([]Prefix, bool, error) {
+		interfaces, err := p.getInterfaces(ctx, region, p.opts)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to describe network interfaces: %w", err)
+		}
+		prefixes := networkInterfacePrefixes(interfaces)
+		if loaded && slices.EqualFunc(prefixes, mapped, equalPrefix) {
+			return nil, false, nil
+		}
+		mapped, loaded = prefixes, true
+		log.Infof("Mapped %d address(es) and prefix(es) of %d network interface(s) to their zones", len(prefixes), len(interfaces))
+		return prefixes, true, nil
+	}
+	startMapSource(ctx, "network_interfaces", p.opts.interval, load, update)
+	return nil
+}
+
+// getNetworkInterfacesFromEC2 fetches all network interfaces from the AWS EC2 API, filtered by VPC and tags.
+func getNetworkInterfacesFromEC2(ctx context.Context, region string, opts *eniOptions) ([]types.NetworkInterface, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS SDK config: %w", err)
+	}
+
+	ec2Client := ec2.NewFromConfig(cfg)
+
+	var filters []types.Filter
+	if len(opts.vpcIDs) > 0 {
+		filters = append(filters, types.Filter{Name: aws.String("vpc-id"), Values: opts.vpcIDs})
+	}
+	for key, value := range opts.tags {
+		filters = append(filters, types.Filter{Name: aws.String("tag:" + key), Values: []string{value}})
+	}
+
+	var interfaces []types.NetworkInterface
+	paginator := ec2.NewDescribeNetworkInterfacesPaginator(ec2Client, &ec2.DescribeNetworkInterfacesInput{Filters: filters})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe network interfaces: %w", err)
+		}
+		interfaces = append(interfaces, page.NetworkInterfaces...)
+	}
+
+	return interfaces, nil
+}
+
+// networkInterfacePrefixes returns the private addresses of the network interfaces in the zone ID of each interface,
+// and their delegated prefixes in the zone. Addresses are exact, so they take precedence over subnet CIDRs.
+func networkInterfacePrefixes(interfaces []types.NetworkInterface) []Prefix {
+	var prefixes []Prefix
+	hosts, delegatedPrefixes := 0, 0
+
+	for _, eni := range interfaces {
+		zone := aws.ToString(eni.AvailabilityZoneId)
+		if zone == "" {
+			log.Warningf("Network interface %s has no availability zone ID, skipping", aws.ToString(eni.NetworkInterfaceId))
+			continue
+		}
+		metadata := map[string]string{MetadataName: "network interface " + aws.ToString(eni.NetworkInterfaceId)}
+
+		for _, addr := range eniAddresses(eni) {
+			prefixes = append(prefixes, Prefix{Prefix: netip.PrefixFrom(addr, addr.BitLen()), Zone: zone, Metadata: metadata})
+			hosts++
+		}
+
+		var delegated []string
+		for _, prefix := range eni.Ipv4Prefixes {
+			delegated = append(delegated, aws.ToString(prefix.Ipv4Prefix))
+		}
+		for _, prefix := range eni.Ipv6Prefixes {
+			delegated = append(delegated, aws.ToString(prefix.Ipv6Prefix))
+		}
+		for _, prefix := range delegated {
+			cidr, err := netip.ParsePrefix(prefix)
+			if err != nil {
+				log.Warningf("Invalid delegated prefix '%s' on network interface %s: %v", prefix, aws.ToString(eni.NetworkInterfaceId), err)
+				continue
+			}
+			prefixes = append(prefixes, Prefix{Prefix: cidr, Zone: zone, Metadata: metadata})
+			delegatedPrefixes++
+		}
+	}
+
+	log.Debugf("Found %d address(es) and %d delegated prefix(es) on %d network interface(s)", hosts, delegatedPrefixes, len(interfaces))
+	return prefixes
+}
+
+// eniAddresses returns the private IPv4 and IPv6 addresses of a network interface.
+func eniAddresses(eni types.NetworkInterface) []netip.Addr {
+	addresses := []*string{eni.PrivateIpAddress, eni.Ipv6Address}
+	for _, private := range eni.PrivateIpAddresses {
+		addresses = append(addresses, private.PrivateIpAddress)
+	}
+	for _, ipv6 := range eni.Ipv6Addresses {
+		addresses = append(addresses, ipv6.Ipv6Address)
+	}
+
+	var addrs []netip.Addr
+	for _, address := range addresses {
+		if addr, err := netip.ParseAddr(aws.ToString(address)); err == nil {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,152 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+func TestParseENIOptions(t *testing.T) {
+	opts, err := parseENIOptions([]string{"vpc-1", "team=payments", "vpc-2", "env=", "interval=30s"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if opts.interval != 30*time.Second {
+		t.Errorf("Expected interval 30s, got %s", opts.interval)
+	}
+	if strings.Join(opts.vpcIDs, ",") != "vpc-1,vpc-2" {
+		t.Errorf("Unexpected VPC IDs: %v", opts.vpcIDs)
+	}
+	if len(opts.tags) != 2 || opts.tags["team"] != "payments" || opts.tags["env"] != "" {
+		t.Errorf("Unexpected tags: %v", opts.tags)
+	}
+
+	if opts, _ := parseENIOptions(nil); opts.interval != defaultENIInterval {
+		t.Errorf("Expected the default interval, got %s", opts.interval)
+	}
+	for _, args := range [][]string{{"subnet-1"}, {"=value"}, {"interval=0s"}, {"interval=soon"}} {
+		if _, err := parseENIOptions(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestSetupNetworkInterfaces(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return []types.Subnet{{SubnetId: aws.String("subnet-1"), CidrBlock: aws.String("10.0.0.0/16")}}, nil
+		}
+	})
+
+	var (
+		mu      sync.Mutex
+		gotOpts *eniOptions
+		remote  = "10.0.1.20"
+	)
+	patchProvider(t, "network_interfaces", func(p *eniProvider) {
+		p.getInterfaces = func(ctx context.Context, region string, opts *eniOptions) ([]types.NetworkInterface, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			gotOpts = opts
+			return []types.NetworkInterface{
+				{
+					NetworkInterfaceId: aws.String("eni-local"),
+					AvailabilityZoneId: aws.String("use1-az1"),
+					PrivateIpAddress:   aws.String("10.0.1.10"),
+					PrivateIpAddresses: []types.NetworkInterfacePrivateIpAddress{
+						{PrivateIpAddress: aws.String("10.0.1.10")},
+						{PrivateIpAddress: aws.String("10.0.1.11")},
+					},
+					Ipv4Prefixes: []types.Ipv4PrefixSpecification{{Ipv4Prefix: aws.String("10.0.2.0/28")}},
+				},
+				{
+					// Lives in a shared subnet that overlaps the local one.
+					NetworkInterfaceId: aws.String("eni-remote"),
+					AvailabilityZoneId: aws.String("use1-az2"),
+					PrivateIpAddress:   aws.String(remote),
+					Ipv6Addresses:      []types.NetworkInterfaceIpv6Address{{Ipv6Address: aws.String("2001:db8::20")}},
+					Ipv6Prefixes:       []types.Ipv6PrefixSpecification{{Ipv6Prefix: aws.String("2001:db8:1::/80")}},
+				},
+				{
+					NetworkInterfaceId: aws.String("eni-no-zone"),
+					PrivateIpAddress:   aws.String("10.0.1.30"),
+				},
+			}, nil
+		}
+	})
+
+	corefile := "zoneawareness {\n\tnetwork_interfaces vpc-1 team=payments interval=10ms\n}"
+	c := caddy.NewTestController("dns", corefile)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+
+	// The interfaces are described once the server started.
+	startTestWatchers(t, corefile, za, Location{Zone: "use1-az1", Region: "us-east-1", Cloud: CloudAWS})
+	mu.Lock()
+	if gotOpts == nil || strings.Join(gotOpts.vpcIDs, ",") != "vpc-1" || gotOpts.tags["team"] != "payments" {
+		t.Errorf("Expected VPC and tag filters to be passed on, got %+v", gotOpts)
+	}
+	mu.Unlock()
+
+	rank := func(ip string) int {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.rankIP(net.ParseIP(ip), za.localPath())
+	}
+	tests := map[string]int{
+		"10.0.1.10":      1, // ENI address in the local zone
+		"10.0.1.20":      0, // ENI address in another zone wins over the broader local subnet
+		"10.0.1.30":      1, // ENI without zone falls back to the subnet
+		"10.0.2.5":       1, // Delegated prefix in the local zone
+		"2001:db8::20":   0,
+		"2001:db8:1::10": 0,
+	}
+	for ip, expected := range tests {
+		if rank := rank(ip); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+
+	// The remote interface is replaced by one with another address, which the local subnet covers again.
+	mu.Lock()
+	remote = "10.0.1.21"
+	mu.Unlock()
+	waitFor(t, "the interfaces to be described again", func() bool { return rank("10.0.1.20") == 1 && rank("10.0.1.21") == 0 })
+}
+
+func TestSetupNetworkInterfacesFailure(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+	})
+	patchProvider(t, "network_interfaces", func(p *eniProvider) {
+		p.getInterfaces = func(ctx context.Context, region string, opts *eniOptions) ([]types.NetworkInterface, error) {
+			return nil, errors.New("access denied")
+		}
+	})
+
+	c := caddy.NewTestController("dns", "zoneawareness use1-az1 10.0.0.0/16 {\n\tnetwork_interfaces\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected failed discovery not to be an error, but got: %v", err)
+	}
+	if len(dnsserver.GetConfig(c).Plugin) == 0 {
+		t.Fatal("Expected plugin to be added with the Corefile CIDRs")
+	}
+}
@@ -0,0 +1,303 @@
+package zoneawareness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The GCE metadata server answers on a link-local host, overridable with the environment variable the Google client
+// libraries use.
+// https://cloud.google.com/compute/docs/metadata/overview
+const (
+	gcpMetadataHostEnv     = "GCE_METADATA_HOST"
+	defaultGCPMetadataHost = "metadata.google.internal"
+	defaultGCPInterval     = 5 * time.Minute
+)
+
+// gcpComputeEndpoint is the base URL of the Compute Engine API.
+var gcpComputeEndpoint = "https://compute.googleapis.com/compute/v1/"
+
+// gcpOptions configures the gcp option.
+type gcpOptions struct {
+	project         string // empty for the project of the instance
+	forwardingRules bool
+	interval        time.Duration
+}
+
+// parseGCPOptions parses the arguments of the gcp option: forwarding_rules, project=PROJECT and interval=INTERVAL.
+func parseGCPOptions(args []string) (*gcpOptions, error) {
+	opts := &gcpOptions{interval: defaultGCPInterval}
+	for _, arg := range args {
+		if arg == "forwarding_rules" {
+			opts.forwardingRules = true
+			continue
+		}
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("expected forwarding_rules, project=PROJECT or interval=INTERVAL, got '%s'", arg)
+		}
+		switch key {
+		case "project":
+			opts.project = value
+		case "interval":
+			interval, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			if interval <= 0 {
+				return nil, fmt.Errorf("refresh interval must be positive, got %s", interval)
+			}
+			opts.interval = interval
+		default:
+			return nil, fmt.Errorf("unknown argument '%s'", key)
+		}
+	}
+	return opts, nil
+}
+
+// getGCPMetadata returns the value of path below computeMetadata/v1/ on the GCE metadata server.
+func getGCPMetadata(ctx context.Context, path string) (string, error) {
+	host := os.Getenv(gcpMetadataHostEnv)
+	if host == "" {
+		host = defaultGCPMetadataHost
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/computeMetadata/v1/"+path, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create metadata request: %w", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s from the metadata server: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status for %s from the metadata server: %s", path, resp.Status)
+	}
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s from the metadata server: %w", path, err)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// gcpZoneRegion returns the region of a GCP zone such as "us-central1-a".
+func gcpZoneRegion(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return ""
+}
+
+// gcpZonePath names a GCP zone by its topology path, region/zone. Zone names are only unique within a region's
+// topology level, so addresses in other zones of the local region share the region with the local node.
+func gcpZonePath(zone string) string {
+	return gcpZoneRegion(zone) + "/" + zone
+}
+
+// getConfigFromGCPMetadata fetches the zone and region of the instance from the GCE metadata server. The server
+// reports the zone as "projects/PROJECT-NUMBER/zones/ZONE".
+func getConfigFromGCPMetadata() (string, string, error) {
+	const metadataTimeout = 2 * time.Second // Short timeout to fail fast
+
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+
+	zone, err := getGCPMetadata(ctx, "instance/zone")
+	if err != nil {
+		return "", "", err
+	}
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	region := gcpZoneRegion(zone)
+	if region == "" {
+		return "", "", fmt.Errorf("zone '%s' from the metadata server has an invalid format", zone)
+	}
+	return zone, region, nil
+}
+
+// gcpAggregatedList is a page of an aggregated list of the Compute Engine API, keyed by "zones/ZONE" or
+// "regions/REGION".
+type gcpAggregatedList[T any] struct {
+	Items         map[string]T `json:"items"`
+	NextPageToken string       `json:"nextPageToken"`
+}
+
+// gcpInstancesScope is the subset of an instances scoped list used by this plugin.
+type gcpInstancesScope struct {
+	Instances []struct {
+		Name              string `json:"name"`
+		NetworkInterfaces []struct {
+			NetworkIP     string `json:"networkIP"`
+			IPv6Address   string `json:"ipv6Address"`
+			AliasIPRanges []struct {
+				IPCidrRange string `json:"ipCidrRange"`
+			} `json:"aliasIpRanges"`
+		} `json:"networkInterfaces"`
+	} `json:"instances"`
+}
+
+// gcpForwardingRulesScope is the subset of a forwarding rules scoped list used by this plugin.
+type gcpForwardingRulesScope struct {
+	ForwardingRules []struct {
+		Name                string `json:"name"`
+		IPAddress           string `json:"IPAddress"`
+		LoadBalancingScheme string `json:"loadBalancingScheme"`
+	} `json:"forwardingRules"`
+}
+
+// listGCPAggregated fetches every page of the aggregated list of resource in project, calling handle for every
+// scope.
+func listGCPAggregated[T any](ctx context.Context, token string, project string, resource string, handle func(scope string, items T)) error {
+	pageToken := ""
+	for {
+		query := url.Values{"returnPartialSuccess": {"true"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		u := gcpComputeEndpoint + "projects/" + url.PathEscape(project) + "/aggregated/" + resource + "?" + query.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create request for %s: %w", resource, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", resource, err)
+		}
+		var page gcpAggregatedList[T]
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("unexpected status listing %s: %s", resource, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", resource, err)
+		}
+
+		for scope, items := range page.Items {
+			handle(scope[strings.LastIndex(scope, "/")+1:], items)
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// getGCPAddresses lists the instances of the project and returns the internal addresses of their network interfaces
+// and their alias IP ranges, such as the pod ranges of GKE nodes, mapped to the zone of the instance. Internal
+// forwarding rules are regional and, if enabled, mapped to their region. The access token of the default service
+// account is read from the metadata server.
+func getGCPAddresses(ctx context.Context, opts *gcpOptions) ([]zonalAddress, []zonalCIDR, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	body, err := getGCPMetadata(ctx, "instance/service-accounts/default/token")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal([]byte(body), &token); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode access token: %w", err)
+	}
+
+	project := opts.project
+	if project == "" {
+		if project, err = getGCPMetadata(ctx, "project/project-id"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var addresses []zonalAddress
+	var cidrs []zonalCIDR
+	addAddress := func(s string, zone string, name string) {
+		if s == "" {
+			return
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			log.Warningf("Invalid address '%s' of %s: %v", s, name, err)
+			return
+		}
+		addresses = append(addresses, zonalAddress{addr: addr, zone: zone})
+	}
+
+	err = listGCPAggregated(ctx, token.AccessToken, project, "instances", func(zone string, scope gcpInstancesScope) {
+		for _, instance := range scope.Instances {
+			for _, nic := range instance.NetworkInterfaces {
+				addAddress(nic.NetworkIP, gcpZonePath(zone), "instance "+instance.Name)
+				addAddress(nic.IPv6Address, gcpZonePath(zone), "instance "+instance.Name)
+				for _, alias := range nic.AliasIPRanges {
+					_, cidr, err := net.ParseCIDR(alias.IPCidrRange)
+					if err != nil {
+						log.Warningf("Invalid alias IP range '%s' of instance %s: %v", alias.IPCidrRange, instance.Name, err)
+						continue
+					}
+					cidrs = append(cidrs, zonalCIDR{cidr: cidr, zone: gcpZonePath(zone), region: gcpZoneRegion(zone)})
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if opts.forwardingRules {
+		err = listGCPAggregated(ctx, token.AccessToken, project, "forwardingRules", func(region string, scope gcpForwardingRulesScope) {
+			for _, rule := range scope.ForwardingRules {
+				if strings.HasPrefix(rule.LoadBalancingScheme, "INTERNAL") {
+					addAddress(rule.IPAddress, region, "forwarding rule "+rule.Name)
+				}
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return addresses, cidrs, nil
+}
+
+// startGCP maps the addresses of the instances in the project, listed with getAddresses, to their zones, passing them
+// to update when they change, and refreshes them every interval until ctx is done. A failed refresh keeps the
+// addresses found before.
+func startGCP(ctx context.Context, opts *gcpOptions, getAddresses func(ctx context.Context, opts *gcpOptions) ([]zonalAddress, []zonalCIDR, error), update func([]Prefix)) error {
+	var (
+		mapped []Prefix
+		loaded bool
+	)
+	load := func(ctx context.Context) ([]Prefix, bool, error) {
+		addresses, cidrs, err := getAddresses(ctx, opts)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to list GCP instances: %w", err)
+		}
+		prefixes := make([]Prefix, 0, len(addresses)+len(cidrs))
+		for _, address := range addresses {
+			prefixes = append(prefixes, Prefix{Prefix: netip.PrefixFrom(address.addr, address.addr.BitLen()), Zone: address.zone})
+		}
+		for _, c := range cidrs {
+			prefixes = append(prefixes, Prefix{Prefix: ipNetPrefix(c.cidr), Zone: c.zone})
+		}
+		if loaded && slices.EqualFunc(prefixes, mapped, equalPrefix) {
+			return nil, false, nil
+		}
+		mapped, loaded = prefixes, true
+		log.Infof("Mapped %d GCP address(es) and alias IP range(s) to their zones", len(prefixes))
+		return prefixes, true, nil
+	}
+	startMapSource(ctx, "gcp", opts.interval, load, update)
+	return nil
+}
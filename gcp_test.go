@@ -0,0 +1,177 @@
+package zoneawareness
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+// newFakeGCP starts a stand-in for the GCE metadata server and the Compute Engine API, serving responses keyed by
+// path. Compute requests are keyed by path and page token, e.g. "/projects/p/aggregated/instances?pageToken=2".
+func newFakeGCP(t *testing.T, responses map[string]string) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path
+		if strings.HasPrefix(key, "/computeMetadata/") {
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+				return
+			}
+		} else {
+			if r.Header.Get("Authorization") != "Bearer test-token" {
+				http.Error(w, "unauthenticated", http.StatusUnauthorized)
+				return
+			}
+			if token := r.URL.Query().Get("pageToken"); token != "" {
+				key += "?pageToken=" + token
+			}
+		}
+		body, ok := responses[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv(gcpMetadataHostEnv, strings.TrimPrefix(server.URL, "http://"))
+	origEndpoint := gcpComputeEndpoint
+	gcpComputeEndpoint = server.URL + "/"
+	t.Cleanup(func() { gcpComputeEndpoint = origEndpoint })
+}
+
+func TestGetConfigFromGCPMetadata(t *testing.T) {
+	newFakeGCP(t, map[string]string{"/computeMetadata/v1/instance/zone": "projects/123456789/zones/europe-west4-b\n"})
+
+	zone, region, err := getConfigFromGCPMetadata()
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if zone != "europe-west4-b" || region != "europe-west4" {
+		t.Errorf("Expected zone europe-west4-b in europe-west4, got %s in %s", zone, region)
+	}
+}
+
+func TestGetGCPAddresses(t *testing.T) {
+	newFakeGCP(t, map[string]string{
+		"/computeMetadata/v1/instance/service-accounts/default/token": `{"access_token":"test-token","expires_in":3599,"token_type":"Bearer"}`,
+		"/computeMetadata/v1/project/project-id":                      "my-project",
+		"/projects/my-project/aggregated/instances": `{
+  "items": {
+    "zones/us-central1-a": {"instances": [{"name": "gke-node-1", "networkInterfaces": [
+      {"networkIP": "10.128.0.2", "ipv6Address": "fd20:1::", "aliasIpRanges": [{"ipCidrRange": "10.4.0.0/24"}]}
+    ]}]},
+    "zones/us-east1-b": {"warning": {"code": "NO_RESULTS_ON_PAGE"}}
+  },
+  "nextPageToken": "2"
+}`,
+		"/projects/my-project/aggregated/instances?pageToken=2": `{
+  "items": {
+    "zones/us-central1-b": {"instances": [{"name": "vm-2", "networkInterfaces": [{"networkIP": "10.128.0.3"}]}]}
+  }
+}`,
+		"/projects/my-project/aggregated/forwardingRules": `{
+  "items": {
+    "regions/us-central1": {"forwardingRules": [
+      {"name": "ilb", "IPAddress": "10.128.0.50", "loadBalancingScheme": "INTERNAL"},
+      {"name": "public", "IPAddress": "34.1.2.3", "loadBalancingScheme": "EXTERNAL"}
+    ]}
+  }
+}`,
+	})
+
+	addresses, cidrs, err := getGCPAddresses(context.Background(), &gcpOptions{forwardingRules: true})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	expected := map[string]string{
+		"10.128.0.2":  "us-central1/us-central1-a",
+		"fd20:1::":    "us-central1/us-central1-a",
+		"10.128.0.3":  "us-central1/us-central1-b",
+		"10.128.0.50": "us-central1",
+	}
+	if got := addressZones(addresses); len(got) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	} else {
+		for addr, zone := range expected {
+			if got[addr] != zone {
+				t.Errorf("Expected %s in zone '%s', got '%s'", addr, zone, got[addr])
+			}
+		}
+	}
+	if len(cidrs) != 1 || cidrs[0].cidr.String() != "10.4.0.0/24" || cidrs[0].zone != "us-central1/us-central1-a" {
+		t.Errorf("Unexpected alias IP ranges: %v", cidrs)
+	}
+}
+
+func TestParseGCPOptions(t *testing.T) {
+	opts, err := parseGCPOptions([]string{"forwarding_rules", "project=my-project", "interval=1m"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !opts.forwardingRules || opts.project != "my-project" || opts.interval != time.Minute {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+	for _, args := range [][]string{{"instances"}, {"project="}, {"interval=0s"}, {"zone=us-central1-a"}} {
+		if _, err := parseGCPOptions(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestSetupGCP(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "gcp", func(p *gcpProvider) {
+		p.getConfig = func() (string, string, error) { return "us-central1-a", "us-central1", nil }
+	})
+
+	c := caddy.NewTestController("dns", "zoneawareness {\n\tgcp\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+	if local := za.localPath(); !slices.Equal(local, []string{"us-central1", "us-central1-a"}) {
+		t.Errorf("Expected local path us-central1/us-central1-a, got %v", local)
+	}
+
+	getAddresses := func(ctx context.Context, opts *gcpOptions) ([]zonalAddress, []zonalCIDR, error) {
+		_, alias, _ := net.ParseCIDR("10.4.0.0/24")
+		return []zonalAddress{
+			{addr: netip.MustParseAddr("10.128.0.2"), zone: "us-central1/us-central1-a"},
+			{addr: netip.MustParseAddr("10.128.0.3"), zone: "us-central1/us-central1-b"},
+			{addr: netip.MustParseAddr("10.132.0.2"), zone: "europe-west1/europe-west1-b"},
+			{addr: netip.MustParseAddr("10.128.0.50"), zone: "us-central1"},
+		}, []zonalCIDR{
+			{cidr: alias, zone: "us-central1/us-central1-a", region: "us-central1"},
+		}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	update := func(prefixes []Prefix) { za.setProviderPrefixes("gcp", prefixes) }
+	if err := startGCP(ctx, &gcpOptions{interval: time.Hour}, getAddresses, update); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	for ip, expected := range map[string]int{"10.128.0.2": 2, "10.4.0.9": 2, "10.128.0.3": 1, "10.128.0.50": 1, "10.132.0.2": 0} {
+		if rank := za.rankIP(net.ParseIP(ip), za.localPath()); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package zoneawareness
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// defaultZoneTag is the tag holding the zone of an AWS resource, as a zone ID or name.
+const defaultZoneTag = "zoneawareness/zone"
+
+// ipamOptions selects the IPAM pools whose allocations are mapped to zones by the ipam_pools option.
+type ipamOptions struct {
+	poolIDs []string
+	zoneTag string
+	region  string // IPAM home region, empty for the discovered region
+}
+
+// parseIPAMOptions parses the arguments of the ipam_pools option: pool IDs followed by optional tag=KEY and
+// region=REGION arguments.
+func parseIPAMOptions(args []string) (*ipamOptions, error) {
+	opts := &ipamOptions{zoneTag: defaultZoneTag}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "ipam-pool-") {
+			opts.poolIDs = append(opts.poolIDs, arg)
+			continue
+		}
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("expected an IPAM pool ID, tag=KEY or region=REGION, got '%s'", arg)
+		}
+		switch key {
+		case "tag":
+			opts.zoneTag = value
+		case "region":
+			opts.region = value
+		default:
+			return nil, fmt.Errorf("unknown argument '%s'", key)
+		}
+	}
+	return opts, nil
+}
+
+// zonalCIDR is a CIDR and the zone it belongs to, optionally with the region of the zone.
+type zonalCIDR struct {
+	cidr   *net.IPNet
+	zone   string
+	region string
+}
+
+// ipamProvider maps the allocations of VPC IPAM pools to the zones of their pools, classifying ranges of VPCs that
+// can't be described directly.
+type ipamProvider struct {
+	opts *ipamOptions
+
+	zoneID         zoneIDFunc
+	getAllocations func(ctx context.Context, region string, opts *ipamOptions, zoneID zoneIDFunc) ([]zonalCIDR, error)
+}
+
+func (p *ipamProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *ipamProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	region := loc.awsRegion()
+	if region == "" {
+		return nil, nil
+	}
+	allocations, err := p.getAllocations(ctx, region, p.opts, p.zoneID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IPAM pool allocations: %w", err)
+	}
+	return zonalCIDRPrefixes(allocations), nil
+}
+
+// getIPAMAllocations returns the allocations of the selected IPAM pools, or of all pools, each with the zone of its
+// pool. The zone is taken from the zone tag of the pool and translated to a zone ID if needed; pools without the tag
+// map their allocations to their locale, the region the pool allocates to. Pools with neither are skipped. Zone names
+// are translated with zoneID.
+func getIPAMAllocations(ctx context.Context, region string, opts *ipamOptions, zoneID zoneIDFunc) ([]zonalCIDR, error) {
+	if opts.region != "" {
+		region = opts.region
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS SDK config: %w", err)
+	}
+
+	ec2Client := ec2.NewFromConfig(cfg)
+
+	var pools []types.IpamPool
+	paginator := ec2.NewDescribeIpamPoolsPaginator(ec2Client, &ec2.DescribeIpamPoolsInput{IpamPoolIds: opts.poolIDs})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe IPAM pools: %w", err)
+		}
+		pools = append(pools, page.IpamPools...)
+	}
+
+	zones := make(map[string]*zoneResolver)
+	var allocations []zonalCIDR
+	for _, pool := range pools {
+		poolID := aws.ToString(pool.IpamPoolId)
+		locale := aws.ToString(pool.Locale)
+		if locale == "None" {
+			locale = ""
+		}
+
+		zone := locale
+		for _, tag := range pool.Tags {
+			if aws.ToString(tag.Key) == opts.zoneTag && aws.ToString(tag.Value) != "" {
+				// Zone names are translated in the region the pool allocates to.
+				resolverRegion := locale
+				if resolverRegion == "" {
+					resolverRegion = region
+				}
+				if zones[resolverRegion] == nil {
+					zones[resolverRegion] = newZoneResolver(resolverRegion, zoneID)
+				}
+				zone = zones[resolverRegion].resolve(ctx, aws.ToString(tag.Value))
+			}
+		}
+		if zone == "" {
+			log.Infof("Skipping IPAM pool %s: no %s tag and no locale", poolID, opts.zoneTag)
+			continue
+		}
+
+		allocationPages := ec2.NewGetIpamPoolAllocationsPaginator(ec2Client, &ec2.GetIpamPoolAllocationsInput{IpamPoolId: pool.IpamPoolId})
+		for allocationPages.HasMorePages() {
+			page, err := allocationPages.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get allocations of IPAM pool %s: %w", poolID, err)
+			}
+			for _, allocation := range page.IpamPoolAllocations {
+				_, cidr, err := net.ParseCIDR(aws.ToString(allocation.Cidr))
+				if err != nil {
+					log.Warningf("Invalid CIDR '%s' allocated from IPAM pool %s: %v", aws.ToString(allocation.Cidr), poolID, err)
+					continue
+				}
+				allocations = append(allocations, zonalCIDR{cidr: cidr, zone: zone, region: locale})
+			}
+		}
+	}
+	return allocations, nil
+}
+
+// zonalCIDRPrefixes returns each CIDR in its zone. A zone in a region is placed below the region.
+func zonalCIDRPrefixes(cidrs []zonalCIDR) []Prefix {
+	prefixes := make([]Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		p := Prefix{Prefix: ipNetPrefix(c.cidr), Zone: c.zone, Metadata: map[string]string{MetadataName: "IPAM"}}
+		if c.region != "" && c.zone != c.region {
+			p.Metadata[MetadataRegion] = c.region
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
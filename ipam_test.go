@@ -0,0 +1,121 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+func TestGetIPAMAllocations(t *testing.T) {
+	zoneID := func(ctx context.Context, zoneName string, region string) (string, error) {
+		if zoneName == "us-east-1b" && region == "us-east-1" {
+			return "use1-az2", nil
+		}
+		return "", errors.New("unknown zone")
+	}
+
+	requests := newFakeAWSAPI(t, "EC2", map[string]string{
+		"DescribeIpamPools": `<DescribeIpamPoolsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>1</requestId>
+  <ipamPoolSet>
+    <item>
+      <ipamPoolId>ipam-pool-az</ipamPoolId>
+      <locale>us-east-1</locale>
+      <tagSet><item><key>zone</key><value>us-east-1b</value></item></tagSet>
+    </item>
+    <item>
+      <ipamPoolId>ipam-pool-top</ipamPoolId>
+      <locale>None</locale>
+    </item>
+  </ipamPoolSet>
+</DescribeIpamPoolsResponse>`,
+		"GetIpamPoolAllocations": `<GetIpamPoolAllocationsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>2</requestId>
+  <ipamPoolAllocationSet>
+    <item><cidr>10.40.0.0/20</cidr><resourceType>vpc</resourceType><resourceId>vpc-1</resourceId></item>
+    <item><cidr>10.40.16.0/20</cidr><resourceType>custom</resourceType></item>
+  </ipamPoolAllocationSet>
+</GetIpamPoolAllocationsResponse>`,
+	})
+
+	opts, err := parseIPAMOptions([]string{"ipam-pool-az", "ipam-pool-top", "tag=zone", "region=us-east-1"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	allocations, err := getIPAMAllocations(context.Background(), "eu-west-1", opts, zoneID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, allocation := range allocations {
+		got[allocation.cidr.String()] = allocation.zone
+	}
+	if len(got) != 2 || got["10.40.0.0/20"] != "use1-az2" || got["10.40.16.0/20"] != "use1-az2" {
+		t.Errorf("Unexpected allocations: %v", got)
+	}
+
+	sent := requests()
+	if len(sent) != 2 || sent[0].Get("IpamPoolId.1") != "ipam-pool-az" || sent[1].Get("IpamPoolId") != "ipam-pool-az" {
+		t.Errorf("Expected the allocations of the tagged pool only, got %v", sent)
+	}
+}
+
+func TestParseIPAMOptions(t *testing.T) {
+	opts, err := parseIPAMOptions(nil)
+	if err != nil || len(opts.poolIDs) != 0 || opts.zoneTag != defaultZoneTag || opts.region != "" {
+		t.Errorf("Unexpected defaults: %+v, %v", opts, err)
+	}
+	for _, args := range [][]string{{"pool-1"}, {"tag="}, {"scope=private"}} {
+		if _, err := parseIPAMOptions(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestSetupIPAMPools(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+	})
+	patchProvider(t, "ipam_pools", func(p *ipamProvider) {
+		p.getAllocations = func(ctx context.Context, region string, opts *ipamOptions, zoneID zoneIDFunc) ([]zonalCIDR, error) {
+			cidr := func(s string) *net.IPNet {
+				_, n, _ := net.ParseCIDR(s)
+				return n
+			}
+			return []zonalCIDR{
+				{cidr: cidr("10.40.0.0/20"), zone: "use1-az1", region: "us-east-1"},
+				{cidr: cidr("10.40.16.0/20"), zone: "use1-az2", region: "us-east-1"},
+				{cidr: cidr("10.40.0.0/16"), zone: "us-east-1", region: "us-east-1"},
+				{cidr: cidr("10.50.0.0/16"), zone: "euw1-az1", region: "eu-west-1"},
+			}, nil
+		}
+	})
+
+	c := caddy.NewTestController("dns", "zoneawareness {\n\tipam_pools\n\tregions\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+
+	for ip, expected := range map[string]int{
+		"10.40.0.1":  2, // current zone
+		"10.40.16.1": 1, // other zone in the same region
+		"10.40.32.1": 1, // region level allocation
+		"10.50.0.1":  0, // other region
+	} {
+		if rank := za.rankIP(net.ParseIP(ip), za.localPath()); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+}
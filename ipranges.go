@@ -0,0 +1,203 @@
+package zoneawareness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// AWS publishes the public IP ranges of its services, with the region and network border group of each prefix.
+// https://docs.aws.amazon.com/vpc/latest/userguide/aws-ip-ranges.html
+const (
+	defaultAWSIPRangesSource   = "https://ip-ranges.amazonaws.com/ip-ranges.json"
+	defaultAWSIPRangesInterval = 12 * time.Hour
+)
+
+// awsIPRangesOptions configures the aws_ip_ranges option.
+type awsIPRangesOptions struct {
+	source   string // local path or http(s) URL
+	interval time.Duration
+}
+
+// parseAWSIPRangesOptions parses the arguments of the aws_ip_ranges option: an optional path or URL and an optional
+// refresh interval.
+func parseAWSIPRangesOptions(args []string) (*awsIPRangesOptions, error) {
+	opts := &awsIPRangesOptions{source: defaultAWSIPRangesSource, interval: defaultAWSIPRangesInterval}
+	if len(args) > 2 {
+		return nil, fmt.Errorf("expected at most a source and a refresh interval, got %d arguments", len(args))
+	}
+	if len(args) > 0 {
+		opts.source = args[0]
+	}
+	if len(args) > 1 {
+		interval, err := time.ParseDuration(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("refresh interval must be positive, got %s", interval)
+		}
+		opts.interval = interval
+	}
+	return opts, nil
+}
+
+// awsIPPrefix is an entry of the prefixes or ipv6_prefixes list of ip-ranges.json.
+type awsIPPrefix struct {
+	IPPrefix           string `json:"ip_prefix"`
+	IPv6Prefix         string `json:"ipv6_prefix"`
+	Region             string `json:"region"`
+	NetworkBorderGroup string `json:"network_border_group"`
+}
+
+// path returns the topology path of the prefix: its region and, for Local Zones and Wavelength Zones, the network
+// border group within the region. Prefixes that are not bound to a region have no path.
+func (p awsIPPrefix) path() []string {
+	if p.Region == "" || p.Region == "GLOBAL" {
+		return nil
+	}
+	if p.NetworkBorderGroup != "" && p.NetworkBorderGroup != p.Region {
+		return []string{p.Region, p.NetworkBorderGroup}
+	}
+	return []string{p.Region}
+}
+
+// parseAWSIPRanges reads an ip-ranges.json document one prefix at a time, without holding the document in memory,
+// and returns its sync token and the prefixes, each in the zone named by its path. A prefix listed for several
+// services is returned once.
+func parseAWSIPRanges(r io.Reader) (string, []Prefix, error) {
+	decoder := json.NewDecoder(r)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return "", nil, err
+	}
+
+	syncToken := ""
+	var prefixes []Prefix
+	seen := make(map[netip.Prefix]bool)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", nil, err
+		}
+		switch token {
+		case "syncToken":
+			if err := decoder.Decode(&syncToken); err != nil {
+				return "", nil, fmt.Errorf("failed to decode syncToken: %w", err)
+			}
+		case "prefixes", "ipv6_prefixes":
+			if err := expectDelim(decoder, '['); err != nil {
+				return "", nil, err
+			}
+			for decoder.More() {
+				entry := awsIPPrefix{}
+				if err := decoder.Decode(&entry); err != nil {
+					return "", nil, fmt.Errorf("failed to decode %s entry: %w", token, err)
+				}
+				path := entry.path()
+				if path == nil {
+					continue
+				}
+				prefix, err := netip.ParsePrefix(entry.IPPrefix + entry.IPv6Prefix)
+				if err != nil {
+					log.Debugf("Ignoring invalid prefix in AWS IP ranges: %v", err)
+					continue
+				}
+				prefix = prefix.Masked()
+				if seen[prefix] {
+					continue
+				}
+				seen[prefix] = true
+				prefixes = append(prefixes, Prefix{Prefix: prefix, Zone: strings.Join(path, "/")})
+			}
+			if err := expectDelim(decoder, ']'); err != nil {
+				return "", nil, err
+			}
+		default:
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return "", nil, fmt.Errorf("failed to decode %v: %w", token, err)
+			}
+		}
+	}
+	return syncToken, prefixes, nil
+}
+
+// expectDelim reads the next token and checks that it is delim.
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected '%s', got %v", delim, token)
+	}
+	return nil
+}
+
+// openAWSIPRanges opens source, an http(s) URL or a local path.
+func openAWSIPRanges(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %s: %w", source, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", source, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status for %s: %s", source, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// awsIPRangesProvider loads the public AWS IP ranges and reloads them periodically, placing each prefix below its
+// region. It does not locate the node.
+type awsIPRangesProvider struct {
+	opts *awsIPRangesOptions
+}
+
+func (p *awsIPRangesProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *awsIPRangesProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *awsIPRangesProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	syncToken := ""
+	load := func(ctx context.Context) ([]Prefix, bool, error) {
+		body, err := openAWSIPRanges(ctx, p.opts.source)
+		if err != nil {
+			return nil, false, err
+		}
+		defer body.Close()
+
+		token, prefixes, err := parseAWSIPRanges(body)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse AWS IP ranges from %s: %w", p.opts.source, err)
+		}
+		if token != "" && token == syncToken {
+			log.Debugf("AWS IP ranges unchanged (syncToken %s)", token)
+			return nil, false, nil
+		}
+		syncToken = token
+		log.Infof("Loaded %d AWS IP prefix(es) from %s (syncToken %s)", len(prefixes), p.opts.source, token)
+		return prefixes, true, nil
+	}
+	startMapSource(ctx, "aws_ip_ranges", p.opts.interval, load, update)
+	return nil
+}
+
+func (p *awsIPRangesProvider) regional() bool { return true }
@@ -0,0 +1,191 @@
+package zoneawareness
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+const testAWSIPRanges = `{
+  "syncToken": "1700000000",
+  "createDate": "2023-11-14-22-13-20",
+  "prefixes": [
+    {"ip_prefix": "52.216.0.0/15", "region": "us-east-1", "service": "AMAZON", "network_border_group": "us-east-1"},
+    {"ip_prefix": "52.216.0.0/15", "region": "us-east-1", "service": "S3", "network_border_group": "us-east-1"},
+    {"ip_prefix": "15.181.232.0/21", "region": "us-east-1", "service": "EC2", "network_border_group": "us-east-1-bos-1"},
+    {"ip_prefix": "52.218.0.0/17", "region": "eu-west-1", "service": "S3", "network_border_group": "eu-west-1"},
+    {"ip_prefix": "52.94.76.0/22", "region": "GLOBAL", "service": "AMAZON", "network_border_group": "GLOBAL"},
+    {"ip_prefix": "not-a-prefix", "region": "us-east-1", "service": "AMAZON", "network_border_group": "us-east-1"}
+  ],
+  "ipv6_prefixes": [
+    {"ipv6_prefix": "2600:1f18::/36", "region": "us-east-1", "service": "EC2", "network_border_group": "us-east-1"}
+  ]
+}`
+
+func TestParseAWSIPRanges(t *testing.T) {
+	syncToken, prefixes, err := parseAWSIPRanges(strings.NewReader(testAWSIPRanges))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if syncToken != "1700000000" {
+		t.Errorf("Expected syncToken 1700000000, got %s", syncToken)
+	}
+	if len(prefixes) != 4 {
+		t.Errorf("Expected 4 prefixes, got %d", len(prefixes))
+	}
+
+	for addr, expected := range map[string]string{
+		"52.216.1.1":       "us-east-1",
+		"15.181.232.10":    "us-east-1/us-east-1-bos-1",
+		"52.218.1.1":       "eu-west-1",
+		"2600:1f18:234::1": "us-east-1",
+		"52.94.76.1":       "",
+	} {
+		zone := ""
+		for _, p := range prefixes {
+			if p.Prefix.Contains(netip.MustParseAddr(addr)) {
+				zone = p.Zone
+			}
+		}
+		if zone != expected {
+			t.Errorf("Expected %s to be in zone '%s', got '%s'", addr, expected, zone)
+		}
+	}
+
+	if _, _, err := parseAWSIPRanges(strings.NewReader(`{"prefixes": {}}`)); err == nil {
+		t.Error("Expected an error for a malformed document")
+	}
+}
+
+func TestParseAWSIPRangesOptions(t *testing.T) {
+	opts, err := parseAWSIPRangesOptions(nil)
+	if err != nil || opts.source != defaultAWSIPRangesSource || opts.interval != defaultAWSIPRangesInterval {
+		t.Errorf("Unexpected defaults: %+v, %v", opts, err)
+	}
+	opts, err = parseAWSIPRangesOptions([]string{"/etc/ip-ranges.json", "1h"})
+	if err != nil || opts.source != "/etc/ip-ranges.json" || opts.interval != time.Hour {
+		t.Errorf("Unexpected options: %+v, %v", opts, err)
+	}
+	for _, args := range [][]string{{"/etc/ip-ranges.json", "0s"}, {"a", "1h", "b"}} {
+		if _, err := parseAWSIPRangesOptions(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestStartAWSIPRanges(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(testAWSIPRanges))
+	}))
+	t.Cleanup(server.Close)
+
+	za := &Zoneawareness{Zones: make(map[string]*Zone), currentAvailabilityZoneId: "use1-az1", topology: []string{"us-east-1", "use1-az1"}}
+	za.setProviderPrefixes("ec2", []Prefix{{Prefix: netip.MustParsePrefix("52.216.4.0/24"), Zone: "use1-az1"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	provider := &awsIPRangesProvider{opts: &awsIPRangesOptions{source: server.URL, interval: 10 * time.Millisecond}}
+	if err := provider.Watch(ctx, Location{}, func(prefixes []Prefix) { za.setProviderPrefixes("aws_ip_ranges", prefixes) }); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	rank := func(ip string) int {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.rankIP(net.ParseIP(ip), za.localPath())
+	}
+	for ip, expected := range map[string]int{
+		"52.216.4.1":    2, // The subnet is more specific than the region prefix
+		"52.216.9.1":    1, // Public endpoint in the same region
+		"15.181.232.10": 1, // Local Zone of the same region
+		"52.218.1.1":    0, // Other region
+	} {
+		if got := rank(ip); got != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, got)
+		}
+	}
+
+	waitFor(t, "a refresh", func() bool { return requests.Load() > 2 })
+}
+
+func TestStartAWSIPRangesFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip-ranges.json")
+	if err := os.WriteFile(path, []byte(`{"syncToken": "1", "prefixes": []}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	za := &Zoneawareness{Zones: make(map[string]*Zone), currentAvailabilityZoneId: "use1-az1", topology: []string{"us-east-1", "use1-az1"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	provider := &awsIPRangesProvider{opts: &awsIPRangesOptions{source: path, interval: 10 * time.Millisecond}}
+	if err := provider.Watch(ctx, Location{}, func(prefixes []Prefix) { za.setProviderPrefixes("aws_ip_ranges", prefixes) }); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	rank := func(ip string) int {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.rankIP(net.ParseIP(ip), za.localPath())
+	}
+	if got := rank("52.216.9.1"); got != 0 {
+		t.Errorf("Expected no rank before the file changed, got %d", got)
+	}
+
+	// A broken file keeps the ranges loaded before, a new sync token replaces them.
+	if err := os.WriteFile(path, []byte(`{"syncToken": "2", "prefixes": [`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(path, []byte(testAWSIPRanges), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the new ranges", func() bool { return rank("52.216.9.1") == 1 })
+}
+
+func TestSetupAWSIPRanges(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+	})
+
+	c := caddy.NewTestController("dns", "zoneawareness {\n\taws_ip_ranges /etc/ip-ranges.json 1h\n}")
+	opts, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(opts.sources) != 1 {
+		t.Fatalf("Expected one source, got %d", len(opts.sources))
+	}
+	provider, ok := opts.sources[0].provider.(*awsIPRangesProvider)
+	if !ok || provider.opts.source != "/etc/ip-ranges.json" || provider.opts.interval != time.Hour {
+		t.Errorf("Unexpected aws_ip_ranges provider: %+v", opts.sources[0].provider)
+	}
+
+	// Without any CIDRs the plugin is added, as the ranges are loaded once the server starts.
+	c = caddy.NewTestController("dns", "zoneawareness {\n\taws_ip_ranges\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+	if got := strings.Join(za.localPath(), "/"); got != "us-east-1/use1-az1" {
+		t.Errorf("Expected local path 'us-east-1/use1-az1', got '%s'", got)
+	}
+}
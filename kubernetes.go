@@ -0,0 +1,439 @@
+package zoneawareness
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-cluster service account credentials, mounted into every pod.
+const (
+	kubeTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// Well known node labels. EKS sets the zone ID label, the others are set by every cloud provider.
+const (
+	kubeZoneIDLabel = "topology.k8s.aws/zone-id"
+	kubeZoneLabel   = "topology.kubernetes.io/zone"
+	kubeRegionLabel = "topology.kubernetes.io/region"
+)
+
+// kubeNodeNameEnv is the environment variable holding the name of the node, set through the downward API:
+//
+//	env:
+//	- name: NODE_NAME
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: spec.nodeName
+const kubeNodeNameEnv = "NODE_NAME"
+
+// kubeTokenTTL is how long a service account token read from its file is used before the file is read again. The
+// kubelet rotates projected tokens, typically every hour, and an expired token is rejected by the API server.
+var kubeTokenTTL = time.Minute
+
+// kubeClient is a minimal read-only client for the Kubernetes API.
+type kubeClient struct {
+	host string
+	// tokenFile, when set, is read again for token once kubeTokenTTL has passed since tokenRead.
+	tokenFile string
+	client    *http.Client
+
+	mu        sync.Mutex
+	token     string
+	tokenRead time.Time
+}
+
+// kubeObjectMeta is the subset of metav1.ObjectMeta used by this plugin.
+type kubeObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	Labels          map[string]string `json:"labels"`
+	ResourceVersion string            `json:"resourceVersion"`
+}
+
+// kubeObject is implemented by the Kubernetes resources this plugin lists and watches.
+type kubeObject interface {
+	objectMeta() kubeObjectMeta
+}
+
+// kubeNode is the subset of a v1.Node used by this plugin.
+type kubeNode struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		PodCIDR    string   `json:"podCIDR"`
+		PodCIDRs   []string `json:"podCIDRs"`
+		ProviderID string   `json:"providerID"`
+	} `json:"spec"`
+}
+
+func (n kubeNode) objectMeta() kubeObjectMeta { return n.Metadata }
+
+// cloud returns the cloud the node runs in, from the scheme of its provider ID such as "aws:///us-east-1a/i-0abc",
+// or empty if unknown.
+func (n kubeNode) cloud() string {
+	scheme, _, ok := strings.Cut(n.Spec.ProviderID, "://")
+	if !ok {
+		return ""
+	}
+	switch scheme {
+	case "aws":
+		return CloudAWS
+	case "gce":
+		return CloudGCP
+	case "azure":
+		return CloudAzure
+	}
+	return ""
+}
+
+// zone returns the zone of the node, preferring the EKS zone ID label over the zone name.
+func (n kubeNode) zone() string {
+	if zone := n.Metadata.Labels[kubeZoneIDLabel]; zone != "" {
+		return zone
+	}
+	return n.Metadata.Labels[kubeZoneLabel]
+}
+
+// newInClusterKubeClient creates a client using the service account of the pod CoreDNS runs in.
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set (not running in a cluster)")
+	}
+
+	token, err := os.ReadFile(kubeTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	ca, err := os.ReadFile(kubeCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", kubeCAFile)
+	}
+
+	return &kubeClient{
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: kubeTokenFile,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+		},
+		token:     strings.TrimSpace(string(token)),
+		tokenRead: time.Now(),
+	}, nil
+}
+
+// bearerToken returns the token to authenticate with, reading the token file again once kubeTokenTTL has passed. If
+// the file can't be read the token read before is used.
+func (k *kubeClient) bearerToken() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.tokenFile == "" || time.Since(k.tokenRead) < kubeTokenTTL {
+		return k.token
+	}
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		log.Warningf("Failed to read service account token again, using the token read before: %v", err)
+		return k.token
+	}
+	k.token, k.tokenRead = strings.TrimSpace(string(token)), time.Now()
+	return k.token
+}
+
+// get fetches path from the API server and decodes the JSON response into v.
+func (k *kubeClient) get(ctx context.Context, path string, query url.Values, v any) error {
+	resp, err := k.do(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// do sends a GET request for path to the API server and returns the response if it was successful.
+func (k *kubeClient) do(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := k.host + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %s: %w", path, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if token := k.bearerToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status for %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// getConfigFromKubernetesNode fetches the location of the node CoreDNS runs on from its labels, and the cloud from its
+// provider ID. The custom label, if set, is checked first, then the EKS zone ID label and finally the well known zone
+// label. The node is read with a client created by newClient. On AWS a zone name such as "us-east-1a" is translated to
+// its zone ID with zoneID.
+func getConfigFromKubernetesNode(label string, newClient func() (*kubeClient, error), zoneID zoneIDFunc) (Location, error) {
+	const kubeTimeout = 5 * time.Second
+
+	nodeName := os.Getenv(kubeNodeNameEnv)
+	if nodeName == "" {
+		return Location{}, fmt.Errorf("%s is not set", kubeNodeNameEnv)
+	}
+
+	client, err := newClient()
+	if err != nil {
+		return Location{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+
+	node := &kubeNode{}
+	if err := client.get(ctx, "/api/v1/nodes/"+url.PathEscape(nodeName), nil, node); err != nil {
+		return Location{}, err
+	}
+
+	loc := Location{Region: node.Metadata.Labels[kubeRegionLabel], Cloud: node.cloud()}
+
+	for _, key := range []string{label, kubeZoneIDLabel, kubeZoneLabel} {
+		value := node.Metadata.Labels[key]
+		if key == "" || value == "" {
+			continue
+		}
+		if loc.Cloud != CloudAWS || awsZoneIDPattern.MatchString(value) {
+			loc.Zone = value
+			return loc, nil
+		}
+		if loc.Region == "" {
+			return Location{}, fmt.Errorf("node %s label %s=%s is not a zone ID and the node has no %s label to translate it", nodeName, key, value, kubeRegionLabel)
+		}
+		azID, err := zoneID(ctx, value, loc.Region)
+		if err != nil {
+			return Location{}, err
+		}
+		if !awsZoneIDPattern.MatchString(azID) {
+			return Location{}, fmt.Errorf("zone ID '%s' for availability zone '%s' has an invalid format", azID, value)
+		}
+		loc.Zone = azID
+		return loc, nil
+	}
+
+	return Location{}, fmt.Errorf("node %s has no zone label", nodeName)
+}
+
+// kubeRetryInterval is how long a failed list or watch waits before trying again.
+var kubeRetryInterval = 10 * time.Second
+
+// kubeWatchTimeout is the server side timeout of a single watch request, after which the resource is listed again.
+const kubeWatchTimeout = 5 * time.Minute
+
+// kubeListLimit is the number of objects asked for per list request. Larger lists are read in several pages, so the
+// pods of a large cluster don't come back in a single response.
+const kubeListLimit = 500
+
+// kubeList is a list response of the Kubernetes API.
+type kubeList[T kubeObject] struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+		// Continue is set if more objects are left to list, to be passed as the continue parameter of the next page.
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []T `json:"items"`
+}
+
+// kubeWatchEvent is a single event of a watch response.
+type kubeWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubeInformer keeps a local copy of all objects of one resource in sync with the API server using list and watch,
+// and calls onChange every time it changes. onChange must not block; the objects are read with snapshot.
+type kubeInformer[T kubeObject] struct {
+	client   *kubeClient
+	path     string
+	query    url.Values
+	onChange func()
+
+	mu      sync.Mutex
+	objects map[string]T // keyed by namespace/name
+}
+
+// snapshot returns a copy of the current objects, keyed by namespace/name.
+func (i *kubeInformer[T]) snapshot() map[string]T {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return maps.Clone(i.objects)
+}
+
+// run lists and watches until ctx is done.
+func (i *kubeInformer[T]) run(ctx context.Context) {
+	for {
+		err := i.listAndWatch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			continue
+		}
+		log.Warningf("Failed to watch %s: %v. Retrying in %s.", i.path, err, kubeRetryInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(kubeRetryInterval):
+		}
+	}
+}
+
+// listAndWatch lists all objects, page by page, and then follows changes until the watch ends.
+func (i *kubeInformer[T]) listAndWatch(ctx context.Context) error {
+	objects := make(map[string]T)
+	query := i.queryWith("limit", fmt.Sprint(kubeListLimit))
+	var resourceVersion string
+	for {
+		list := &kubeList[T]{}
+		if err := i.client.get(ctx, i.path, query, list); err != nil {
+			return err
+		}
+		for _, item := range list.Items {
+			objects[kubeKey(item)] = item
+		}
+		// Every page is part of the same snapshot, so the watch starts from the version of the last one.
+		resourceVersion = list.Metadata.ResourceVersion
+		if list.Metadata.Continue == "" {
+			break
+		}
+		query.Set("continue", list.Metadata.Continue)
+	}
+	i.mu.Lock()
+	i.objects = objects
+	i.mu.Unlock()
+	i.onChange()
+
+	query = i.queryWith("watch", "1")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("timeoutSeconds", fmt.Sprint(int(kubeWatchTimeout.Seconds())))
+
+	resp, err := i.client.do(ctx, i.path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := kubeWatchEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil // The server ended the watch, list again.
+			}
+			return fmt.Errorf("failed to decode watch event: %w", err)
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var object T
+			if err := json.Unmarshal(event.Object, &object); err != nil {
+				return fmt.Errorf("failed to decode %s object: %w", event.Type, err)
+			}
+			i.mu.Lock()
+			if event.Type == "DELETED" {
+				delete(i.objects, kubeKey(object))
+			} else {
+				i.objects[kubeKey(object)] = object
+			}
+			i.mu.Unlock()
+			i.onChange()
+		case "ERROR":
+			// Typically 410 Gone when the resource version is too old.
+			return fmt.Errorf("watch error: %s", event.Object)
+		}
+	}
+}
+
+// queryWith returns a copy of the query of the informer with key set to value.
+func (i *kubeInformer[T]) queryWith(key, value string) url.Values {
+	query := url.Values{}
+	for k, v := range i.query {
+		query[k] = v
+	}
+	query.Set(key, value)
+	return query
+}
+
+// kubeDebounce is how long watchers wait for more changes of the informers before rebuilding their prefixes, so that
+// a rollout replacing many pods or the status updates of many nodes cause a single rebuild.
+var kubeDebounce = time.Second
+
+// kubeChanges signals changes of informers to the watcher rebuilding its prefixes from them. The informers only mark
+// the objects as changed, they are read once per rebuild.
+type kubeChanges chan struct{}
+
+func newKubeChanges() kubeChanges { return make(kubeChanges, 1) }
+
+// notify schedules a rebuild without blocking the informer.
+func (c kubeChanges) notify() {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// run calls rebuild after changes until ctx is done, waiting kubeDebounce after the first change.
+func (c kubeChanges) run(ctx context.Context, rebuild func(ctx context.Context)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(kubeDebounce):
+		}
+		// Changes received while waiting are part of this rebuild.
+		select {
+		case <-c:
+		default:
+		}
+		rebuild(ctx)
+	}
+}
+
+// kubeKey returns the namespace/name key of an object.
+func kubeKey(o kubeObject) string {
+	meta := o.objectMeta()
+	if meta.Namespace == "" {
+		return meta.Name
+	}
+	return meta.Namespace + "/" + meta.Name
+}
@@ -0,0 +1,188 @@
+package zoneawareness
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+)
+
+// Sources of endpoint addresses for the kubernetes_endpoints option.
+const (
+	kubeEndpointSlices = "endpointslices"
+	kubePods           = "pods"
+)
+
+// kubeEndpointSlice is the subset of a discovery.k8s.io/v1 EndpointSlice used by this plugin.
+type kubeEndpointSlice struct {
+	Metadata  kubeObjectMeta `json:"metadata"`
+	Endpoints []struct {
+		Addresses []string `json:"addresses"`
+		Zone      string   `json:"zone"`
+	} `json:"endpoints"`
+}
+
+func (s kubeEndpointSlice) objectMeta() kubeObjectMeta { return s.Metadata }
+
+// kubePod is the subset of a v1.Pod used by this plugin.
+type kubePod struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs"`
+	} `json:"status"`
+}
+
+func (p kubePod) objectMeta() kubeObjectMeta { return p.Metadata }
+
+// parseKubernetesEndpoints parses the arguments of the kubernetes_endpoints option, the sources to watch. Without
+// arguments EndpointSlices are watched.
+func parseKubernetesEndpoints(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return []string{kubeEndpointSlices}, nil
+	}
+	var sources []string
+	for _, source := range args {
+		if source != kubeEndpointSlices && source != kubePods {
+			return nil, fmt.Errorf("unknown source '%s', expected '%s' or '%s'", source, kubeEndpointSlices, kubePods)
+		}
+		if !slices.Contains(sources, source) {
+			sources = append(sources, source)
+		}
+	}
+	return sources, nil
+}
+
+// kubeEndpointProvider watches the cluster for the addresses of endpoints and the zones they run in.
+type kubeEndpointProvider struct {
+	sources []string
+
+	newClient func() (*kubeClient, error)
+	zoneID    zoneIDFunc
+}
+
+func (p *kubeEndpointProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *kubeEndpointProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *kubeEndpointProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	client, err := p.newClient()
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	startKubernetesEndpoints(ctx, client, newZoneResolver(loc.awsRegion(), p.zoneID), p.sources, update)
+	return nil
+}
+
+// kubeEndpointWatcher maps the addresses of cluster endpoints to the zone they run in, using the zone field of
+// EndpointSlices and/or the zone of the node each pod runs on. This classifies pod IPs that are not part of any
+// known subnet, e.g. with EKS custom networking or prefix delegation.
+type kubeEndpointWatcher struct {
+	update  func([]Prefix)
+	zones   *zoneResolver
+	changed kubeChanges
+
+	// The informers of the watched sources, nil for sources not watched.
+	slices *kubeInformer[kubeEndpointSlice]
+	pods   *kubeInformer[kubePod]
+	nodes  *kubeInformer[kubeNode]
+}
+
+// startKubernetesEndpoints starts watching the given sources, "endpointslices" and/or "pods", with client until ctx
+// is done, passing the addresses and their zones, translated by zones, to update whenever they change.
+func startKubernetesEndpoints(ctx context.Context, client *kubeClient, zones *zoneResolver, sources []string, update func([]Prefix)) {
+	w := &kubeEndpointWatcher{update: update, zones: zones, changed: newKubeChanges()}
+	for _, source := range sources {
+		switch source {
+		case kubeEndpointSlices:
+			w.slices = &kubeInformer[kubeEndpointSlice]{
+				client:   client,
+				path:     "/apis/discovery.k8s.io/v1/endpointslices",
+				onChange: w.changed.notify,
+			}
+		case kubePods:
+			w.pods = &kubeInformer[kubePod]{
+				client:   client,
+				path:     "/api/v1/pods",
+				query:    url.Values{"fieldSelector": {"status.phase=Running"}},
+				onChange: w.changed.notify,
+			}
+			w.nodes = &kubeInformer[kubeNode]{
+				client:   client,
+				path:     "/api/v1/nodes",
+				onChange: w.changed.notify,
+			}
+		}
+	}
+	// The informers are only started once all are set, as the first change may be rebuilt right away.
+	go w.changed.run(ctx, w.rebuild)
+	if w.slices != nil {
+		go w.slices.run(ctx)
+	}
+	if w.pods != nil {
+		go w.pods.run(ctx)
+		go w.nodes.run(ctx)
+	}
+
+	log.Infof("Watching Kubernetes %v for endpoint zones.", sources)
+}
+
+// rebuild passes the addresses of the current EndpointSlices and pods in their zones to update. The objects of the
+// informers are copied once, so zone names are translated without holding their locks.
+func (w *kubeEndpointWatcher) rebuild(ctx context.Context) {
+	var (
+		slices map[string]kubeEndpointSlice
+		pods   map[string]kubePod
+		nodes  map[string]kubeNode
+	)
+	if w.slices != nil {
+		slices = w.slices.snapshot()
+	}
+	if w.pods != nil {
+		pods, nodes = w.pods.snapshot(), w.nodes.snapshot()
+	}
+
+	hosts := make(map[netip.Addr]string)
+	for _, slice := range slices {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Zone == "" {
+				continue
+			}
+			zone := w.zones.resolve(ctx, endpoint.Zone)
+			for _, address := range endpoint.Addresses {
+				if addr, err := netip.ParseAddr(address); err == nil {
+					hosts[addr.Unmap()] = zone
+				}
+			}
+		}
+	}
+
+	for _, pod := range pods {
+		node, ok := nodes[pod.Spec.NodeName]
+		if !ok || node.zone() == "" {
+			continue
+		}
+		zone := w.zones.resolve(ctx, node.zone())
+		for _, podIP := range pod.Status.PodIPs {
+			if addr, err := netip.ParseAddr(podIP.IP); err == nil {
+				hosts[addr.Unmap()] = zone
+			}
+		}
+	}
+
+	prefixes := make([]Prefix, 0, len(hosts))
+	for addr, zone := range hosts {
+		prefixes = append(prefixes, Prefix{Prefix: netip.PrefixFrom(addr, addr.BitLen()), Zone: zone})
+	}
+	w.update(prefixes)
+	log.Debugf("Mapped %d Kubernetes endpoint address(es) to zones", len(hosts))
+}
@@ -0,0 +1,97 @@
+package zoneawareness
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestKubernetesEndpoints(t *testing.T) {
+	origDebounce := kubeDebounce
+	t.Cleanup(func() { kubeDebounce = origDebounce })
+	kubeDebounce = 10 * time.Millisecond
+
+	client, events := newFakeKubeAPI(t, map[string]string{
+		"/apis/discovery.k8s.io/v1/endpointslices": `{"metadata": {"resourceVersion": "10"}, "items": [
+			{"metadata": {"name": "web-abc", "namespace": "default"}, "endpoints": [
+				{"addresses": ["100.64.1.10"], "zone": "use1-az1"},
+				{"addresses": ["100.64.2.10"], "zone": "use1-az2"},
+				{"addresses": ["100.64.3.10"]}
+			]}
+		]}`,
+		"/api/v1/pods": `{"metadata": {"resourceVersion": "20"}, "items": [
+			{"metadata": {"name": "db-0", "namespace": "default"}, "spec": {"nodeName": "node-1"},
+			 "status": {"podIPs": [{"ip": "100.64.1.20"}, {"ip": "2001:db8::20"}]}},
+			{"metadata": {"name": "db-1", "namespace": "default"}, "spec": {"nodeName": "node-2"},
+			 "status": {"podIPs": [{"ip": "100.64.2.20"}]}}
+		]}`,
+		"/api/v1/nodes": `{"metadata": {"resourceVersion": "30"}, "items": [
+			{"metadata": {"name": "node-1", "labels": {"topology.k8s.aws/zone-id": "use1-az1"}}},
+			{"metadata": {"name": "node-2", "labels": {"topology.k8s.aws/zone-id": "use1-az2"}}}
+		]}`,
+	})
+
+	za := &Zoneawareness{Zones: make(map[string]*Zone), currentAvailabilityZoneId: "use1-az1"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startKubernetesEndpoints(ctx, client, newZoneResolver("", nil), []string{kubeEndpointSlices, kubePods}, func(prefixes []Prefix) {
+		za.setProviderPrefixes("kubernetes_endpoints", prefixes)
+	})
+
+	zoneOf := func(ip string) string {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.hosts[netip.MustParseAddr(ip)]
+	}
+
+	waitFor(t, "endpoints to be mapped", func() bool {
+		return zoneOf("100.64.1.10") == "use1-az1" && zoneOf("100.64.1.20") == "use1-az1"
+	})
+	for ip, zone := range map[string]string{
+		"100.64.2.10":  "use1-az2",
+		"100.64.2.20":  "use1-az2",
+		"2001:db8::20": "use1-az1",
+		"100.64.3.10":  "",
+	} {
+		if got := zoneOf(ip); got != zone {
+			t.Errorf("Expected %s to be in zone '%s', got '%s'", ip, zone, got)
+		}
+	}
+
+	// A pod moving to another node is picked up from the watch.
+	events <- fakeKubeEvent{path: "/api/v1/pods", body: `{"type": "MODIFIED", "object":
+		{"metadata": {"name": "db-1", "namespace": "default"}, "spec": {"nodeName": "node-1"},
+		 "status": {"podIPs": [{"ip": "100.64.2.20"}]}}}`}
+	waitFor(t, "moved pod to be mapped", func() bool { return zoneOf("100.64.2.20") == "use1-az1" })
+
+	events <- fakeKubeEvent{path: "/api/v1/pods", body: `{"type": "DELETED", "object":
+		{"metadata": {"name": "db-0", "namespace": "default"}}}`}
+	waitFor(t, "deleted pod to be removed", func() bool { return zoneOf("100.64.1.20") == "" })
+
+	// Headless service answers are ranked by the zone of the pods.
+	za.mu.RLock()
+	defer za.mu.RUnlock()
+	if rank := za.rankIP(net.ParseIP("100.64.1.10"), za.localPath()); rank != 1 {
+		t.Errorf("Expected local pod to be preferred, got rank %d", rank)
+	}
+	if rank := za.rankIP(net.ParseIP("100.64.2.10"), za.localPath()); rank != 0 {
+		t.Errorf("Expected pod in other zone not to be preferred, got rank %d", rank)
+	}
+}
+
+func TestHostsTakePrecedenceOverCIDRs(t *testing.T) {
+	za := &Zoneawareness{currentAvailabilityZoneId: "use1-az1"}
+	za.setProviderPrefixes("ec2", []Prefix{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Zone: "use1-az1"}})
+	za.setProviderPrefixes("test", []Prefix{{Prefix: netip.MustParsePrefix("10.0.0.5/32"), Zone: "use1-az2"}})
+
+	local := za.localPath()
+	if rank := za.rankIP(net.ParseIP("10.0.0.4"), local); rank != 1 {
+		t.Errorf("Expected rank 1 for subnet address, got %d", rank)
+	}
+	if rank := za.rankIP(net.ParseIP("10.0.0.5"), local); rank != 0 {
+		t.Errorf("Expected rank 0 for host in another zone, got %d", rank)
+	}
+}
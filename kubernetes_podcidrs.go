@@ -0,0 +1,86 @@
+package zoneawareness
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+)
+
+// kubePodCIDRProvider watches the nodes of the cluster and maps the pod CIDRs of each node to the zone of the node.
+type kubePodCIDRProvider struct {
+	newClient func() (*kubeClient, error)
+	zoneID    zoneIDFunc
+}
+
+func (p *kubePodCIDRProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *kubePodCIDRProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *kubePodCIDRProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	client, err := p.newClient()
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	startKubernetesPodCIDRs(ctx, client, newZoneResolver(loc.awsRegion(), p.zoneID), update)
+	return nil
+}
+
+// startKubernetesPodCIDRs watches the nodes of the cluster with client until ctx is done, and passes the pod CIDRs of
+// each node in the zone of the node, translated by zones, to update whenever they change. With Calico, Cilium or
+// kubenet IPAM pod IPs are not part of any VPC subnet. Node changes are debounced, and changes that leave the pod
+// CIDRs and their zones as they were, such as the status updates of the nodes, are not passed on.
+func startKubernetesPodCIDRs(ctx context.Context, client *kubeClient, zones *zoneResolver, update func([]Prefix)) {
+	changed := newKubeChanges()
+	informer := &kubeInformer[kubeNode]{client: client, path: "/api/v1/nodes", onChange: changed.notify}
+
+	var (
+		last   map[netip.Prefix]string
+		loaded bool
+	)
+	go changed.run(ctx, func(ctx context.Context) {
+		prefixes := podCIDRPrefixes(ctx, informer.snapshot(), zones)
+		zonesOf := make(map[netip.Prefix]string, len(prefixes))
+		for _, p := range prefixes {
+			zonesOf[p.Prefix] = p.Zone
+		}
+		if loaded && maps.Equal(zonesOf, last) {
+			return
+		}
+		last, loaded = zonesOf, true
+		update(prefixes)
+	})
+	go informer.run(ctx)
+
+	log.Infof("Watching Kubernetes nodes for pod CIDRs.")
+}
+
+// podCIDRPrefixes returns the pod CIDRs of the nodes in the zone of their node.
+func podCIDRPrefixes(ctx context.Context, nodes map[string]kubeNode, zones *zoneResolver) []Prefix {
+	var prefixes []Prefix
+	for _, node := range nodes {
+		if node.zone() == "" {
+			continue
+		}
+		zone := zones.resolve(ctx, node.zone())
+
+		podCIDRs := node.Spec.PodCIDRs
+		if node.Spec.PodCIDR != "" && !slices.Contains(podCIDRs, node.Spec.PodCIDR) {
+			podCIDRs = append(podCIDRs, node.Spec.PodCIDR)
+		}
+		for _, cidrStr := range podCIDRs {
+			cidr, err := netip.ParsePrefix(cidrStr)
+			if err != nil {
+				log.Warningf("Invalid pod CIDR '%s' of node %s: %v", cidrStr, node.Metadata.Name, err)
+				continue
+			}
+			prefixes = append(prefixes, Prefix{Prefix: cidr, Zone: zone, Metadata: map[string]string{MetadataName: "node " + node.Metadata.Name}})
+		}
+	}
+	return prefixes
+}
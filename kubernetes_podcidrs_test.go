@@ -0,0 +1,82 @@
+package zoneawareness
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKubernetesPodCIDRs(t *testing.T) {
+	origDebounce := kubeDebounce
+	t.Cleanup(func() { kubeDebounce = origDebounce })
+	kubeDebounce = 10 * time.Millisecond
+
+	client, events := newFakeKubeAPI(t, map[string]string{
+		"/api/v1/nodes": `{"metadata": {"resourceVersion": "30"}, "items": [
+			{"metadata": {"name": "node-1", "labels": {"topology.k8s.aws/zone-id": "use1-az1"}},
+			 "spec": {"podCIDR": "192.168.1.0/24", "podCIDRs": ["192.168.1.0/24", "fd00:1::/64"]}},
+			{"metadata": {"name": "node-2", "labels": {"topology.k8s.aws/zone-id": "use1-az2"}},
+			 "spec": {"podCIDR": "192.168.2.0/24"}},
+			{"metadata": {"name": "node-3"}, "spec": {"podCIDR": "192.168.3.0/24"}}
+		]}`,
+	})
+
+	_, static, _ := net.ParseCIDR("10.0.1.0/24")
+	za := &Zoneawareness{
+		static:                    []staticZone{{name: "use1-az1", cidrs: []*net.IPNet{static}}},
+		currentAvailabilityZoneId: "use1-az1",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var updates atomic.Int32
+	startKubernetesPodCIDRs(ctx, client, newZoneResolver("", nil), func(prefixes []Prefix) {
+		updates.Add(1)
+		za.setProviderPrefixes("kubernetes_pod_cidrs", prefixes)
+	})
+
+	cidrsOf := func(zone string) []string {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		var cidrs []string
+		if z, ok := za.Zones[zone]; ok {
+			for _, cidr := range z.CIDRs {
+				cidrs = append(cidrs, cidr.String())
+			}
+		}
+		slices.Sort(cidrs)
+		return cidrs
+	}
+
+	waitFor(t, "pod CIDRs to be mapped", func() bool { return len(cidrsOf("use1-az2")) == 1 })
+	if got := cidrsOf("use1-az1"); !slices.Equal(got, []string{"10.0.1.0/24", "192.168.1.0/24", "fd00:1::/64"}) {
+		t.Errorf("Unexpected CIDRs in use1-az1: %v", got)
+	}
+	if got := cidrsOf("use1-az2"); !slices.Equal(got, []string{"192.168.2.0/24"}) {
+		t.Errorf("Unexpected CIDRs in use1-az2: %v", got)
+	}
+
+	// Status updates of a node leave its pod CIDRs as they were and are not passed on.
+	events <- fakeKubeEvent{path: "/api/v1/nodes", body: `{"type": "MODIFIED", "object":
+		{"metadata": {"name": "node-2", "resourceVersion": "31", "labels": {"topology.k8s.aws/zone-id": "use1-az2"}},
+		 "spec": {"podCIDR": "192.168.2.0/24"}}}`}
+	time.Sleep(50 * time.Millisecond)
+
+	// Nodes joining and leaving update the zones, CIDRs from other sources are kept.
+	events <- fakeKubeEvent{path: "/api/v1/nodes", body: `{"type": "ADDED", "object":
+		{"metadata": {"name": "node-4", "labels": {"topology.k8s.aws/zone-id": "use1-az2"}},
+		 "spec": {"podCIDR": "192.168.4.0/24"}}}`}
+	waitFor(t, "new node to be mapped", func() bool { return len(cidrsOf("use1-az2")) == 2 })
+	if n := updates.Load(); n != 2 {
+		t.Errorf("Expected 2 updates, for the listed nodes and the new node, got %d", n)
+	}
+
+	events <- fakeKubeEvent{path: "/api/v1/nodes", body: `{"type": "DELETED", "object": {"metadata": {"name": "node-1"}}}`}
+	waitFor(t, "removed node to be unmapped", func() bool { return len(cidrsOf("use1-az1")) == 1 })
+	if got := cidrsOf("use1-az1"); !slices.Equal(got, []string{"10.0.1.0/24"}) {
+		t.Errorf("Expected only the static CIDR to remain in use1-az1, got %v", got)
+	}
+}
@@ -0,0 +1,273 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFakeKubeAPI starts a fake Kubernetes API server serving the given JSON documents by path, and returns a client
+// of it. Watch requests receive the events queued on the returned channel for their path, and are held open until
+// the client goes away.
+func newFakeKubeAPI(t *testing.T, objects map[string]string) (*kubeClient, chan<- fakeKubeEvent) {
+	t.Helper()
+	events := make(chan fakeKubeEvent, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, ok := objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("watch") != "1" {
+			w.Write([]byte(body))
+			return
+		}
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-events:
+				if event.path != r.URL.Path {
+					events <- event // Meant for another watch.
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				w.Write([]byte(event.body + "\n"))
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return &kubeClient{host: server.URL, token: "test-token", client: server.Client()}, events
+}
+
+// fakeKubeEvent is a watch event sent by the fake API server to watches of path.
+type fakeKubeEvent struct {
+	path string
+	body string
+}
+
+// waitFor polls cond until it returns true or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGetConfigFromKubernetesNode(t *testing.T) {
+	zoneID := func(ctx context.Context, zoneName string, region string) (string, error) {
+		if zoneName == "us-east-1b" && region == "us-east-1" {
+			return "use1-az2", nil
+		}
+		return "", errors.New("unknown zone " + zoneName)
+	}
+
+	client, _ := newFakeKubeAPI(t, map[string]string{
+		"/api/v1/nodes/eks-node": `{"metadata": {"name": "eks-node", "labels": {
+			"topology.kubernetes.io/region": "us-east-1",
+			"topology.kubernetes.io/zone": "us-east-1b",
+			"topology.k8s.aws/zone-id": "use1-az2"}},
+			"spec": {"providerID": "aws:///us-east-1b/i-0123456789abcdef0"}}`,
+		"/api/v1/nodes/zone-name-node": `{"metadata": {"name": "zone-name-node", "labels": {
+			"topology.kubernetes.io/region": "us-east-1",
+			"topology.kubernetes.io/zone": "us-east-1b"}},
+			"spec": {"providerID": "aws:///us-east-1b/i-0123456789abcdef0"}}`,
+		"/api/v1/nodes/custom-node": `{"metadata": {"name": "custom-node", "labels": {
+			"example.com/zone-id": "use1-az3",
+			"topology.k8s.aws/zone-id": "use1-az2"}}}`,
+		"/api/v1/nodes/no-region-node": `{"metadata": {"name": "no-region-node", "labels": {
+			"topology.kubernetes.io/zone": "us-east-1b"}},
+			"spec": {"providerID": "aws:///us-east-1b/i-0123456789abcdef0"}}`,
+		"/api/v1/nodes/gke-node": `{"metadata": {"name": "gke-node", "labels": {
+			"topology.kubernetes.io/region": "us-central1",
+			"topology.kubernetes.io/zone": "us-central1-a"}},
+			"spec": {"providerID": "gce://my-project/us-central1-a/gke-node"}}`,
+		"/api/v1/nodes/unlabeled-node": `{"metadata": {"name": "unlabeled-node"}}`,
+	})
+
+	tests := []struct {
+		name           string
+		nodeName       string
+		label          string
+		expectedErr    string
+		expectedAZ     string
+		expectedRegion string
+		expectedCloud  string
+	}{
+		{name: "EKS zone ID label", nodeName: "eks-node", expectedAZ: "use1-az2", expectedRegion: "us-east-1", expectedCloud: CloudAWS},
+		{name: "Zone name is translated", nodeName: "zone-name-node", expectedAZ: "use1-az2", expectedRegion: "us-east-1", expectedCloud: CloudAWS},
+		{name: "Custom label is checked first", nodeName: "custom-node", label: "example.com/zone-id", expectedAZ: "use1-az3"},
+		{name: "Zone name outside AWS is used as is", nodeName: "gke-node", expectedAZ: "us-central1-a", expectedRegion: "us-central1", expectedCloud: CloudGCP},
+		{name: "Zone name without region", nodeName: "no-region-node", expectedErr: "no topology.kubernetes.io/region label"},
+		{name: "Node without zone labels", nodeName: "unlabeled-node", expectedErr: "has no zone label"},
+		{name: "Unknown node", nodeName: "missing-node", expectedErr: "404"},
+		{name: "NODE_NAME not set", expectedErr: "NODE_NAME is not set"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(kubeNodeNameEnv, tc.nodeName)
+
+			newClient := func() (*kubeClient, error) { return client, nil }
+			loc, err := getConfigFromKubernetesNode(tc.label, newClient, zoneID)
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Fatalf("Expected error containing '%s', but got: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			if loc.Zone != tc.expectedAZ || loc.Region != tc.expectedRegion || loc.Cloud != tc.expectedCloud {
+				t.Errorf("Expected '%s' in '%s' of cloud '%s', got %+v", tc.expectedAZ, tc.expectedRegion, tc.expectedCloud, loc)
+			}
+		})
+	}
+}
+
+func TestNewInClusterKubeClientOutsideCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := newInClusterKubeClient(); err == nil {
+		t.Fatal("Expected an error outside of a cluster, got nil")
+	}
+}
+
+func TestZoneResolver(t *testing.T) {
+	calls := 0
+	zoneID := func(ctx context.Context, zoneName string, region string) (string, error) {
+		calls++
+		if zoneName == "us-east-1a" {
+			return "use1-az4", nil
+		}
+		return "", errors.New("unknown zone")
+	}
+
+	r := newZoneResolver("us-east-1", zoneID)
+	for range 2 {
+		if got := r.resolve(context.TODO(), "us-east-1a"); got != "use1-az4" {
+			t.Errorf("Expected 'use1-az4', got '%s'", got)
+		}
+		if got := r.resolve(context.TODO(), "use1-az1"); got != "use1-az1" {
+			t.Errorf("Expected zone IDs to be used as is, got '%s'", got)
+		}
+		if got := r.resolve(context.TODO(), "zone-a"); got != "zone-a" {
+			t.Errorf("Expected untranslatable zones to be used as is, got '%s'", got)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 lookups, got %d", calls)
+	}
+
+	// Names that couldn't be translated are asked about again once the retry interval has passed.
+	r.failed["zone-a"] = time.Now().Add(-time.Second)
+	r.resolve(context.TODO(), "zone-a")
+	if calls != 3 {
+		t.Errorf("Expected a failed translation to be retried, got %d lookups", calls)
+	}
+}
+
+func TestKubeClientReadsTokenAgain(t *testing.T) {
+	origTTL := kubeTokenTTL
+	t.Cleanup(func() { kubeTokenTTL = origTTL })
+	kubeTokenTTL = time.Hour
+
+	var auth []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("rotated-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client := &kubeClient{host: server.URL, tokenFile: tokenFile, client: server.Client(), token: "old-token", tokenRead: time.Now()}
+
+	node := &kubeNode{}
+	if err := client.get(context.Background(), "/api/v1/nodes/node-1", nil, node); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	// Once the token expired the rotated token is read from the file, and kept if the file can't be read.
+	client.tokenRead = time.Now().Add(-2 * time.Hour)
+	if err := client.get(context.Background(), "/api/v1/nodes/node-1", nil, node); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	os.Remove(tokenFile)
+	client.tokenRead = time.Now().Add(-2 * time.Hour)
+	if err := client.get(context.Background(), "/api/v1/nodes/node-1", nil, node); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if want := []string{"Bearer old-token", "Bearer rotated-token", "Bearer rotated-token"}; !slices.Equal(auth, want) {
+		t.Errorf("Expected the tokens %v, got %v", want, auth)
+	}
+}
+
+func TestKubeInformerListsPages(t *testing.T) {
+	var mu sync.Mutex
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.Query())
+		mu.Unlock()
+		switch {
+		case r.URL.Query().Get("watch") == "1":
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case r.URL.Query().Get("continue") == "":
+			w.Write([]byte(`{"metadata": {"resourceVersion": "40", "continue": "page-2"}, "items": [{"metadata": {"name": "node-1"}}]}`))
+		default:
+			w.Write([]byte(`{"metadata": {"resourceVersion": "40"}, "items": [{"metadata": {"name": "node-2"}}]}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	listed := make(chan []string, 1)
+	informer := &kubeInformer[kubeNode]{client: &kubeClient{host: server.URL, client: server.Client()}, path: "/api/v1/nodes"}
+	informer.onChange = func() {
+		listed <- slices.Sorted(maps.Keys(informer.snapshot()))
+	}
+	go informer.run(ctx)
+
+	if nodes := <-listed; !slices.Equal(nodes, []string{"node-1", "node-2"}) {
+		t.Errorf("Expected the nodes of both pages, got %v", nodes)
+	}
+	waitFor(t, "the watch to start", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(queries) == 3
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if queries[0].Get("limit") != "500" || queries[1].Get("continue") != "page-2" {
+		t.Errorf("Expected the list to be paginated, got %v", queries[:2])
+	}
+	if watch := queries[2]; watch.Get("resourceVersion") != "40" || watch.Get("limit") != "" || watch.Get("continue") != "" {
+		t.Errorf("Expected the watch to start from the listed version, got %v", watch)
+	}
+}
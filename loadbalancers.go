@@ -0,0 +1,265 @@
+package zoneawareness
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+)
+
+// zonalAddress is an address and the zone ID it is served from.
+type zonalAddress struct {
+	addr netip.Addr
+	zone string
+}
+
+// zonalAddressPrefixes returns the addresses as single address prefixes of their zones.
+func zonalAddressPrefixes(addresses []zonalAddress) []Prefix {
+	prefixes := make([]Prefix, 0, len(addresses))
+	for _, address := range addresses {
+		addr := address.addr.Unmap()
+		prefixes = append(prefixes, Prefix{Prefix: netip.PrefixFrom(addr, addr.BitLen()), Zone: address.zone})
+	}
+	return prefixes
+}
+
+// defaultZonalAddressInterval is how often the load balancers and VPC endpoints are described again.
+const defaultZonalAddressInterval = 5 * time.Minute
+
+// zonalAddressOptions configures the load_balancers and vpc_endpoints options.
+type zonalAddressOptions struct {
+	vpcIDs   []string
+	interval time.Duration
+}
+
+// parseZonalAddressOptions parses the arguments of the load_balancers and vpc_endpoints options: VPC IDs and
+// interval=INTERVAL.
+func parseZonalAddressOptions(args []string) (*zonalAddressOptions, error) {
+	opts := &zonalAddressOptions{interval: defaultZonalAddressInterval}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			opts.vpcIDs = append(opts.vpcIDs, arg)
+			continue
+		}
+		if key != "interval" {
+			return nil, fmt.Errorf("unknown argument '%s'", key)
+		}
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("refresh interval must be positive, got %s", interval)
+		}
+		opts.interval = interval
+	}
+	return opts, nil
+}
+
+// watchZonalAddresses gets the addresses of source and gets them again every interval until ctx is done, passing
+// them to update whenever they changed.
+func watchZonalAddresses(ctx context.Context, source string, interval time.Duration, get func(ctx context.Context) ([]zonalAddress, error), update func([]Prefix)) {
+	var (
+		mapped []zonalAddress
+		loaded bool
+	)
+	load := func(ctx context.Context) ([]Prefix, bool, error) {
+		addresses, err := get(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+		if loaded && slices.Equal(addresses, mapped) {
+			return nil, false, nil
+		}
+		mapped, loaded = addresses, true
+		log.Infof("Mapped %d address(es) from %s to their zones", len(addresses), source)
+		return zonalAddressPrefixes(addresses), true, nil
+	}
+	startMapSource(ctx, source, interval, load, update)
+}
+
+// loadBalancerProvider maps the zonal addresses of the ELBv2 load balancers in the region, optionally limited to some
+// VPCs, to their zones. The load balancers are described again periodically, following the addresses of new and
+// replaced ones.
+type loadBalancerProvider struct {
+	opts *zonalAddressOptions
+
+	zoneID       zoneIDFunc
+	getAddresses func(ctx context.Context, region string, vpcIDs []string, zoneID zoneIDFunc) ([]zonalAddress, error)
+}
+
+func (p *loadBalancerProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *loadBalancerProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *loadBalancerProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	region := loc.awsRegion()
+	if region == "" {
+		return nil
+	}
+	watchZonalAddresses(ctx, "load_balancers", p.opts.interval, func(ctx context.Context) ([]zonalAddress, error) {
+		addresses, err := p.getAddresses(ctx, region, p.opts.vpcIDs, p.zoneID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe load balancers: %w", err)
+		}
+		return addresses, nil
+	}, update)
+	return nil
+}
+
+// vpcEndpointProvider maps the addresses of the VPC endpoints in the region, optionally limited to some VPCs, to
+// their zones. The endpoints are described again periodically, following created and deleted endpoints.
+type vpcEndpointProvider struct {
+	opts *zonalAddressOptions
+
+	getAddresses func(ctx context.Context, region string, vpcIDs []string) ([]zonalAddress, error)
+}
+
+func (p *vpcEndpointProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *vpcEndpointProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *vpcEndpointProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	region := loc.awsRegion()
+	if region == "" {
+		return nil
+	}
+	watchZonalAddresses(ctx, "vpc_endpoints", p.opts.interval, func(ctx context.Context) ([]zonalAddress, error) {
+		addresses, err := p.getAddresses(ctx, region, p.opts.vpcIDs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe VPC endpoints: %w", err)
+		}
+		return addresses, nil
+	}, update)
+	return nil
+}
+
+// getLoadBalancerAddresses lists the ELBv2 load balancers in the region, optionally limited to some VPCs, and returns
+// the addresses each of them has in every zone. These are the static addresses of Network and Gateway Load Balancers,
+// including the Elastic IPs of internet-facing ones which are not part of any subnet. Application Load Balancers have
+// no static addresses, their addresses are part of the load balancer subnets. Zone names are translated with zoneID.
+func getLoadBalancerAddresses(ctx context.Context, region string, vpcIDs []string, zoneID zoneIDFunc) ([]zonalAddress, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS SDK config: %w", err)
+	}
+
+	elbClient := elasticloadbalancingv2.NewFromConfig(cfg)
+	zones := newZoneResolver(region, zoneID)
+
+	var addresses []zonalAddress
+	paginator := elasticloadbalancingv2.NewDescribeLoadBalancersPaginator(elbClient, &elasticloadbalancingv2.DescribeLoadBalancersInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe load balancers: %w", err)
+		}
+
+		for _, lb := range page.LoadBalancers {
+			if len(vpcIDs) > 0 && !slices.Contains(vpcIDs, aws.ToString(lb.VpcId)) {
+				continue
+			}
+			for _, az := range lb.AvailabilityZones {
+				if az.ZoneName == nil {
+					continue
+				}
+				zone := zones.resolve(ctx, *az.ZoneName)
+				for _, lbAddress := range az.LoadBalancerAddresses {
+					for _, address := range []*string{lbAddress.IpAddress, lbAddress.PrivateIPv4Address, lbAddress.IPv6Address} {
+						if addr, err := netip.ParseAddr(aws.ToString(address)); err == nil {
+							addresses = append(addresses, zonalAddress{addr: addr, zone: zone})
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return addresses, nil
+}
+
+// getVPCEndpointAddresses returns the addresses of the network interfaces of the VPC endpoints in the region,
+// optionally limited to some VPCs. Next to the interfaces of the endpoints that can be described, this includes
+// endpoint interfaces in the VPCs that were created by other accounts, e.g. in subnets shared with RAM.
+func getVPCEndpointAddresses(ctx context.Context, region string, vpcIDs []string) ([]zonalAddress, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS SDK config: %w", err)
+	}
+
+	ec2Client := ec2.NewFromConfig(cfg)
+
+	var vpcFilters []types.Filter
+	if len(vpcIDs) > 0 {
+		vpcFilters = append(vpcFilters, types.Filter{Name: aws.String("vpc-id"), Values: vpcIDs})
+	}
+
+	var eniIDs []string
+	endpoints := ec2.NewDescribeVpcEndpointsPaginator(ec2Client, &ec2.DescribeVpcEndpointsInput{Filters: vpcFilters})
+	for endpoints.HasMorePages() {
+		page, err := endpoints.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe VPC endpoints: %w", err)
+		}
+		for _, endpoint := range page.VpcEndpoints {
+			eniIDs = append(eniIDs, endpoint.NetworkInterfaceIds...)
+		}
+	}
+
+	var interfaces []types.NetworkInterface
+	// The API accepts a limited number of IDs per request.
+	for chunk := range slices.Chunk(eniIDs, 200) {
+		byID := ec2.NewDescribeNetworkInterfacesPaginator(ec2Client, &ec2.DescribeNetworkInterfacesInput{NetworkInterfaceIds: chunk})
+		for byID.HasMorePages() {
+			page, err := byID.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe VPC endpoint network interfaces: %w", err)
+			}
+			interfaces = append(interfaces, page.NetworkInterfaces...)
+		}
+	}
+
+	byType := ec2.NewDescribeNetworkInterfacesPaginator(ec2Client, &ec2.DescribeNetworkInterfacesInput{
+		Filters: append(vpcFilters, types.Filter{
+			Name:   aws.String("interface-type"),
+			Values: []string{string(types.NetworkInterfaceTypeVpcEndpoint), string(types.NetworkInterfaceTypeGatewayLoadBalancerEndpoint)},
+		}),
+	})
+	for byType.HasMorePages() {
+		page, err := byType.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe VPC endpoint network interfaces: %w", err)
+		}
+		interfaces = append(interfaces, page.NetworkInterfaces...)
+	}
+
+	var addresses []zonalAddress
+	for _, eni := range interfaces {
+		zone := aws.ToString(eni.AvailabilityZoneId)
+		if zone == "" {
+			continue
+		}
+		for _, addr := range eniAddresses(eni) {
+			addresses = append(addresses, zonalAddress{addr: addr, zone: zone})
+		}
+	}
+
+	return addresses, nil
+}
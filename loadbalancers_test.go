@@ -0,0 +1,295 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net"
+	"net/netip"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+// newFakeAWSAPI starts a fake AWS query protocol API answering each Action with the given XML document, and points
+// the SDK at it through AWS_ENDPOINT_URL_<SERVICE> for the duration of the test. It returns a function listing the
+// requests received so far.
+func newFakeAWSAPI(t *testing.T, service string, responses map[string]string) func() []url.Values {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests = append(requests, r.PostForm)
+		mu.Unlock()
+
+		body, ok := responses[r.PostForm.Get("Action")]
+		if !ok {
+			http.Error(w, "<Response><Errors><Error><Code>InvalidAction</Code></Error></Errors></Response>", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("AWS_ENDPOINT_URL_"+service, server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	return func() []url.Values {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(requests)
+	}
+}
+
+// addressZones converts zonal addresses to a map for comparison.
+func addressZones(addresses []zonalAddress) map[string]string {
+	zones := make(map[string]string)
+	for _, address := range addresses {
+		zones[address.addr.String()] = address.zone
+	}
+	return zones
+}
+
+func TestGetLoadBalancerAddresses(t *testing.T) {
+	zoneID := func(ctx context.Context, zoneName string, region string) (string, error) {
+		switch zoneName {
+		case "us-east-1a":
+			return "use1-az6", nil
+		case "us-east-1b":
+			return "use1-az1", nil
+		}
+		return "", errors.New("unknown zone")
+	}
+
+	newFakeAWSAPI(t, "ELASTIC_LOAD_BALANCING_V2", map[string]string{
+		"DescribeLoadBalancers": `<DescribeLoadBalancersResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2015-12-01/">
+  <DescribeLoadBalancersResult>
+    <LoadBalancers>
+      <member>
+        <LoadBalancerName>public-nlb</LoadBalancerName>
+        <Type>network</Type>
+        <VpcId>vpc-1</VpcId>
+        <AvailabilityZones>
+          <member>
+            <ZoneName>us-east-1a</ZoneName>
+            <LoadBalancerAddresses>
+              <member>
+                <IpAddress>198.51.100.10</IpAddress>
+                <AllocationId>eipalloc-1</AllocationId>
+                <PrivateIPv4Address>10.0.1.10</PrivateIPv4Address>
+              </member>
+            </LoadBalancerAddresses>
+          </member>
+          <member>
+            <ZoneName>us-east-1b</ZoneName>
+            <LoadBalancerAddresses>
+              <member>
+                <IpAddress>198.51.100.20</IpAddress>
+                <IPv6Address>2001:db8::20</IPv6Address>
+              </member>
+            </LoadBalancerAddresses>
+          </member>
+        </AvailabilityZones>
+      </member>
+      <member>
+        <LoadBalancerName>alb</LoadBalancerName>
+        <Type>application</Type>
+        <VpcId>vpc-1</VpcId>
+        <AvailabilityZones>
+          <member><ZoneName>us-east-1a</ZoneName></member>
+        </AvailabilityZones>
+      </member>
+      <member>
+        <LoadBalancerName>other-vpc-nlb</LoadBalancerName>
+        <VpcId>vpc-2</VpcId>
+        <AvailabilityZones>
+          <member>
+            <ZoneName>us-east-1a</ZoneName>
+            <LoadBalancerAddresses><member><IpAddress>198.51.100.30</IpAddress></member></LoadBalancerAddresses>
+          </member>
+        </AvailabilityZones>
+      </member>
+    </LoadBalancers>
+  </DescribeLoadBalancersResult>
+  <ResponseMetadata><RequestId>1</RequestId></ResponseMetadata>
+</DescribeLoadBalancersResponse>`,
+	})
+
+	addresses, err := getLoadBalancerAddresses(context.Background(), "us-east-1", []string{"vpc-1"}, zoneID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	expected := map[string]string{
+		"198.51.100.10": "use1-az6",
+		"10.0.1.10":     "use1-az6",
+		"198.51.100.20": "use1-az1",
+		"2001:db8::20":  "use1-az1",
+	}
+	if got := addressZones(addresses); !maps.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestGetVPCEndpointAddresses(t *testing.T) {
+	requests := newFakeAWSAPI(t, "EC2", map[string]string{
+		"DescribeVpcEndpoints": `<DescribeVpcEndpointsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>1</requestId>
+  <vpcEndpointSet>
+    <item>
+      <vpcEndpointId>vpce-1</vpcEndpointId>
+      <vpcId>vpc-1</vpcId>
+      <networkInterfaceIdSet><item>eni-1</item></networkInterfaceIdSet>
+    </item>
+  </vpcEndpointSet>
+</DescribeVpcEndpointsResponse>`,
+		"DescribeNetworkInterfaces": `<DescribeNetworkInterfacesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>2</requestId>
+  <networkInterfaceSet>
+    <item>
+      <networkInterfaceId>eni-1</networkInterfaceId>
+      <availabilityZoneId>use1-az1</availabilityZoneId>
+      <privateIpAddress>10.0.1.50</privateIpAddress>
+      <privateIpAddressesSet><item><privateIpAddress>10.0.1.50</privateIpAddress></item></privateIpAddressesSet>
+    </item>
+    <item>
+      <networkInterfaceId>eni-shared</networkInterfaceId>
+      <availabilityZoneId>use1-az2</availabilityZoneId>
+      <privateIpAddress>10.0.2.60</privateIpAddress>
+    </item>
+  </networkInterfaceSet>
+</DescribeNetworkInterfacesResponse>`,
+	})
+
+	addresses, err := getVPCEndpointAddresses(context.Background(), "us-east-1", []string{"vpc-1"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	expected := map[string]string{
+		"10.0.1.50": "use1-az1",
+		"10.0.2.60": "use1-az2",
+	}
+	if got := addressZones(addresses); !maps.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	var actions []string
+	for _, request := range requests() {
+		actions = append(actions, request.Get("Action"))
+		if request.Get("Action") == "DescribeVpcEndpoints" && request.Get("Filter.1.Value.1") != "vpc-1" {
+			t.Errorf("Expected VPC endpoints to be filtered by VPC, got %v", request)
+		}
+	}
+	if !slices.Equal(actions, []string{"DescribeVpcEndpoints", "DescribeNetworkInterfaces", "DescribeNetworkInterfaces"}) {
+		t.Errorf("Unexpected API calls: %v", actions)
+	}
+}
+
+func TestSetupLoadBalancersAndVPCEndpoints(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+	})
+
+	var (
+		mu                   sync.Mutex
+		lbVPCs, endpointVPCs []string
+		replaced             = "198.51.100.20"
+	)
+	patchProvider(t, "load_balancers", func(p *loadBalancerProvider) {
+		p.getAddresses = func(ctx context.Context, region string, vpcIDs []string, zoneID zoneIDFunc) ([]zonalAddress, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			lbVPCs = vpcIDs
+			return []zonalAddress{
+				{addr: netip.MustParseAddr("198.51.100.10"), zone: "use1-az1"},
+				{addr: netip.MustParseAddr(replaced), zone: "use1-az2"},
+			}, nil
+		}
+	})
+	patchProvider(t, "vpc_endpoints", func(p *vpcEndpointProvider) {
+		p.getAddresses = func(ctx context.Context, region string, vpcIDs []string) ([]zonalAddress, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			endpointVPCs = vpcIDs
+			return []zonalAddress{{addr: netip.MustParseAddr("10.0.1.50"), zone: "use1-az1"}}, nil
+		}
+	})
+
+	corefile := "zoneawareness {\n\tload_balancers vpc-1 interval=10ms\n\tvpc_endpoints\n}"
+	c := caddy.NewTestController("dns", corefile)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+
+	// The load balancers and endpoints are described once the server started.
+	startTestWatchers(t, corefile, za, Location{Zone: "use1-az1", Region: "us-east-1", Cloud: CloudAWS})
+	mu.Lock()
+	if !slices.Equal(lbVPCs, []string{"vpc-1"}) || len(endpointVPCs) != 0 {
+		t.Errorf("Unexpected VPC filters: load balancers %v, endpoints %v", lbVPCs, endpointVPCs)
+	}
+	mu.Unlock()
+
+	rank := func(ip string) int {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.rankIP(net.ParseIP(ip), za.localPath())
+	}
+	for ip, expected := range map[string]int{"198.51.100.10": 1, "198.51.100.20": 0, "10.0.1.50": 1} {
+		if rank := rank(ip); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+
+	// A replaced load balancer gets another address.
+	mu.Lock()
+	replaced = "198.51.100.30"
+	mu.Unlock()
+	zoneOf := func(ip string) string {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.hosts[netip.MustParseAddr(ip)]
+	}
+	waitFor(t, "the load balancers to be described again", func() bool {
+		return zoneOf("198.51.100.30") == "use1-az2" && zoneOf("198.51.100.20") == ""
+	})
+}
+
+func TestParseZonalAddressOptions(t *testing.T) {
+	opts, err := parseZonalAddressOptions([]string{"vpc-1", "interval=1m", "vpc-2"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !slices.Equal(opts.vpcIDs, []string{"vpc-1", "vpc-2"}) || opts.interval != time.Minute {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+	if opts, _ := parseZonalAddressOptions(nil); opts.interval != defaultZonalAddressInterval || len(opts.vpcIDs) != 0 {
+		t.Errorf("Expected the default options, got %+v", opts)
+	}
+	for _, args := range [][]string{{"interval=0s"}, {"interval=soon"}, {"vpc=vpc-1"}} {
+		if _, err := parseZonalAddressOptions(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package zoneawareness
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// getParentZonesFromEC2 returns the parent zone ID of every Local Zone and Wavelength Zone in region, keyed by
+// zone ID. Availability Zones have no parent and are left out.
+func getParentZonesFromEC2(ctx context.Context, region string) (map[string]string, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS SDK config: %w", err)
+	}
+
+	ec2Client := ec2.NewFromConfig(cfg)
+
+	// Local Zones the account has not opted in to are included, their subnets may still be shared with it.
+	output, err := ec2Client.DescribeAvailabilityZones(ctx, &ec2.DescribeAvailabilityZonesInput{
+		AllAvailabilityZones: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe availability zones in region '%s': %w", region, err)
+	}
+
+	parents := make(map[string]string)
+	for _, zone := range output.AvailabilityZones {
+		zoneType := aws.ToString(zone.ZoneType)
+		if zoneType == "availability-zone" || aws.ToString(zone.ParentZoneId) == "" {
+			continue
+		}
+		parents[aws.ToString(zone.ZoneId)] = aws.ToString(zone.ParentZoneId)
+		log.Debugf("Zone '%s' is a %s in zone '%s'", aws.ToString(zone.ZoneId), zoneType, aws.ToString(zone.ParentZoneId))
+	}
+	return parents, nil
+}
+
+// getSubnetIDFromIMDSv2 fetches the subnet ID of the primary network interface of the instance from AWS EC2 IMDSv2.
+func getSubnetIDFromIMDSv2() (string, error) {
+	return getInterfaceMetadataFromIMDSv2("subnet-id")
+}
+
+// getVPCIDFromIMDSv2 fetches the VPC ID of the primary network interface of the instance from AWS EC2 IMDSv2.
+func getVPCIDFromIMDSv2() (string, error) {
+	return getInterfaceMetadataFromIMDSv2("vpc-id")
+}
+
+// getInterfaceMetadataFromIMDSv2 fetches the metadata category path of the primary network interface of the
+// instance from AWS EC2 IMDSv2.
+func getInterfaceMetadataFromIMDSv2(path string) (string, error) {
+	const imdsTimeout = 2 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), imdsTimeout)
+	defer cancel()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to load AWS SDK config: %w", err)
+	}
+
+	client := imds.NewFromConfig(cfg)
+
+	mac, err := getMetadata(ctx, client, "mac")
+	if err != nil {
+		return "", err
+	}
+	return getMetadata(ctx, client, "network/interfaces/macs/"+mac+"/"+path)
+}
+
+// getMetadata returns the trimmed value of the IMDS metadata category path.
+func getMetadata(ctx context.Context, client *imds.Client, path string) (string, error) {
+	output, err := client.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s from IMDS: %w", path, err)
+	}
+	defer output.Content.Close()
+
+	value, err := io.ReadAll(output.Content)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s from IMDS response body: %w", path, err)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// outpostID returns the ID of the Outpost a subnet is on, such as "op-0123456789abcdef0", or an empty string for
+// subnets in the region.
+func outpostID(subnet types.Subnet) string {
+	arn := aws.ToString(subnet.OutpostArn)
+	if arn == "" {
+		return ""
+	}
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+// markOutpost marks the prefixes of the subnet of the instance with MetadataLocal if the subnet, one of the subnets
+// of prefixes, is on an Outpost. IMDS is only asked for the subnet of the instance if any of prefixes is on an
+// Outpost, through getSubnetID.
+func markOutpost(prefixes []Prefix, getSubnetID func() (string, error)) {
+	if !slices.ContainsFunc(prefixes, func(p Prefix) bool { return p.Metadata["outpost"] != "" }) {
+		return
+	}
+
+	subnetID, err := getSubnetID()
+	if err != nil {
+		log.Infof("Could not fetch the subnet of the instance from IMDSv2: %v. Assuming it does not run on an Outpost.", err)
+		return
+	}
+	for _, p := range prefixes {
+		if p.Metadata["subnet-id"] == subnetID && p.Metadata["outpost"] != "" {
+			p.Metadata[MetadataLocal] = "true"
+		}
+	}
+}
+
+// setParentZones sets the parent zone of the prefixes in Local Zones and Wavelength Zones, keyed by zone ID in
+// parents, unless they have one already.
+func setParentZones(prefixes []Prefix, parents map[string]string) {
+	for _, p := range prefixes {
+		if parent := parents[p.Zone]; parent != "" && p.Metadata[MetadataParent] == "" {
+			p.Metadata[MetadataParent] = parent
+		}
+	}
+}
+
+// parentChain returns the named zone preceded by its parent zones, outermost first: e.g. a Local Zone preceded by
+// its parent Availability Zone, or an Outpost preceded by the zone it is anchored to.
+func (e *Zoneawareness) parentChain(name string) []string {
+	chain := []string{name}
+	for parent := e.parents[name]; parent != "" && !slices.Contains(chain, parent); parent = e.parents[parent] {
+		chain = slices.Insert(chain, 0, parent)
+	}
+	return chain
+}
@@ -0,0 +1,143 @@
+package zoneawareness
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+func TestGetParentZonesFromEC2(t *testing.T) {
+	requests := newFakeAWSAPI(t, "EC2", map[string]string{
+		"DescribeAvailabilityZones": `<DescribeAvailabilityZonesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>1</requestId>
+  <availabilityZoneInfo>
+    <item><zoneId>use1-az1</zoneId><zoneName>us-east-1a</zoneName><zoneType>availability-zone</zoneType></item>
+    <item><zoneId>use1-bos1-az1</zoneId><zoneName>us-east-1-bos-1a</zoneName><zoneType>local-zone</zoneType><parentZoneId>use1-az4</parentZoneId></item>
+    <item><zoneId>use1-wl1-bos-wlz1</zoneId><zoneName>us-east-1-wl1-bos-wlz-1</zoneName><zoneType>wavelength-zone</zoneType><parentZoneId>use1-az2</parentZoneId></item>
+  </availabilityZoneInfo>
+</DescribeAvailabilityZonesResponse>`,
+	})
+
+	parents, err := getParentZonesFromEC2(context.Background(), "us-east-1")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(parents) != 2 || parents["use1-bos1-az1"] != "use1-az4" || parents["use1-wl1-bos-wlz1"] != "use1-az2" {
+		t.Errorf("Unexpected parent zones: %v", parents)
+	}
+	if got := requests(); len(got) != 1 || got[0].Get("AllAvailabilityZones") != "true" {
+		t.Errorf("Expected all zones to be described, got %v", got)
+	}
+}
+
+func TestZoneIDPattern(t *testing.T) {
+	for _, id := range []string{"use1-az1", "use1-bos1-az1", "usw2-wl1-sea-wlz1"} {
+		if !awsZoneIDPattern.MatchString(id) {
+			t.Errorf("Expected '%s' to be a zone ID", id)
+		}
+	}
+	for _, id := range []string{"us-east-1a", "use1-wl1-bos", "op-0123456789abcdef0"} {
+		if awsZoneIDPattern.MatchString(id) {
+			t.Errorf("Expected '%s' not to be a zone ID", id)
+		}
+	}
+}
+
+func TestParentPath(t *testing.T) {
+	za := &Zoneawareness{
+		Zones:    map[string]*Zone{"use1-az4": {Path: []string{"us-east-1", "use1-az4"}}},
+		topology: []string{"use1-az1"},
+		parents:  map[string]string{"use1-bos1-az1": "use1-az4", "op-1": "use1-bos1-az1", "op-2": "use1-az1", "use1-x1-az1": "use1-x1-az1"},
+	}
+	for name, expected := range map[string][]string{
+		"use1-bos1-az1": {"us-east-1", "use1-az4", "use1-bos1-az1"},
+		"op-1":          {"us-east-1", "use1-az4", "use1-bos1-az1", "op-1"},
+		"op-2":          {"use1-az1", "op-2"},
+		"use1-x1-az1":   {"use1-x1-az1"},
+		"use1-az2":      {"use1-az2"},
+	} {
+		if got := za.zonePath(name); !slices.Equal(got, expected) {
+			t.Errorf("Expected zone '%s' to have path %v, got %v", name, expected, got)
+		}
+	}
+}
+
+func TestSetupLocalZone(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-bos1-az1", "us-east-1", nil }
+		p.getParentZones = func(ctx context.Context, region string) (map[string]string, error) {
+			return map[string]string{"use1-bos1-az1": "use1-az4", "use1-mia1-az1": "use1-az2"}, nil
+		}
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			switch azID {
+			case "use1-bos1-az1":
+				return []types.Subnet{{SubnetId: aws.String("subnet-bos"), CidrBlock: aws.String("10.0.1.0/24")}}, nil
+			case "use1-az4":
+				return []types.Subnet{{SubnetId: aws.String("subnet-az4"), CidrBlock: aws.String("10.0.2.0/24")}}, nil
+			}
+			return nil, nil
+		}
+	})
+
+	c := caddy.NewTestController("dns", `zoneawareness use1-az4 10.0.4.0/24`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+
+	if local := za.localPath(); !slices.Equal(local, []string{"use1-az4", "use1-bos1-az1"}) {
+		t.Errorf("Expected the Local Zone below its parent zone, got %v", local)
+	}
+	for ip, expected := range map[string]int{"10.0.1.5": 2, "10.0.2.5": 1, "10.0.4.5": 1, "10.0.3.5": 0} {
+		if rank := za.rankIP(net.ParseIP(ip), za.localPath()); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+}
+
+func TestSetupOutpost(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+		p.getSubnetID = func() (string, error) { return "subnet-op1", nil }
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return []types.Subnet{
+				{SubnetId: aws.String("subnet-az"), CidrBlock: aws.String("10.0.1.0/24")},
+				{SubnetId: aws.String("subnet-op1"), CidrBlock: aws.String("10.0.2.0/24"), OutpostArn: aws.String("arn:aws:outposts:us-east-1:123456789012:outpost/op-1")},
+				{SubnetId: aws.String("subnet-op2"), CidrBlock: aws.String("10.0.3.0/24"), OutpostArn: aws.String("arn:aws:outposts:us-east-1:123456789012:outpost/op-2")},
+			}, nil
+		}
+	})
+
+	c := caddy.NewTestController("dns", `zoneawareness use1-az2 10.0.4.0/24`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+
+	if local := za.localPath(); !slices.Equal(local, []string{"use1-az1", "op-1"}) {
+		t.Errorf("Expected the Outpost below its zone, got %v", local)
+	}
+	for ip, expected := range map[string]int{"10.0.2.5": 2, "10.0.1.5": 1, "10.0.3.5": 1, "10.0.4.5": 0} {
+		if rank := za.rankIP(net.ParseIP(ip), za.localPath()); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+}
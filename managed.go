@@ -0,0 +1,349 @@
+package zoneawareness
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/elasticache"
+	"github.com/aws/aws-sdk-go-v2/service/kafka"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+)
+
+// Managed services supported by the managed_services option.
+const (
+	managedRDS         = "rds"
+	managedElastiCache = "elasticache"
+	managedMSK         = "msk"
+)
+
+// managedServices lists all supported managed services, the default of the managed_services option.
+var managedServices = []string{managedRDS, managedElastiCache, managedMSK}
+
+// defaultManagedInterval is how often the nodes of managed services are described and their hostnames resolved again.
+const defaultManagedInterval = 5 * time.Minute
+
+// managedOptions configures the managed_services option.
+type managedOptions struct {
+	services []string
+	interval time.Duration
+	vpcID    string // VPC of the node, empty to read it from IMDS
+}
+
+// parseManagedOptions parses the arguments of the managed_services option: the services to map, interval=INTERVAL
+// and vpc=VPC-ID. Without services all services are mapped.
+func parseManagedOptions(args []string) (*managedOptions, error) {
+	opts := &managedOptions{interval: defaultManagedInterval}
+	for _, arg := range args {
+		if key, value, ok := strings.Cut(arg, "="); ok {
+			switch key {
+			case "interval":
+				interval, err := time.ParseDuration(value)
+				if err != nil {
+					return nil, err
+				}
+				if interval <= 0 {
+					return nil, fmt.Errorf("refresh interval must be positive, got %s", interval)
+				}
+				opts.interval = interval
+			case "vpc":
+				if value == "" {
+					return nil, fmt.Errorf("empty VPC ID")
+				}
+				opts.vpcID = value
+			default:
+				return nil, fmt.Errorf("unknown argument '%s'", key)
+			}
+			continue
+		}
+		if !slices.Contains(managedServices, arg) {
+			return nil, fmt.Errorf("unknown service '%s', expected one of %v", arg, managedServices)
+		}
+		if !slices.Contains(opts.services, arg) {
+			opts.services = append(opts.services, arg)
+		}
+	}
+	if len(opts.services) == 0 {
+		opts.services = managedServices
+	}
+	return opts, nil
+}
+
+// managedProvider maps the nodes of managed services in the VPC of the node to the zone they run in. The nodes are
+// described again periodically, as the addresses behind their hostnames change on failover or replacement. Unless
+// configured, the VPC is read from IMDS, so it is only known on EC2 instances.
+type managedProvider struct {
+	opts *managedOptions
+
+	zoneID       zoneIDFunc
+	lookupNetIP  lookupNetIPFunc
+	getVPCID     func() (string, error)
+	getAddresses func(ctx context.Context, region string, vpcID string, services []string, zoneID zoneIDFunc, lookupNetIP lookupNetIPFunc) ([]zonalAddress, error)
+}
+
+func (p *managedProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *managedProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *managedProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	region := loc.awsRegion()
+	if region == "" {
+		return nil
+	}
+	var (
+		vpcID  = p.opts.vpcID
+		mapped []zonalAddress
+		loaded bool
+	)
+	load := func(ctx context.Context) ([]Prefix, bool, error) {
+		// Only the nodes in the VPC of this node are mapped, as others are neither reachable from it nor necessarily
+		// in the same zones
+		if vpcID == "" {
+			id, err := p.getVPCID()
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to get the VPC of the node: %w", err)
+			}
+			vpcID = id
+		}
+		addresses, err := p.getAddresses(ctx, region, vpcID, p.opts.services, p.zoneID, p.lookupNetIP)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to describe managed services: %w", err)
+		}
+		if loaded && slices.Equal(addresses, mapped) {
+			return nil, false, nil
+		}
+		mapped, loaded = addresses, true
+		log.Infof("Mapped %d address(es) of managed services in %s to their zones", len(addresses), vpcID)
+		return zonalAddressPrefixes(addresses), true, nil
+	}
+	startMapSource(ctx, "managed_services", p.opts.interval, load, update)
+	return nil
+}
+
+// managedEndpoint is a node of a managed service, addressed by hostname or IP, and the zone name or ID it runs in.
+type managedEndpoint struct {
+	host string
+	zone string
+}
+
+const (
+	// managedLookupTimeout bounds the resolution of the hostname of one node, so a slow resolver doesn't hold up the
+	// others.
+	managedLookupTimeout = 5 * time.Second
+	// managedLookupWorkers is how many hostnames are resolved at the same time, so that hundreds of nodes behind a
+	// slow resolver are resolved well within the refresh interval.
+	managedLookupWorkers = 16
+)
+
+// lookupNetIPFunc resolves a hostname to its addresses, like net.Resolver.LookupNetIP.
+type lookupNetIPFunc func(ctx context.Context, network, host string) ([]netip.Addr, error)
+
+// getManagedServiceAddresses returns the addresses of the nodes of the given managed services in the VPC vpcID of the
+// region, each with the zone it runs in. RDS instances and ElastiCache nodes only report a hostname, which is resolved
+// to the current addresses of the node with lookupNetIP, by managedLookupWorkers at a time. Nodes that cannot be
+// resolved are skipped. Zone names are translated with zoneID.
+func getManagedServiceAddresses(ctx context.Context, region string, vpcID string, services []string, zoneID zoneIDFunc, lookupNetIP lookupNetIPFunc) ([]zonalAddress, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS SDK config: %w", err)
+	}
+
+	var endpoints []managedEndpoint
+	for _, service := range services {
+		var found []managedEndpoint
+		switch service {
+		case managedRDS:
+			found, err = getRDSEndpoints(ctx, rds.NewFromConfig(cfg), vpcID)
+		case managedElastiCache:
+			found, err = getElastiCacheEndpoints(ctx, elasticache.NewFromConfig(cfg), vpcID)
+		case managedMSK:
+			found, err = getMSKEndpoints(ctx, kafka.NewFromConfig(cfg), ec2.NewFromConfig(cfg), vpcID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, found...)
+	}
+
+	resolved := resolveManagedEndpoints(ctx, endpoints, lookupNetIP)
+
+	zones := newZoneResolver(region, zoneID)
+	var addresses []zonalAddress
+	for i, endpoint := range endpoints {
+		if len(resolved[i]) == 0 {
+			continue
+		}
+		zone := zones.resolve(ctx, endpoint.zone)
+		for _, addr := range resolved[i] {
+			addresses = append(addresses, zonalAddress{addr: addr, zone: zone})
+		}
+	}
+
+	return addresses, nil
+}
+
+// resolveManagedEndpoints returns the addresses of each endpoint, at the index of the endpoint. The hostnames are
+// resolved by managedLookupWorkers at a time.
+func resolveManagedEndpoints(ctx context.Context, endpoints []managedEndpoint, lookupNetIP lookupNetIPFunc) [][]netip.Addr {
+	resolved := make([][]netip.Addr, len(endpoints))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(managedLookupWorkers, len(endpoints)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				resolved[i] = resolveManagedEndpoint(ctx, endpoints[i].host, lookupNetIP)
+			}
+		}()
+	}
+	for i := range endpoints {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return resolved
+}
+
+// resolveManagedEndpoint returns the addresses of host, an IP address or a hostname resolved with lookupNetIP within
+// managedLookupTimeout. A hostname that can't be resolved has no addresses.
+func resolveManagedEndpoint(ctx context.Context, host string, lookupNetIP lookupNetIPFunc) []netip.Addr {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}
+	}
+	ctx, cancel := context.WithTimeout(ctx, managedLookupTimeout)
+	defer cancel()
+	addrs, err := lookupNetIP(ctx, "ip", host)
+	if err != nil {
+		log.Debugf("Failed to resolve %s: %v", host, err)
+		return nil
+	}
+	return addrs
+}
+
+// getRDSEndpoints returns the endpoint of every RDS and Aurora DB instance in vpcID with the zone it runs in.
+func getRDSEndpoints(ctx context.Context, client *rds.Client, vpcID string) ([]managedEndpoint, error) {
+	var endpoints []managedEndpoint
+	paginator := rds.NewDescribeDBInstancesPaginator(client, &rds.DescribeDBInstancesInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe DB instances: %w", err)
+		}
+		for _, instance := range page.DBInstances {
+			if instance.Endpoint == nil || instance.Endpoint.Address == nil || instance.AvailabilityZone == nil {
+				continue
+			}
+			if instance.DBSubnetGroup == nil || aws.ToString(instance.DBSubnetGroup.VpcId) != vpcID {
+				continue
+			}
+			endpoints = append(endpoints, managedEndpoint{host: *instance.Endpoint.Address, zone: *instance.AvailabilityZone})
+		}
+	}
+	return endpoints, nil
+}
+
+// getElastiCacheEndpoints returns the endpoint of every ElastiCache cache node in vpcID with the zone it runs in.
+// Clusters only name their subnet group, whose VPC is looked up once all clusters are known.
+func getElastiCacheEndpoints(ctx context.Context, client *elasticache.Client, vpcID string) ([]managedEndpoint, error) {
+	// Cache node endpoints by the subnet group of their cluster.
+	groups := make(map[string][]managedEndpoint)
+	paginator := elasticache.NewDescribeCacheClustersPaginator(client, &elasticache.DescribeCacheClustersInput{ShowCacheNodeInfo: aws.Bool(true)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe cache clusters: %w", err)
+		}
+		for _, cluster := range page.CacheClusters {
+			group := aws.ToString(cluster.CacheSubnetGroupName)
+			for _, node := range cluster.CacheNodes {
+				if node.Endpoint == nil || node.Endpoint.Address == nil || node.CustomerAvailabilityZone == nil {
+					continue
+				}
+				groups[group] = append(groups[group], managedEndpoint{host: *node.Endpoint.Address, zone: *node.CustomerAvailabilityZone})
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	var endpoints []managedEndpoint
+	subnetGroups := elasticache.NewDescribeCacheSubnetGroupsPaginator(client, &elasticache.DescribeCacheSubnetGroupsInput{})
+	for subnetGroups.HasMorePages() {
+		page, err := subnetGroups.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe cache subnet groups: %w", err)
+		}
+		for _, group := range page.CacheSubnetGroups {
+			if aws.ToString(group.VpcId) == vpcID {
+				endpoints = append(endpoints, groups[aws.ToString(group.CacheSubnetGroupName)]...)
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// getMSKEndpoints returns the client address of every broker of the provisioned MSK clusters in vpcID. Brokers only
+// report their client subnet, whose VPC and zone ID are looked up with the EC2 API.
+func getMSKEndpoints(ctx context.Context, client *kafka.Client, ec2Client *ec2.Client, vpcID string) ([]managedEndpoint, error) {
+	// Broker client addresses by the subnet they are in.
+	brokers := make(map[string][]string)
+	clusters := kafka.NewListClustersV2Paginator(client, &kafka.ListClustersV2Input{ClusterTypeFilter: aws.String("PROVISIONED")})
+	for clusters.HasMorePages() {
+		page, err := clusters.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list MSK clusters: %w", err)
+		}
+		for _, cluster := range page.ClusterInfoList {
+			nodes := kafka.NewListNodesPaginator(client, &kafka.ListNodesInput{ClusterArn: cluster.ClusterArn})
+			for nodes.HasMorePages() {
+				page, err := nodes.NextPage(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("failed to list nodes of MSK cluster %s: %w", aws.ToString(cluster.ClusterName), err)
+				}
+				for _, node := range page.NodeInfoList {
+					broker := node.BrokerNodeInfo
+					if broker == nil || broker.ClientVpcIpAddress == nil || broker.ClientSubnet == nil {
+						continue
+					}
+					brokers[*broker.ClientSubnet] = append(brokers[*broker.ClientSubnet], *broker.ClientVpcIpAddress)
+				}
+			}
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, nil
+	}
+
+	var endpoints []managedEndpoint
+	subnets := ec2.NewDescribeSubnetsPaginator(ec2Client, &ec2.DescribeSubnetsInput{SubnetIds: slices.Sorted(maps.Keys(brokers))})
+	for subnets.HasMorePages() {
+		page, err := subnets.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe MSK broker subnets: %w", err)
+		}
+		for _, subnet := range page.Subnets {
+			zone := aws.ToString(subnet.AvailabilityZoneId)
+			if zone == "" || aws.ToString(subnet.VpcId) != vpcID {
+				continue
+			}
+			for _, address := range brokers[aws.ToString(subnet.SubnetId)] {
+				endpoints = append(endpoints, managedEndpoint{host: address, zone: zone})
+			}
+		}
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,320 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestGetManagedServiceAddresses(t *testing.T) {
+	zoneID := func(ctx context.Context, zoneName string, region string) (string, error) {
+		switch zoneName {
+		case "us-east-1a":
+			return "use1-az6", nil
+		case "us-east-1b":
+			return "use1-az1", nil
+		}
+		return "", errors.New("unknown zone")
+	}
+	lookupNetIP := func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > managedLookupTimeout {
+			t.Errorf("Expected the lookup of %s to be bounded by %s", host, managedLookupTimeout)
+		}
+		switch host {
+		case "db1.abc.us-east-1.rds.amazonaws.com":
+			return []netip.Addr{netip.MustParseAddr("10.0.1.10")}, nil
+		case "cache-0001-001.abc.use1.cache.amazonaws.com":
+			return []netip.Addr{netip.MustParseAddr("10.0.2.20"), netip.MustParseAddr("2001:db8::20")}, nil
+		case "peered.abc.us-east-1.rds.amazonaws.com", "peered-0001-001.abc.use1.cache.amazonaws.com":
+			t.Errorf("Expected %s outside the VPC not to be resolved", host)
+		}
+		return nil, errors.New("no such host")
+	}
+
+	newFakeAWSAPI(t, "RDS", map[string]string{
+		"DescribeDBInstances": `<DescribeDBInstancesResponse xmlns="http://rds.amazonaws.com/doc/2014-10-31/">
+  <DescribeDBInstancesResult>
+    <DBInstances>
+      <DBInstance>
+        <DBInstanceIdentifier>db1</DBInstanceIdentifier>
+        <AvailabilityZone>us-east-1a</AvailabilityZone>
+        <DBSubnetGroup><DBSubnetGroupName>app</DBSubnetGroupName><VpcId>vpc-local</VpcId></DBSubnetGroup>
+        <Endpoint><Address>db1.abc.us-east-1.rds.amazonaws.com</Address><Port>5432</Port></Endpoint>
+      </DBInstance>
+      <DBInstance>
+        <DBInstanceIdentifier>creating</DBInstanceIdentifier>
+        <AvailabilityZone>us-east-1b</AvailabilityZone>
+      </DBInstance>
+      <DBInstance>
+        <DBInstanceIdentifier>deleted</DBInstanceIdentifier>
+        <AvailabilityZone>us-east-1b</AvailabilityZone>
+        <DBSubnetGroup><DBSubnetGroupName>app</DBSubnetGroupName><VpcId>vpc-local</VpcId></DBSubnetGroup>
+        <Endpoint><Address>gone.abc.us-east-1.rds.amazonaws.com</Address></Endpoint>
+      </DBInstance>
+      <DBInstance>
+        <DBInstanceIdentifier>peered</DBInstanceIdentifier>
+        <AvailabilityZone>us-east-1b</AvailabilityZone>
+        <DBSubnetGroup><DBSubnetGroupName>other</DBSubnetGroupName><VpcId>vpc-other</VpcId></DBSubnetGroup>
+        <Endpoint><Address>peered.abc.us-east-1.rds.amazonaws.com</Address></Endpoint>
+      </DBInstance>
+    </DBInstances>
+  </DescribeDBInstancesResult>
+  <ResponseMetadata><RequestId>1</RequestId></ResponseMetadata>
+</DescribeDBInstancesResponse>`,
+	})
+	newFakeAWSAPI(t, "ELASTICACHE", map[string]string{
+		"DescribeCacheClusters": `<DescribeCacheClustersResponse xmlns="http://elasticache.amazonaws.com/doc/2015-02-02/">
+  <DescribeCacheClustersResult>
+    <CacheClusters>
+      <CacheCluster>
+        <CacheClusterId>cache-0001-001</CacheClusterId>
+        <CacheSubnetGroupName>app</CacheSubnetGroupName>
+        <CacheNodes>
+          <CacheNode>
+            <CacheNodeId>0001</CacheNodeId>
+            <CustomerAvailabilityZone>us-east-1b</CustomerAvailabilityZone>
+            <Endpoint><Address>cache-0001-001.abc.use1.cache.amazonaws.com</Address><Port>6379</Port></Endpoint>
+          </CacheNode>
+        </CacheNodes>
+      </CacheCluster>
+      <CacheCluster>
+        <CacheClusterId>peered-0001-001</CacheClusterId>
+        <CacheSubnetGroupName>other</CacheSubnetGroupName>
+        <CacheNodes>
+          <CacheNode>
+            <CacheNodeId>0001</CacheNodeId>
+            <CustomerAvailabilityZone>us-east-1a</CustomerAvailabilityZone>
+            <Endpoint><Address>peered-0001-001.abc.use1.cache.amazonaws.com</Address><Port>6379</Port></Endpoint>
+          </CacheNode>
+        </CacheNodes>
+      </CacheCluster>
+    </CacheClusters>
+  </DescribeCacheClustersResult>
+  <ResponseMetadata><RequestId>2</RequestId></ResponseMetadata>
+</DescribeCacheClustersResponse>`,
+		"DescribeCacheSubnetGroups": `<DescribeCacheSubnetGroupsResponse xmlns="http://elasticache.amazonaws.com/doc/2015-02-02/">
+  <DescribeCacheSubnetGroupsResult>
+    <CacheSubnetGroups>
+      <CacheSubnetGroup><CacheSubnetGroupName>app</CacheSubnetGroupName><VpcId>vpc-local</VpcId></CacheSubnetGroup>
+      <CacheSubnetGroup><CacheSubnetGroupName>other</CacheSubnetGroupName><VpcId>vpc-other</VpcId></CacheSubnetGroup>
+    </CacheSubnetGroups>
+  </DescribeCacheSubnetGroupsResult>
+  <ResponseMetadata><RequestId>4</RequestId></ResponseMetadata>
+</DescribeCacheSubnetGroupsResponse>`,
+	})
+	ec2Requests := newFakeAWSAPI(t, "EC2", map[string]string{
+		"DescribeSubnets": `<DescribeSubnetsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>3</requestId>
+  <subnetSet>
+    <item><subnetId>subnet-a</subnetId><vpcId>vpc-local</vpcId><availabilityZoneId>use1-az6</availabilityZoneId></item>
+    <item><subnetId>subnet-b</subnetId><vpcId>vpc-local</vpcId><availabilityZoneId>use1-az1</availabilityZoneId></item>
+    <item><subnetId>subnet-c</subnetId><vpcId>vpc-other</vpcId><availabilityZoneId>use1-az1</availabilityZoneId></item>
+  </subnetSet>
+</DescribeSubnetsResponse>`,
+	})
+
+	kafka := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v2/clusters":
+			if r.URL.Query().Get("clusterTypeFilter") != "PROVISIONED" {
+				t.Errorf("Expected clusters to be filtered by type, got %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"clusterInfoList": [{"clusterArn": "arn:aws:kafka:us-east-1:123456789012:cluster/events/1", "clusterName": "events"}]}`))
+		case "/v1/clusters/arn:aws:kafka:us-east-1:123456789012:cluster/events/1/nodes":
+			w.Write([]byte(`{"nodeInfoList": [
+  {"nodeType": "BROKER", "brokerNodeInfo": {"brokerId": 1, "clientSubnet": "subnet-a", "clientVpcIpAddress": "10.0.1.30"}},
+  {"nodeType": "BROKER", "brokerNodeInfo": {"brokerId": 2, "clientSubnet": "subnet-b", "clientVpcIpAddress": "10.0.2.30"}},
+  {"nodeType": "BROKER", "brokerNodeInfo": {"brokerId": 3, "clientSubnet": "subnet-b", "clientVpcIpAddress": "10.0.2.31"}},
+  {"nodeType": "BROKER", "brokerNodeInfo": {"brokerId": 4, "clientSubnet": "subnet-c", "clientVpcIpAddress": "10.9.2.31"}}
+]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(kafka.Close)
+	t.Setenv("AWS_ENDPOINT_URL_KAFKA", kafka.URL)
+
+	addresses, err := getManagedServiceAddresses(context.Background(), "us-east-1", "vpc-local", managedServices, zoneID, lookupNetIP)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	expected := map[string]string{
+		"10.0.1.10":    "use1-az6",
+		"10.0.2.20":    "use1-az1",
+		"2001:db8::20": "use1-az1",
+		"10.0.1.30":    "use1-az6",
+		"10.0.2.30":    "use1-az1",
+		"10.0.2.31":    "use1-az1",
+	}
+	if got := addressZones(addresses); !maps.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	requests := ec2Requests()
+	if len(requests) != 1 || requests[0].Get("SubnetId.1") != "subnet-a" || requests[0].Get("SubnetId.2") != "subnet-b" || requests[0].Get("SubnetId.3") != "subnet-c" {
+		t.Errorf("Expected one DescribeSubnets call for the broker subnets, got %v", requests)
+	}
+}
+
+func TestResolveManagedEndpoints(t *testing.T) {
+	var endpoints []managedEndpoint
+	for i := range 5 * managedLookupWorkers {
+		endpoints = append(endpoints, managedEndpoint{host: fmt.Sprintf("node-%d.cache.amazonaws.com", i)})
+	}
+	endpoints = append(endpoints, managedEndpoint{host: "10.0.9.9"}, managedEndpoint{host: "unknown.cache.amazonaws.com"})
+
+	// Every lookup is slow, so resolving them one after another would take far longer than the test allows
+	var running, most atomic.Int32
+	lookupNetIP := func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		var i int
+		if _, err := fmt.Sscanf(host, "node-%d.cache.amazonaws.com", &i); err != nil {
+			return nil, errors.New("no such host")
+		}
+		return []netip.Addr{netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})}, nil
+	}
+
+	start := time.Now()
+	resolved := resolveManagedEndpoints(context.Background(), endpoints, lookupNetIP)
+	if elapsed := time.Since(start); elapsed > time.Duration(len(endpoints))*20*time.Millisecond/2 {
+		t.Errorf("Expected the hostnames to be resolved concurrently, took %s", elapsed)
+	}
+	if got := most.Load(); got > managedLookupWorkers {
+		t.Errorf("Expected at most %d lookups at a time, got %d", managedLookupWorkers, got)
+	}
+
+	if len(resolved) != len(endpoints) {
+		t.Fatalf("Expected the addresses of %d endpoints, got %d", len(endpoints), len(resolved))
+	}
+	for i := range 5 * managedLookupWorkers {
+		if expected := []netip.Addr{netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})}; !slices.Equal(resolved[i], expected) {
+			t.Errorf("Expected %s to resolve to %v, got %v", endpoints[i].host, expected, resolved[i])
+		}
+	}
+	if expected := []netip.Addr{netip.MustParseAddr("10.0.9.9")}; !slices.Equal(resolved[len(resolved)-2], expected) {
+		t.Errorf("Expected an address to be used as is, got %v", resolved[len(resolved)-2])
+	}
+	if addrs := resolved[len(resolved)-1]; addrs != nil {
+		t.Errorf("Expected no addresses for an unknown host, got %v", addrs)
+	}
+}
+
+func TestParseManagedOptions(t *testing.T) {
+	opts, err := parseManagedOptions(nil)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !slices.Equal(opts.services, managedServices) || opts.interval != defaultManagedInterval {
+		t.Errorf("Expected all services every %s by default, got %+v", defaultManagedInterval, opts)
+	}
+
+	opts, err = parseManagedOptions([]string{"msk", "rds", "msk", "interval=1m"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !slices.Equal(opts.services, []string{managedMSK, managedRDS}) || opts.interval != time.Minute {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+
+	opts, err = parseManagedOptions([]string{"rds", "vpc=vpc-1"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !slices.Equal(opts.services, []string{managedRDS}) || opts.vpcID != "vpc-1" {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+
+	for _, args := range [][]string{{"dynamodb"}, {"interval=0s"}, {"interval=soon"}, {"vpc="}, {"subnet=subnet-1"}} {
+		if _, err := parseManagedOptions(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestSetupManagedServices(t *testing.T) {
+	setupTest(t)
+
+	var (
+		mu       sync.Mutex
+		services []string
+		replica  = "10.0.2.20"
+	)
+	patchProvider(t, "managed_services", func(p *managedProvider) {
+		p.getVPCID = func() (string, error) { return "vpc-local", nil }
+		p.getAddresses = func(ctx context.Context, region string, vpcID string, s []string, zoneID zoneIDFunc, lookupNetIP lookupNetIPFunc) ([]zonalAddress, error) {
+			if vpcID != "vpc-local" {
+				t.Errorf("Expected the VPC of the node, got %s", vpcID)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			services = s
+			return []zonalAddress{
+				{addr: netip.MustParseAddr("10.0.1.10"), zone: "use1-az1"},
+				{addr: netip.MustParseAddr(replica), zone: "use1-az2"},
+			}, nil
+		}
+	})
+
+	opts, err := parse(caddy.NewTestController("dns", "zoneawareness {\n\tmanaged_services interval=10ms\n}"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if names := opts.providerNames(); !slices.Equal(names, []string{"aws", "ecs", "env", "managed_services"}) {
+		t.Fatalf("Expected the managed_services provider after the default providers, got %v", names)
+	}
+
+	za := &Zoneawareness{Zones: make(map[string]*Zone), currentAvailabilityZoneId: "use1-az1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	managed := opts.providers[3].provider.(Watcher)
+	loc := Location{Zone: "use1-az1", Region: "us-east-1", Cloud: CloudAWS}
+	if err := managed.Watch(ctx, loc, func(prefixes []Prefix) { za.setProviderPrefixes("managed_services", prefixes) }); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	zoneOf := func(ip string) string {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.hosts[netip.MustParseAddr(ip)]
+	}
+	mu.Lock()
+	if !slices.Equal(services, managedServices) {
+		t.Errorf("Expected all managed services by default, got %v", services)
+	}
+	mu.Unlock()
+	for ip, zone := range map[string]string{"10.0.1.10": "use1-az1", "10.0.2.20": "use1-az2"} {
+		if got := zoneOf(ip); got != zone {
+			t.Errorf("Expected %s in zone '%s', got '%s'", ip, zone, got)
+		}
+	}
+
+	// The replica is replaced, and its hostname now resolves to another address
+	mu.Lock()
+	replica = "10.0.2.30"
+	mu.Unlock()
+	waitFor(t, "the nodes to be described again", func() bool { return zoneOf("10.0.2.30") == "use1-az2" && zoneOf("10.0.2.20") == "" })
+
+	// Outside AWS there is no VPC to describe
+	if err := managed.Watch(ctx, Location{Zone: "us-central1-a", Region: "us-central1", Cloud: CloudGCP}, func(prefixes []Prefix) {
+		t.Errorf("Expected no update outside AWS, got %v", prefixes)
+	}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+const defaultAWSMapInterval = 5 * time.Minute
+
+// awsMap is a zone map shared through an SSM parameter or an S3 object.
+type awsMap struct {
+	option   string // "ssm_parameter" or "s3_object"
+	name     string // the parameter name, or the bucket and key of the object as s3://BUCKET/KEY
+	region   string // empty for the region of the node
+	endpoint string // overrides the service endpoint, e.g. for LocalStack
+	interval time.Duration
+}
+
+// parseAWSMap parses the arguments of the ssm_parameter and s3_object options: a parameter name or S3 URL followed
+// by region=REGION, endpoint=URL and interval=INTERVAL.
+func parseAWSMap(option string, args []string) (awsMap, error) {
+	if len(args) == 0 {
+		return awsMap{}, fmt.Errorf("expected a parameter name or S3 URL")
+	}
+	m := awsMap{option: option, name: args[0], interval: defaultAWSMapInterval}
+	if option == "s3_object" {
+		if _, _, err := m.bucketKey(); err != nil {
+			return awsMap{}, err
+		}
+	}
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || value == "" {
+			return awsMap{}, fmt.Errorf("expected KEY=VALUE, got '%s'", arg)
+		}
+		switch key {
+		case "region":
+			m.region = value
+		case "endpoint":
+			if _, err := url.ParseRequestURI(value); err != nil {
+				return awsMap{}, fmt.Errorf("invalid endpoint: %w", err)
+			}
+			m.endpoint = value
+		case "interval":
+			interval, err := time.ParseDuration(value)
+			if err != nil {
+				return awsMap{}, err
+			}
+			if interval <= 0 {
+				return awsMap{}, fmt.Errorf("refresh interval must be positive, got %s", interval)
+			}
+			m.interval = interval
+		default:
+			return awsMap{}, fmt.Errorf("unknown argument '%s'", key)
+		}
+	}
+	return m, nil
+}
+
+// bucketKey splits the S3 URL of an object into its bucket and key.
+func (m awsMap) bucketKey() (string, string, error) {
+	u, err := url.Parse(m.name)
+	if err != nil {
+		return "", "", err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "s3" || u.Host == "" || key == "" {
+		return "", "", fmt.Errorf("expected s3://BUCKET/KEY, got '%s'", m.name)
+	}
+	return u.Host, key, nil
+}
+
+// source names the map in logs and metrics.
+func (m awsMap) source() string {
+	if m.option == "ssm_parameter" {
+		return "ssm:" + m.name
+	}
+	return m.name
+}
+
+// getSSMParameter returns the version of an SSM parameter and, if it differs from since, its value. SecureString
+// parameters are decrypted, which needs kms:Decrypt on their key. Once a version was loaded, the version is checked
+// without decryption first, so an unchanged parameter is not decrypted again.
+func getSSMParameter(ctx context.Context, client *ssm.Client, name string, since string) (string, []byte, error) {
+	if since != "" {
+		output, err := client.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(false)})
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get parameter %s: %w", name, err)
+		}
+		if version := fmt.Sprint(output.Parameter.Version); version == since {
+			return version, nil, nil
+		}
+	}
+	output, err := client.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get parameter %s: %w", name, err)
+	}
+	return fmt.Sprint(output.Parameter.Version), []byte(aws.ToString(output.Parameter.Value)), nil
+}
+
+// getS3Object returns the ETag of an S3 object and, if it differs from since, its content. The request is
+// conditional, so an unchanged object is not transferred again.
+func getS3Object(ctx context.Context, client *s3.Client, bucket, key string, since string) (string, []byte, error) {
+	input := &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	if since != "" {
+		input.IfNoneMatch = aws.String(since)
+	}
+	output, err := client.GetObject(ctx, input)
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusNotModified {
+		return since, nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get s3://%s/%s: %w", bucket, key, err)
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read s3://%s/%s: %w", bucket, key, err)
+	}
+	return aws.ToString(output.ETag), data, nil
+}
+
+// getter returns a function fetching the map through a client created from cfg.
+func (m awsMap) getter(cfg aws.Config) func(ctx context.Context, since string) (string, []byte, error) {
+	if m.option == "ssm_parameter" {
+		client := ssm.NewFromConfig(cfg, func(o *ssm.Options) {
+			if m.endpoint != "" {
+				o.BaseEndpoint = aws.String(m.endpoint)
+			}
+		})
+		return func(ctx context.Context, since string) (string, []byte, error) {
+			return getSSMParameter(ctx, client, m.name, since)
+		}
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if m.endpoint != "" {
+			o.BaseEndpoint = aws.String(m.endpoint)
+			// Endpoints such as LocalStack don't resolve bucket subdomains.
+			o.UsePathStyle = true
+		}
+	})
+	// The URL was validated when the option was parsed.
+	bucket, key, _ := m.bucketKey()
+	return func(ctx context.Context, since string) (string, []byte, error) {
+		return getS3Object(ctx, client, bucket, key, since)
+	}
+}
+
+// loader returns a mapLoader fetching the map when its parameter version or object ETag changed. region is the
+// region of the node, used when the map has no region of its own. The SDK config and client are created on the
+// first load and reused by later ones.
+func (m awsMap) loader(region string) (mapLoader, error) {
+	if m.region != "" {
+		region = m.region
+	}
+	if region == "" {
+		return nil, fmt.Errorf("%s: the region of the node is unknown, set region=", m.source())
+	}
+
+	var get func(ctx context.Context, since string) (string, []byte, error)
+	loaded := ""
+	return func(ctx context.Context) ([]Prefix, bool, error) {
+		if get == nil {
+			cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to load AWS SDK config: %w", err)
+			}
+			get = m.getter(cfg)
+		}
+		version, data, err := get(ctx, loaded)
+		if err != nil {
+			return nil, false, err
+		}
+		if version == loaded {
+			return nil, false, nil
+		}
+		prefixes, err := parseZoneMap(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid map %s: %w", m.source(), err)
+		}
+		// The version is only kept for a map that parsed, so a broken map is fetched again.
+		loaded = version
+		log.Infof("Loaded %d CIDR(s) from %s version %s", len(prefixes), m.source(), version)
+		return prefixes, true, nil
+	}, nil
+}
+
+// awsMapProvider loads a zone map shared through an SSM parameter or an S3 object and checks it for a new version
+// every interval. It does not locate the node.
+type awsMapProvider struct {
+	m awsMap
+}
+
+func (p *awsMapProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *awsMapProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+// Watch starts loading the map. Maps without a region of their own are read in the region of the node.
+func (p *awsMapProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	load, err := p.m.loader(loc.awsRegion())
+	if err != nil {
+		return err
+	}
+	startMapSource(ctx, p.source(), p.m.interval, load, update)
+	return nil
+}
+
+// source names the provider by its parameter or object, so that several maps can be configured.
+func (p *awsMapProvider) source() string {
+	return p.m.source()
+}
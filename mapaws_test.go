@@ -0,0 +1,148 @@
+package zoneawareness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setFakeAWSCredentials keeps the AWS SDK from looking for real credentials and from asking IMDS.
+func setFakeAWSCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+}
+
+func TestParseAWSMap(t *testing.T) {
+	m, err := parseAWSMap("s3_object", []string{"s3://zone-maps/prod/map.yaml", "region=eu-west-1", "endpoint=http://localhost:4566", "interval=1m"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if m.region != "eu-west-1" || m.endpoint != "http://localhost:4566" || m.interval != time.Minute || m.source() != "s3://zone-maps/prod/map.yaml" {
+		t.Errorf("Unexpected options: %+v", m)
+	}
+	if bucket, key, _ := m.bucketKey(); bucket != "zone-maps" || key != "prod/map.yaml" {
+		t.Errorf("Expected bucket zone-maps and key prod/map.yaml, got %s and %s", bucket, key)
+	}
+
+	m, err = parseAWSMap("ssm_parameter", []string{"/zoneawareness/map"})
+	if err != nil || m.source() != "ssm:/zoneawareness/map" || m.interval != defaultAWSMapInterval {
+		t.Errorf("Unexpected parameter: %+v, %v", m, err)
+	}
+
+	for _, args := range [][]string{{}, {"https://zone-maps/map.yaml"}, {"s3://zone-maps"}, {"s3://zone-maps/map.yaml", "endpoint=localhost"}, {"s3://zone-maps/map.yaml", "acl=private"}} {
+		if _, err := parseAWSMap("s3_object", args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+
+	if _, err := m.loader(""); err == nil {
+		t.Error("Expected an error for a map without a region on a node without one")
+	}
+	m.region = "eu-west-1"
+	if _, err := m.loader(""); err != nil {
+		t.Errorf("Expected region= to stand in for the region of the node, got %v", err)
+	}
+}
+
+func TestGetSSMParameter(t *testing.T) {
+	setFakeAWSCredentials(t)
+	var (
+		mu        sync.Mutex
+		version   = 3
+		decrypted []bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Name           string
+			WithDecryption bool
+		}
+		if r.Header.Get("X-Amz-Target") != "AmazonSSM.GetParameter" || json.NewDecoder(r.Body).Decode(&input) != nil || input.Name != "/zoneawareness/map" {
+			http.Error(w, `{"__type": "ValidationException"}`, http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		decrypted = append(decrypted, input.WithDecryption)
+		value := "AQICAHh...encrypted"
+		if input.WithDecryption {
+			value = "zones:\n  use1-az1:\n    cidrs: [10.0.0.0/16]\n"
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprintf(w, `{"Parameter": {"Name": "/zoneawareness/map", "Type": "SecureString", "Version": %d, "Value": %q}}`, version, value)
+	}))
+	t.Cleanup(server.Close)
+
+	m := awsMap{option: "ssm_parameter", name: "/zoneawareness/map", endpoint: server.URL}
+	load, err := m.loader("us-east-1")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	prefixes, changed, err := load(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !changed || len(prefixes) != 1 || prefixes[0].Zone != "use1-az1" {
+		t.Errorf("Unexpected first load: %v, %t", prefixes, changed)
+	}
+	if _, changed, err := load(context.Background()); err != nil || changed {
+		t.Errorf("Expected the same version not to be loaded again, got %t, %v", changed, err)
+	}
+
+	mu.Lock()
+	version = 4
+	mu.Unlock()
+	if _, changed, err := load(context.Background()); err != nil || !changed {
+		t.Errorf("Expected the new version to be loaded, got %t, %v", changed, err)
+	}
+	// The value is only decrypted on the first load and when the version changed
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := []bool{true, false, false, true}; !slices.Equal(decrypted, expected) {
+		t.Errorf("Expected requests with decryption %v, got %v", expected, decrypted)
+	}
+}
+
+func TestGetS3Object(t *testing.T) {
+	setFakeAWSCredentials(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != http.MethodGet || r.URL.Path != "/zone-maps/prod/map.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"zones": {"eu-central-1/euc1-az1": {"cidrs": ["10.1.0.0/16"]}}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	m := awsMap{option: "s3_object", name: "s3://zone-maps/prod/map.yaml", endpoint: server.URL}
+	load, err := m.loader("eu-central-1")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	prefixes, changed, err := load(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !changed || len(prefixes) != 1 || prefixes[0].Zone != "eu-central-1/euc1-az1" {
+		t.Errorf("Unexpected first load: %v, %t", prefixes, changed)
+	}
+	if _, changed, err := load(context.Background()); err != nil || changed {
+		t.Errorf("Expected the unchanged object not to be loaded again, got %t, %v", changed, err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+}
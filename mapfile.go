@@ -0,0 +1,172 @@
+package zoneawareness
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultMapFileInterval = 10 * time.Second
+
+// mapFile is a zone map loaded from a YAML or JSON file, or from a Terraform state file.
+type mapFile struct {
+	path     string
+	interval time.Duration
+	option   string // the option the file is configured by: "file" or "terraform_state"
+}
+
+// source names the file in logs and metrics.
+func (f mapFile) source() string {
+	return f.option + ":" + f.path
+}
+
+// parseMapFile parses the arguments of the file option: a path and an optional interval the file is checked for
+// changes at.
+func parseMapFile(args []string) (mapFile, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return mapFile{}, fmt.Errorf("expected a path and an optional check interval")
+	}
+	file := mapFile{path: args[0], interval: defaultMapFileInterval, option: "file"}
+	if len(args) == 2 {
+		interval, err := time.ParseDuration(args[1])
+		if err != nil {
+			return mapFile{}, err
+		}
+		if interval <= 0 {
+			return mapFile{}, fmt.Errorf("check interval must be positive, got %s", interval)
+		}
+		file.interval = interval
+	}
+	return file, nil
+}
+
+// zoneMap is a document mapping zones to their CIDRs, e.g.
+//
+//	zones:
+//	  eu-central-1/euc1-az1:
+//	    cidrs: [10.1.0.0/16, 2001:db8:1::/48]
+//	    labels:
+//	      site: fra1
+//
+// Zones are named like zones in the Corefile, by an AWS Zone ID or a topology path. Labels are kept as the metadata
+// of the CIDRs of the zone.
+type zoneMap struct {
+	Zones map[string]zoneMapZone `yaml:"zones" json:"zones"`
+}
+
+// zoneMapZone is a zone of a zoneMap.
+type zoneMapZone struct {
+	CIDRs  []string          `yaml:"cidrs" json:"cidrs"`
+	Labels map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+}
+
+// parseZoneMap parses a zone map in YAML or JSON, which YAML includes. Unknown fields, invalid zone names and
+// invalid CIDRs fail the whole map so that a broken map never replaces a good one in part.
+func parseZoneMap(data []byte) ([]Prefix, error) {
+	var doc zoneMap
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	var prefixes []Prefix
+	for _, name := range slices.Sorted(maps.Keys(doc.Zones)) {
+		zone := doc.Zones[name]
+		if strings.Contains(name, "/") {
+			if _, err := parseTopologyPath(name); err != nil {
+				return nil, fmt.Errorf("invalid zone '%s': %w", name, err)
+			}
+		} else if name == "" {
+			return nil, fmt.Errorf("empty zone name")
+		}
+		for _, cidr := range zone.CIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR for zone '%s': %w", name, err)
+			}
+			prefixes = append(prefixes, Prefix{Prefix: prefix, Zone: name, Metadata: maps.Clone(zone.Labels)})
+		}
+	}
+	return prefixes, nil
+}
+
+// MarshalZoneMap writes prefixes as a YAML zone map, as read by the file option. The metadata of the prefixes is not
+// written.
+func MarshalZoneMap(prefixes []Prefix) ([]byte, error) {
+	doc := zoneMap{Zones: make(map[string]zoneMapZone)}
+	for _, p := range prefixes {
+		zone := doc.Zones[p.Zone]
+		if cidr := p.Prefix.String(); !slices.Contains(zone.CIDRs, cidr) {
+			zone.CIDRs = append(zone.CIDRs, cidr)
+		}
+		doc.Zones[p.Zone] = zone
+	}
+	return yaml.Marshal(doc)
+}
+
+// loader returns a mapLoader reading the file when its size or modification time changed. Files mounted from a
+// Kubernetes ConfigMap are replaced through a symlink, which is followed.
+func (f mapFile) loader() mapLoader {
+	var loaded os.FileInfo
+	return func(ctx context.Context) ([]Prefix, bool, error) {
+		info, err := os.Stat(f.path)
+		if err != nil {
+			return nil, false, err
+		}
+		if loaded != nil && info.Size() == loaded.Size() && info.ModTime().Equal(loaded.ModTime()) {
+			return nil, false, nil
+		}
+
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, false, err
+		}
+		// A file that was read but fails to parse is not parsed again until it changes, while a file that could
+		// not be read is read again on the next check.
+		loaded = info
+		parse := parseZoneMap
+		if f.option == "terraform_state" {
+			parse = ParseTerraformState
+		}
+		prefixes, err := parse(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s %s: %w", f.option, f.path, err)
+		}
+		log.Infof("Loaded %d CIDR(s) from %s", len(prefixes), f.source())
+		return prefixes, true, nil
+	}
+}
+
+// mapFileProvider loads a map file and reloads it when it changes. It does not locate the node.
+type mapFileProvider struct {
+	file mapFile
+}
+
+func (p *mapFileProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *mapFileProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *mapFileProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	startMapSource(ctx, p.source(), p.file.interval, p.file.loader(), update)
+	return nil
+}
+
+// source names the provider by its file, so that several files can be configured.
+func (p *mapFileProvider) source() string {
+	return p.file.source()
+}
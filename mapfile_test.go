@@ -0,0 +1,145 @@
+package zoneawareness
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseZoneMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected map[string]string
+	}{
+		{
+			name: "YAML",
+			data: `
+zones:
+  eu-central-1/euc1-az1:
+    cidrs: [10.1.0.0/16, "2001:db8:1::/48"]
+    labels:
+      site: fra1
+  euc1-az2:
+    cidrs:
+      - 10.2.0.0/16
+`,
+			expected: map[string]string{"10.1.0.0/16": "eu-central-1/euc1-az1", "2001:db8:1::/48": "eu-central-1/euc1-az1", "10.2.0.0/16": "euc1-az2"},
+		},
+		{
+			name:     "JSON",
+			data:     `{"zones": {"eu-central-1/euc1-az1": {"cidrs": ["10.1.0.0/16"], "labels": {"site": "fra1"}}}}`,
+			expected: map[string]string{"10.1.0.0/16": "eu-central-1/euc1-az1"},
+		},
+		{
+			name:     "Empty",
+			data:     "",
+			expected: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefixes, err := parseZoneMap([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			if len(prefixes) != len(tt.expected) {
+				t.Errorf("Expected %d prefixes, got %v", len(tt.expected), prefixes)
+			}
+			for _, p := range prefixes {
+				if tt.expected[p.Prefix.String()] != p.Zone {
+					t.Errorf("Expected %s in zone '%s', got '%s'", p.Prefix, tt.expected[p.Prefix.String()], p.Zone)
+				}
+				if p.Zone == "eu-central-1/euc1-az1" && p.Metadata["site"] != "fra1" {
+					t.Errorf("Expected the labels of the zone as metadata of %s, got %v", p.Prefix, p.Metadata)
+				}
+			}
+		})
+	}
+
+	for _, data := range []string{
+		"zones:\n  euc1-az1:\n    cidrs: [10.1.0.0]\n",
+		"zones:\n  eu-central-1//euc1-az1:\n    cidrs: [10.1.0.0/16]\n",
+		"zones:\n  euc1-az1:\n    cidr: [10.1.0.0/16]\n",
+		"zones: [",
+	} {
+		if _, err := parseZoneMap([]byte(data)); err == nil {
+			t.Errorf("Expected an error for %q", data)
+		}
+	}
+}
+
+func TestParseMapFile(t *testing.T) {
+	file, err := parseMapFile([]string{"/etc/zoneawareness/map.yaml", "1m"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if file.path != "/etc/zoneawareness/map.yaml" || file.interval != time.Minute {
+		t.Errorf("Unexpected map file: %+v", file)
+	}
+	for _, args := range [][]string{{}, {"map.yaml", "0s"}, {"map.yaml", "soon"}, {"map.yaml", "1m", "extra"}} {
+		if _, err := parseMapFile(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestStartMapFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map.yaml")
+	write := func(data string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// Modification times may be coarse, so each version of the file gets a distinct one.
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("zones:\n  eu-central-1/euc1-az1:\n    cidrs: [10.1.0.0/16]\n", start)
+
+	za := &Zoneawareness{Zones: make(map[string]*Zone), topology: []string{"eu-central-1", "euc1-az1"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	provider := &mapFileProvider{file: mapFile{path: path, interval: 10 * time.Millisecond, option: "file"}}
+	if err := provider.Watch(ctx, Location{}, func(prefixes []Prefix) { za.setProviderPrefixes(provider.source(), prefixes) }); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	rank := func(ip string) int {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.rankIP(net.ParseIP(ip), za.localPath())
+	}
+	if r := rank("10.1.2.3"); r != 2 {
+		t.Errorf("Expected 10.1.2.3 to have rank 2, got %d", r)
+	}
+
+	// A broken map is counted as an error and keeps the map loaded before.
+	errors := mapLoadErrors.WithLabelValues("file:" + path)
+	write("zones:\n  eu-central-1/euc1-az2:\n    cidrs: [10.2.0.0/160]\n", start.Add(time.Minute))
+	waitFor(t, "the map load error", func() bool { return testutil.ToFloat64(errors) == 1 })
+	if r := rank("10.1.2.3"); r != 2 {
+		t.Errorf("Expected 10.1.2.3 to keep rank 2, got %d", r)
+	}
+
+	write("zones:\n  eu-central-1/euc1-az2:\n    cidrs: [10.1.0.0/16]\n", start.Add(2*time.Minute))
+	waitFor(t, "the map to be replaced", func() bool {
+		return rank("10.1.2.3") == 1
+	})
+}
+
+func TestMapFileLoaderRetriesReadErrors(t *testing.T) {
+	// A directory can be checked for changes but not read.
+	path := t.TempDir()
+	load := mapFile{path: path, option: "file"}.loader()
+	for i := range 2 {
+		if _, changed, err := load(context.Background()); err == nil || changed {
+			t.Errorf("Expected check %d to fail reading the unchanged path, got %t, %v", i, changed, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package zoneawareness
+
+import (
+	"context"
+	"maps"
+	"time"
+)
+
+// mapLoader loads the prefixes of a map source, such as a map file. It returns changed false, and no prefixes, if
+// the map is unchanged since the last successful load.
+type mapLoader func(ctx context.Context) (prefixes []Prefix, changed bool, err error)
+
+// equalPrefix reports whether a and b are the same prefix in the same zone with the same metadata, for loaders telling
+// whether their map changed since the last load.
+func equalPrefix(a, b Prefix) bool {
+	return a.Prefix == b.Prefix && a.Zone == b.Zone && maps.Equal(a.Metadata, b.Metadata)
+}
+
+// startMapSource loads the map of source and reloads it every interval until ctx is done, passing its prefixes to
+// update whenever the map changed. A failed load keeps the map loaded before and is counted in the
+// map_load_errors_total metric.
+func startMapSource(ctx context.Context, source string, interval time.Duration, load mapLoader, update func([]Prefix)) {
+	const loadTimeout = time.Minute
+
+	reload := func() {
+		ctx, cancel := context.WithTimeout(ctx, loadTimeout)
+		defer cancel()
+
+		prefixes, changed, err := load(ctx)
+		if err != nil {
+			mapLoadErrors.WithLabelValues(source).Inc()
+			log.Errorf("Failed to load %s, keeping the map loaded before: %v", source, err)
+			return
+		}
+		mapLastSuccess.WithLabelValues(source).SetToCurrentTime()
+		if changed {
+			update(prefixes)
+		}
+	}
+
+	reload()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reload()
+			}
+		}
+	}()
+}
@@ -0,0 +1,48 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStartMapSource(t *testing.T) {
+	za := &Zoneawareness{Zones: make(map[string]*Zone), topology: []string{"eu-central-1", "euc1-az1"}}
+
+	var loads atomic.Int32
+	load := func(ctx context.Context) ([]Prefix, bool, error) {
+		switch loads.Add(1) {
+		case 1:
+			return []Prefix{
+				{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Zone: "eu-central-1/euc1-az1"},
+				{Prefix: netip.MustParsePrefix("10.3.0.4/32"), Zone: "eu-central-1/euc1-az1"},
+			}, true, nil
+		case 2:
+			return nil, false, nil
+		default:
+			return nil, false, errors.New("unavailable")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	startMapSource(ctx, "test", 10*time.Millisecond, load, func(prefixes []Prefix) { za.setProviderPrefixes("test", prefixes) })
+
+	waitFor(t, "failed loads", func() bool { return testutil.ToFloat64(mapLoadErrors.WithLabelValues("test")) >= 2 })
+	if testutil.ToFloat64(mapLastSuccess.WithLabelValues("test")) == 0 {
+		t.Error("Expected the time of the last successful load to be set")
+	}
+	za.mu.RLock()
+	defer za.mu.RUnlock()
+	for _, ip := range []string{"10.1.2.3", "10.3.0.4"} {
+		if rank := za.rankIP(net.ParseIP(ip), za.localPath()); rank != 2 {
+			t.Errorf("Expected %s to keep rank 2, got %d", ip, rank)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package zoneawareness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultMapURLInterval = time.Minute
+
+// mapURL is a zone map polled from an HTTP(S) URL.
+type mapURL struct {
+	url       string
+	interval  time.Duration
+	tokenFile string // file holding a bearer token, read before every request
+	schema    *mapSchema
+}
+
+// mapSchema maps a JSON document other than a zone map to prefixes: a list of items, each with a prefix, a zone and
+// optional labels. Fields are paths of object keys separated by dots.
+type mapSchema struct {
+	items  string // path of the list of items, empty for a document that is a list
+	prefix string
+	zone   string
+	labels []string
+}
+
+// parseMapURL parses the arguments of the url option: a URL followed by interval=INTERVAL, token_file=PATH and the
+// schema mapping items=PATH, prefix=FIELD, zone=FIELD and labels=FIELD[,FIELD...].
+func parseMapURL(args []string) (mapURL, error) {
+	if len(args) == 0 {
+		return mapURL{}, fmt.Errorf("expected a URL")
+	}
+	u, err := url.Parse(args[0])
+	if err != nil {
+		return mapURL{}, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return mapURL{}, fmt.Errorf("'%s' is not an HTTP(S) URL", args[0])
+	}
+
+	source := mapURL{url: args[0], interval: defaultMapURLInterval}
+	schema := mapSchema{prefix: "prefix", zone: "zone"}
+	mapped := false
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || value == "" {
+			return mapURL{}, fmt.Errorf("expected KEY=VALUE, got '%s'", arg)
+		}
+		switch key {
+		case "interval":
+			interval, err := time.ParseDuration(value)
+			if err != nil {
+				return mapURL{}, err
+			}
+			if interval <= 0 {
+				return mapURL{}, fmt.Errorf("refresh interval must be positive, got %s", interval)
+			}
+			source.interval = interval
+		case "token_file":
+			source.tokenFile = value
+		case "items":
+			schema.items, mapped = value, true
+		case "prefix":
+			schema.prefix, mapped = value, true
+		case "zone":
+			schema.zone, mapped = value, true
+		case "labels":
+			schema.labels, mapped = strings.Split(value, ","), true
+		default:
+			return mapURL{}, fmt.Errorf("unknown argument '%s'", key)
+		}
+	}
+	if mapped {
+		source.schema = &schema
+	}
+	return source, nil
+}
+
+// jsonField returns the value at path, object keys separated by dots, in a decoded JSON document.
+func jsonField(v any, path string) (any, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		object, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// jsonString formats a scalar JSON value, such as a numeric site ID, as a string.
+func jsonString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, v != ""
+	case float64, bool:
+		return fmt.Sprint(v), true
+	default:
+		return "", false
+	}
+}
+
+// parse maps a JSON document to prefixes. Items without a prefix or zone are skipped, an invalid prefix fails the
+// whole document.
+func (s *mapSchema) parse(data []byte) ([]Prefix, error) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	list, ok := jsonField(doc, s.items)
+	items, isList := list.([]any)
+	if !ok || !isList {
+		return nil, fmt.Errorf("no list of items at '%s'", s.items)
+	}
+
+	var prefixes []Prefix
+	for i, item := range items {
+		value, _ := jsonField(item, s.prefix)
+		cidr, okPrefix := jsonString(value)
+		value, _ = jsonField(item, s.zone)
+		zone, okZone := jsonString(value)
+		if !okPrefix || !okZone {
+			log.Debugf("Skipping item %d without %s or %s", i, s.prefix, s.zone)
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix of item %d: %w", i, err)
+		}
+
+		var labels map[string]string
+		for _, field := range s.labels {
+			value, _ := jsonField(item, field)
+			if label, ok := jsonString(value); ok {
+				if labels == nil {
+					labels = make(map[string]string)
+				}
+				labels[field] = label
+			}
+		}
+		prefixes = append(prefixes, Prefix{Prefix: prefix, Zone: zone, Metadata: labels})
+	}
+	return prefixes, nil
+}
+
+// loader returns a mapLoader fetching the URL with conditional requests, so an unchanged map is not transferred
+// again.
+func (m mapURL) loader() mapLoader {
+	var etag, lastModified string
+	return func(ctx context.Context) ([]Prefix, bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.url, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		req.Header.Set("Accept", "application/json, application/yaml")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+		if m.tokenFile != "" {
+			token, err := readTokenFile(m.tokenFile)
+			if err != nil {
+				return nil, false, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, false, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotModified {
+			return nil, false, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, false, fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read response: %w", err)
+		}
+
+		var prefixes []Prefix
+		if m.schema != nil {
+			prefixes, err = m.schema.parse(data)
+		} else {
+			prefixes, err = parseZoneMap(data)
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid map from %s: %w", m.url, err)
+		}
+		// Validators are only kept for a map that parsed, so a broken map is fetched again.
+		etag, lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		log.Infof("Loaded %d CIDR(s) from %s", len(prefixes), m.url)
+		return prefixes, true, nil
+	}
+}
+
+// readTokenFile reads a token from a file, e.g. a mounted Kubernetes secret. It is read before every request so a
+// rotated token is picked up.
+func readTokenFile(path string) (string, error) {
+	token, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// mapURLProvider polls a zone map from a URL. It does not locate the node.
+type mapURLProvider struct {
+	url mapURL
+}
+
+func (p *mapURLProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *mapURLProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *mapURLProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	startMapSource(ctx, p.source(), p.url.interval, p.url.loader(), update)
+	return nil
+}
+
+// source names the provider by its URL, so that several URLs can be configured.
+func (p *mapURLProvider) source() string {
+	return "url:" + p.url.url
+}
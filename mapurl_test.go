@@ -0,0 +1,107 @@
+package zoneawareness
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseMapURL(t *testing.T) {
+	u, err := parseMapURL([]string{"https://ipam.example.com/zones.json", "interval=30s", "token_file=/var/run/secrets/ipam", "items=data.prefixes", "zone=site.slug", "labels=vrf,role"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if u.interval != 30*time.Second || u.tokenFile != "/var/run/secrets/ipam" {
+		t.Errorf("Unexpected options: %+v", u)
+	}
+	if u.schema == nil || u.schema.items != "data.prefixes" || u.schema.prefix != "prefix" || u.schema.zone != "site.slug" || !slices.Equal(u.schema.labels, []string{"vrf", "role"}) {
+		t.Errorf("Unexpected schema: %+v", u.schema)
+	}
+
+	if u, err := parseMapURL([]string{"http://ipam/zones.yaml"}); err != nil || u.schema != nil || u.interval != defaultMapURLInterval {
+		t.Errorf("Expected a zone map URL with defaults, got %+v, %v", u, err)
+	}
+	for _, args := range [][]string{{}, {"ipam/zones.json"}, {"https://ipam/zones.json", "interval=0s"}, {"https://ipam/zones.json", "format=csv"}, {"https://ipam/zones.json", "zone="}} {
+		if _, err := parseMapURL(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestMapSchema(t *testing.T) {
+	schema := &mapSchema{items: "data.prefixes", prefix: "prefix", zone: "site.slug", labels: []string{"vrf"}}
+	prefixes, err := schema.parse([]byte(`{"data": {"prefixes": [
+  {"prefix": "10.1.0.0/16", "site": {"slug": "fra1"}, "vrf": "prod"},
+  {"prefix": "10.2.0.0/16", "site": {"slug": "ams1"}},
+  {"prefix": "10.3.0.0/16", "site": null}
+]}}`))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(prefixes) != 2 || prefixes[0].Zone != "fra1" || prefixes[0].Metadata["vrf"] != "prod" || prefixes[1].Prefix.String() != "10.2.0.0/16" || prefixes[1].Zone != "ams1" {
+		t.Errorf("Unexpected prefixes: %v", prefixes)
+	}
+
+	// The document can be the list itself and zones can be numbers.
+	prefixes, err = (&mapSchema{prefix: "cidr", zone: "site_id"}).parse([]byte(`[{"cidr": "10.1.0.0/16", "site_id": 7}]`))
+	if err != nil || len(prefixes) != 1 || prefixes[0].Zone != "7" {
+		t.Errorf("Unexpected prefixes: %v, %v", prefixes, err)
+	}
+
+	for _, data := range []string{`{"data": {}}`, `[{"prefix": "10.1.0.0", "zone": "fra1"}]`, `[`} {
+		if _, err := schema.parse([]byte(data)); err == nil {
+			t.Errorf("Expected an error for %s", data)
+		}
+	}
+}
+
+func TestMapURLLoader(t *testing.T) {
+	const lastModified = "Sun, 18 Oct 2026 10:00:00 GMT"
+	body := `{"zones": {"eu-central-1/euc1-az1": {"cidrs": ["10.1.0.0/16"]}}}`
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` && r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("test-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	load := mapURL{url: server.URL, tokenFile: tokenFile}.loader()
+
+	prefixes, changed, err := load(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !changed || len(prefixes) != 1 || prefixes[0].Zone != "eu-central-1/euc1-az1" {
+		t.Errorf("Unexpected first load: %v, %t", prefixes, changed)
+	}
+
+	if _, changed, err := load(context.Background()); err != nil || changed {
+		t.Errorf("Expected the unchanged map not to be loaded again, got %t, %v", changed, err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+
+	if _, _, err := (mapURL{url: server.URL}).loader()(context.Background()); err == nil {
+		t.Error("Expected an error without the token")
+	}
+}
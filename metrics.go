@@ -35,3 +35,20 @@ var reorderLatency = promauto.NewHistogramVec(
 	},
 	[]string{"server"},
 )
+
+// mapLoadErrors counts the failed loads of a map source, e.g. a map file that doesn't parse. The source keeps the
+// map loaded before.
+var mapLoadErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "map_load_errors_total",
+	Help:      "Number of failed loads of a zone map source.",
+}, []string{"source"})
+
+// mapLastSuccess is the time a map source was last loaded successfully.
+var mapLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "map_last_success_timestamp_seconds",
+	Help:      "Time of the last successful load of a zone map source.",
+}, []string{"source"})
@@ -0,0 +1,231 @@
+package zoneawareness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultNetBoxInterval = 5 * time.Minute
+	netboxPageSize        = 1000
+)
+
+// netboxOptions configures the netbox provider.
+type netboxOptions struct {
+	url       string // base URL of NetBox, e.g. https://netbox.example.com
+	tokenFile string
+	tags      []string // prefixes must have one of these tags, if any
+	roles     []string // prefixes must have one of these roles, if any
+	zone      string   // site, location, region or cf_NAME
+	interval  time.Duration
+}
+
+// parseNetBoxOptions parses the arguments of the netbox option: the URL of NetBox followed by token_file=PATH,
+// tag=TAG, role=ROLE, zone=site|location|region|cf_NAME and interval=INTERVAL. Tags and roles can be repeated.
+func parseNetBoxOptions(args []string) (*netboxOptions, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected the URL of NetBox")
+	}
+	u, err := url.Parse(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("'%s' is not an HTTP(S) URL", args[0])
+	}
+
+	opts := &netboxOptions{url: strings.TrimSuffix(args[0], "/"), zone: "site", interval: defaultNetBoxInterval}
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("expected KEY=VALUE, got '%s'", arg)
+		}
+		switch key {
+		case "token_file":
+			opts.tokenFile = value
+		case "tag":
+			opts.tags = append(opts.tags, value)
+		case "role":
+			opts.roles = append(opts.roles, value)
+		case "zone":
+			if value != "site" && value != "location" && value != "region" && !strings.HasPrefix(value, "cf_") {
+				return nil, fmt.Errorf("zone must be site, location, region or cf_NAME, got '%s'", value)
+			}
+			opts.zone = value
+		case "interval":
+			interval, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			if interval <= 0 {
+				return nil, fmt.Errorf("refresh interval must be positive, got %s", interval)
+			}
+			opts.interval = interval
+		default:
+			return nil, fmt.Errorf("unknown argument '%s'", key)
+		}
+	}
+	return opts, nil
+}
+
+// netboxObject is a nested object of the NetBox API, such as the site of a prefix.
+type netboxObject struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+// netboxPrefix is the subset of a NetBox prefix used by this plugin. NetBox 4.2 replaced the site of a prefix by a
+// scope, which is a region, site group, site or location.
+type netboxPrefix struct {
+	ID           int                        `json:"id"`
+	Prefix       string                     `json:"prefix"`
+	Site         *netboxObject              `json:"site"`
+	ScopeType    string                     `json:"scope_type"`
+	Scope        *netboxObject              `json:"scope"`
+	Role         *netboxObject              `json:"role"`
+	CustomFields map[string]json.RawMessage `json:"custom_fields"`
+}
+
+// zone returns the zone of the prefix by the configured field, or an empty string if the prefix has none.
+func (p netboxPrefix) zone(field string) string {
+	if name, ok := strings.CutPrefix(field, "cf_"); ok {
+		var value any
+		if err := json.Unmarshal(p.CustomFields[name], &value); err != nil {
+			return ""
+		}
+		if object, ok := value.(map[string]any); ok {
+			// Object custom fields, e.g. one referencing a site
+			value = object["slug"]
+		}
+		zone, _ := jsonString(value)
+		return zone
+	}
+
+	if field == "site" && p.Site != nil {
+		return p.Site.Slug
+	}
+	if p.Scope != nil && p.ScopeType == "dcim."+field {
+		return p.Scope.Slug
+	}
+	return ""
+}
+
+// prefixesURL returns the URL of the first page of prefixes, filtered by tag and role.
+func (o *netboxOptions) prefixesURL() string {
+	query := url.Values{"limit": {fmt.Sprint(netboxPageSize)}}
+	for _, tag := range o.tags {
+		query.Add("tag", tag)
+	}
+	for _, role := range o.roles {
+		query.Add("role", role)
+	}
+	return o.url + "/api/ipam/prefixes/?" + query.Encode()
+}
+
+// getNetBoxPrefixes lists the prefixes in NetBox, following the pages of the list, and maps each to the zone of its
+// site, location, region or custom field. Prefixes without a zone are skipped. The token is only sent to the scheme
+// and host of the configured URL, so a page on another server fails the list.
+func getNetBoxPrefixes(ctx context.Context, opts *netboxOptions) ([]Prefix, error) {
+	base, err := url.Parse(opts.url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NetBox URL: %w", err)
+	}
+	token := ""
+	if opts.tokenFile != "" {
+		var err error
+		if token, err = readTokenFile(opts.tokenFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var prefixes []Prefix
+	for next := opts.prefixesURL(); next != ""; {
+		u, err := url.Parse(next)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NetBox page URL '%s': %w", next, err)
+		}
+		if u.Scheme != base.Scheme || u.Host != base.Host {
+			return nil, fmt.Errorf("NetBox page '%s' is not on %s://%s", next, base.Scheme, base.Host)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create NetBox request: %w", err)
+		}
+		req.Header.Set("Accept", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Token "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list NetBox prefixes: %w", err)
+		}
+		var page struct {
+			Next    string         `json:"next"`
+			Results []netboxPrefix `json:"results"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status listing NetBox prefixes: %s", resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode NetBox prefixes: %w", err)
+		}
+
+		for _, p := range page.Results {
+			zone := p.zone(opts.zone)
+			if zone == "" {
+				log.Debugf("Skipping NetBox prefix %s without %s", p.Prefix, opts.zone)
+				continue
+			}
+			prefix, err := netip.ParsePrefix(p.Prefix)
+			if err != nil {
+				log.Warningf("Invalid NetBox prefix %d '%s': %v", p.ID, p.Prefix, err)
+				continue
+			}
+			metadata := map[string]string{MetadataName: fmt.Sprintf("NetBox prefix %d", p.ID)}
+			if p.Role != nil {
+				metadata["role"] = p.Role.Slug
+			}
+			prefixes = append(prefixes, Prefix{Prefix: prefix, Zone: zone, Metadata: metadata})
+		}
+		next = page.Next
+	}
+	return prefixes, nil
+}
+
+// netboxProvider maps the prefixes in NetBox to zones and refreshes them periodically. It does not locate the node.
+type netboxProvider struct {
+	opts *netboxOptions
+
+	getPrefixes func(ctx context.Context, opts *netboxOptions) ([]Prefix, error)
+}
+
+func (p *netboxProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *netboxProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *netboxProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	load := func(ctx context.Context) ([]Prefix, bool, error) {
+		prefixes, err := p.getPrefixes(ctx, p.opts)
+		if err != nil {
+			return nil, false, err
+		}
+		log.Infof("Loaded %d prefix(es) from NetBox", len(prefixes))
+		return prefixes, true, nil
+	}
+	startMapSource(ctx, "netbox", p.opts.interval, load, update)
+	return nil
+}
@@ -0,0 +1,152 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestGetNetBoxPrefixes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token test-token" {
+			http.Error(w, "unauthenticated", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/api/ipam/prefixes/" || !slices.Equal(r.URL.Query()["tag"], []string{"zoneawareness"}) || r.URL.Query().Get("role") != "servers" {
+			http.NotFound(w, r)
+			return
+		}
+		body := `{"count": 4, "next": "http://` + r.Host + `/api/ipam/prefixes/?limit=1000&offset=1000&role=servers&tag=zoneawareness", "results": [
+  {"id": 1, "prefix": "10.1.0.0/16", "site": {"slug": "fra1", "name": "FRA1"}, "role": {"slug": "servers"}},
+  {"id": 2, "prefix": "10.2.0.0/16", "scope_type": "dcim.site", "scope": {"slug": "ams1", "name": "AMS1"}, "custom_fields": {"zone": "ams1-hall2"}},
+  {"id": 3, "prefix": "10.3.0.0/16", "scope_type": "dcim.location", "scope": {"slug": "ams1-hall3"}}
+]}`
+		if r.URL.Query().Get("offset") == "1000" {
+			body = `{"count": 4, "next": null, "results": [
+  {"id": 4, "prefix": "2001:db8:4::/48", "scope_type": "dcim.site", "scope": {"slug": "fra1"}, "custom_fields": {"zone": {"id": 9, "slug": "fra1-hall1"}}}
+]}`
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("test-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		zone     string
+		expected map[string]string
+	}{
+		{"site", map[string]string{"10.1.0.0/16": "fra1", "10.2.0.0/16": "ams1", "2001:db8:4::/48": "fra1"}},
+		{"location", map[string]string{"10.3.0.0/16": "ams1-hall3"}},
+		{"cf_zone", map[string]string{"10.2.0.0/16": "ams1-hall2", "2001:db8:4::/48": "fra1-hall1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.zone, func(t *testing.T) {
+			opts := &netboxOptions{url: server.URL, tokenFile: tokenFile, tags: []string{"zoneawareness"}, roles: []string{"servers"}, zone: tt.zone}
+			prefixes, err := getNetBoxPrefixes(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			got := make(map[string]string)
+			for _, p := range prefixes {
+				got[p.Prefix.String()] = p.Zone
+			}
+			if len(got) != len(tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+			for prefix, zone := range tt.expected {
+				if got[prefix] != zone {
+					t.Errorf("Expected %s in zone '%s', got '%s'", prefix, zone, got[prefix])
+				}
+			}
+		})
+	}
+
+	if _, err := getNetBoxPrefixes(context.Background(), &netboxOptions{url: server.URL, zone: "site"}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected an error without the token, got %v", err)
+	}
+
+	// A next page on another server is not sent the token
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected no request to another server, got %s with Authorization '%s'", r.URL, r.Header.Get("Authorization"))
+	}))
+	t.Cleanup(other.Close)
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"count": 2, "next": "` + other.URL + `/api/ipam/prefixes/?offset=1", "results": []}`))
+	}))
+	t.Cleanup(redirecting.Close)
+	if _, err := getNetBoxPrefixes(context.Background(), &netboxOptions{url: redirecting.URL, tokenFile: tokenFile, zone: "site"}); err == nil || !strings.Contains(err.Error(), "is not on") {
+		t.Errorf("Expected an error for a page on another server, got %v", err)
+	}
+}
+
+func TestParseNetBoxOptions(t *testing.T) {
+	opts, err := parseNetBoxOptions([]string{"https://netbox.example.com/", "token_file=/run/secrets/netbox", "tag=dns", "tag=zoneawareness", "role=servers", "zone=cf_zone", "interval=1m"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if opts.url != "https://netbox.example.com" || opts.tokenFile != "/run/secrets/netbox" || opts.zone != "cf_zone" || opts.interval != time.Minute {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+	if !slices.Equal(opts.tags, []string{"dns", "zoneawareness"}) || !slices.Equal(opts.roles, []string{"servers"}) {
+		t.Errorf("Unexpected filters: %+v", opts)
+	}
+	for _, args := range [][]string{{}, {"netbox.example.com"}, {"https://netbox", "zone=tenant"}, {"https://netbox", "interval=0s"}, {"https://netbox", "vrf=prod"}} {
+		if _, err := parseNetBoxOptions(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestSetupNetBox(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "netbox", func(p *netboxProvider) {
+		p.getPrefixes = func(ctx context.Context, opts *netboxOptions) ([]Prefix, error) {
+			return []Prefix{
+				{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Zone: "fra1"},
+				{Prefix: netip.MustParsePrefix("10.2.0.0/16"), Zone: "ams1"},
+			}, nil
+		}
+	})
+
+	opts, err := parse(caddy.NewTestController("dns", "zoneawareness {\n\ttopology eu/fra1\n\tnetbox https://netbox.example.com\n}"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if names := opts.providerNames(); !slices.Equal(names, []string{"aws", "ecs", "netbox", "env"}) {
+		t.Errorf("Expected the netbox provider after the default providers, got %v", names)
+	}
+
+	za := &Zoneawareness{Zones: make(map[string]*Zone), topology: opts.topology}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if _, err := opts.providers[2].provider.Locate(context.Background()); !errors.Is(err, errNotLocating) {
+		t.Errorf("Expected NetBox not to locate the node, got %v", err)
+	}
+	netbox := opts.providers[2].provider.(Watcher)
+	if err := netbox.Watch(ctx, Location{}, func(prefixes []Prefix) { za.setProviderPrefixes("netbox", prefixes) }); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	za.mu.RLock()
+	defer za.mu.RUnlock()
+	for ip, expected := range map[string]int{"10.1.2.3": 2, "10.2.2.3": 0} {
+		if rank := za.rankIP(net.ParseIP(ip), za.localPath()); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+}
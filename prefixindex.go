@@ -0,0 +1,64 @@
+package zoneawareness
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// prefixIndex maps a large number of prefixes to topology paths with a longest prefix match that costs one map lookup
+// per distinct prefix length instead of a scan over all prefixes.
+type prefixIndex struct {
+	// lengths holds the distinct prefix lengths in the index, longest first, for IPv4 and IPv6.
+	lengths  [2][]int
+	prefixes map[netip.Prefix][]string
+}
+
+func newPrefixIndex() *prefixIndex {
+	return &prefixIndex{prefixes: make(map[netip.Prefix][]string)}
+}
+
+// family returns the index into lengths for addr.
+func family(addr netip.Addr) int {
+	if addr.Is4() {
+		return 0
+	}
+	return 1
+}
+
+// add maps prefix to path. A prefix that is already in the index keeps its first path.
+func (x *prefixIndex) add(prefix netip.Prefix, path []string) {
+	prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+	if !prefix.IsValid() {
+		return
+	}
+	if _, ok := x.prefixes[prefix]; ok {
+		return
+	}
+	x.prefixes[prefix] = path
+
+	f := family(prefix.Addr())
+	if !slices.Contains(x.lengths[f], prefix.Bits()) {
+		x.lengths[f] = append(x.lengths[f], prefix.Bits())
+		slices.SortFunc(x.lengths[f], func(a, b int) int { return b - a })
+	}
+}
+
+// lookup returns the length and path of the longest prefix containing addr.
+func (x *prefixIndex) lookup(addr netip.Addr) (int, []string, bool) {
+	addr = addr.Unmap()
+	for _, bits := range x.lengths[family(addr)] {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if path, ok := x.prefixes[prefix]; ok {
+			return bits, path, true
+		}
+	}
+	return 0, nil, false
+}
+
+// len returns the number of prefixes in the index.
+func (x *prefixIndex) len() int {
+	return len(x.prefixes)
+}
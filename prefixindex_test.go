@@ -0,0 +1,38 @@
+package zoneawareness
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestPrefixIndex(t *testing.T) {
+	x := newPrefixIndex()
+	x.add(netip.MustParsePrefix("52.216.0.0/15"), []string{"us-east-1"})
+	x.add(netip.MustParsePrefix("52.216.4.0/24"), []string{"us-east-1", "us-east-1-bos-1"})
+	x.add(netip.MustParsePrefix("52.216.4.7/15"), []string{"eu-west-1"}) // Same prefix once masked, first path wins
+	x.add(netip.MustParsePrefix("2600:1f18::/36"), []string{"us-east-1"})
+
+	if x.len() != 3 {
+		t.Errorf("Expected 3 prefixes, got %d", x.len())
+	}
+
+	tests := []struct {
+		addr     string
+		bits     int
+		expected []string
+	}{
+		{"52.216.10.1", 15, []string{"us-east-1"}},
+		{"52.216.4.9", 24, []string{"us-east-1", "us-east-1-bos-1"}},
+		{"::ffff:52.216.4.9", 24, []string{"us-east-1", "us-east-1-bos-1"}},
+		{"2600:1f18:234::1", 36, []string{"us-east-1"}},
+		{"192.0.2.1", 0, nil},
+		{"2001:db8::1", 0, nil},
+	}
+	for _, tc := range tests {
+		bits, path, ok := x.lookup(netip.MustParseAddr(tc.addr))
+		if ok != (tc.expected != nil) || bits != tc.bits || !slices.Equal(path, tc.expected) {
+			t.Errorf("lookup(%s) = %d, %v, %v; expected %d, %v", tc.addr, bits, path, ok, tc.bits, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package zoneawareness
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// defaultPrefixListInterval is how often managed prefix lists are checked for a new version.
+const defaultPrefixListInterval = 5 * time.Minute
+
+// prefixList is a managed prefix list whose entries belong to one zone, as set by the prefix_list option.
+type prefixList struct {
+	id       string
+	zone     string // zone ID or topology path
+	interval time.Duration
+}
+
+// parsePrefixList parses the arguments of the prefix_list option: the prefix list ID, the zone and an optional
+// refresh interval.
+func parsePrefixList(args []string) (prefixList, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return prefixList{}, fmt.Errorf("expected a prefix list ID, a zone and an optional refresh interval")
+	}
+	list := prefixList{id: args[0], zone: args[1], interval: defaultPrefixListInterval}
+	if !strings.HasPrefix(list.id, "pl-") {
+		return prefixList{}, fmt.Errorf("'%s' is not a prefix list ID", list.id)
+	}
+	if strings.Contains(list.zone, "/") {
+		if _, err := parseTopologyPath(list.zone); err != nil {
+			return prefixList{}, err
+		}
+	}
+	if len(args) == 3 {
+		interval, err := time.ParseDuration(args[2])
+		if err != nil {
+			return prefixList{}, err
+		}
+		if interval <= 0 {
+			return prefixList{}, fmt.Errorf("refresh interval must be positive, got %s", interval)
+		}
+		list.interval = interval
+	}
+	return list, nil
+}
+
+// getManagedPrefixList returns the current version of a managed prefix list and, if it differs from since, the
+// CIDRs of that version. Entries are only fetched when the version changed.
+func getManagedPrefixList(ctx context.Context, region string, id string, since int64) (int64, []*net.IPNet, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to load AWS SDK config: %w", err)
+	}
+
+	ec2Client := ec2.NewFromConfig(cfg)
+
+	described, err := ec2Client.DescribeManagedPrefixLists(ctx, &ec2.DescribeManagedPrefixListsInput{PrefixListIds: []string{id}})
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to describe prefix list %s: %w", id, err)
+	}
+	if len(described.PrefixLists) == 0 {
+		return 0, nil, fmt.Errorf("prefix list %s not found in region '%s'", id, region)
+	}
+	version := aws.ToInt64(described.PrefixLists[0].Version)
+	if version == since {
+		return version, nil, nil
+	}
+
+	var cidrs []*net.IPNet
+	paginator := ec2.NewGetManagedPrefixListEntriesPaginator(ec2Client, &ec2.GetManagedPrefixListEntriesInput{
+		PrefixListId:  aws.String(id),
+		TargetVersion: aws.Int64(version),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to get entries of prefix list %s: %w", id, err)
+		}
+		for _, entry := range page.Entries {
+			_, cidr, err := net.ParseCIDR(aws.ToString(entry.Cidr))
+			if err != nil {
+				log.Warningf("Invalid CIDR '%s' in prefix list %s: %v", aws.ToString(entry.Cidr), id, err)
+				continue
+			}
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return version, cidrs, nil
+}
+
+// prefixListProvider maps the entries of a managed prefix list to its zone, checking the list for a new version
+// periodically. It does not locate the node.
+type prefixListProvider struct {
+	list prefixList
+
+	getList func(ctx context.Context, region string, id string, since int64) (int64, []*net.IPNet, error)
+}
+
+func (p *prefixListProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *prefixListProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *prefixListProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	region := loc.awsRegion()
+	if region == "" {
+		return nil
+	}
+	version := int64(0)
+	load := func(ctx context.Context) ([]Prefix, bool, error) {
+		v, cidrs, err := p.getList(ctx, region, p.list.id, version)
+		if err != nil {
+			return nil, false, err
+		}
+		if v == version {
+			return nil, false, nil
+		}
+		version = v
+		prefixes := make([]Prefix, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			prefixes = append(prefixes, Prefix{Prefix: ipNetPrefix(cidr), Zone: p.list.zone, Metadata: map[string]string{MetadataName: "prefix list " + p.list.id}})
+		}
+		log.Infof("Mapped %d CIDR(s) of prefix list %s version %d to zone '%s'", len(cidrs), p.list.id, v, p.list.zone)
+		return prefixes, true, nil
+	}
+	startMapSource(ctx, p.source(), p.list.interval, load, update)
+	return nil
+}
+
+// source names the provider of each list by its ID, as the option can be repeated.
+func (p *prefixListProvider) source() string {
+	return "prefix_list/" + p.list.id
+}
@@ -0,0 +1,140 @@
+package zoneawareness
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetManagedPrefixList(t *testing.T) {
+	requests := newFakeAWSAPI(t, "EC2", map[string]string{
+		"DescribeManagedPrefixLists": `<DescribeManagedPrefixListsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>1</requestId>
+  <prefixListSet>
+    <item><prefixListId>pl-1</prefixListId><prefixListName>onprem-dc1</prefixListName><version>3</version></item>
+  </prefixListSet>
+</DescribeManagedPrefixListsResponse>`,
+		"GetManagedPrefixListEntries": `<GetManagedPrefixListEntriesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>2</requestId>
+  <entrySet>
+    <item><cidr>172.16.0.0/16</cidr><description>dc1</description></item>
+    <item><cidr>2001:db8:1::/48</cidr></item>
+    <item><cidr>bogus</cidr></item>
+  </entrySet>
+</GetManagedPrefixListEntriesResponse>`,
+	})
+
+	version, cidrs, err := getManagedPrefixList(context.Background(), "us-east-1", "pl-1", 0)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if version != 3 {
+		t.Errorf("Expected version 3, got %d", version)
+	}
+	var got []string
+	for _, cidr := range cidrs {
+		got = append(got, cidr.String())
+	}
+	if !slices.Equal(got, []string{"172.16.0.0/16", "2001:db8:1::/48"}) {
+		t.Errorf("Unexpected CIDRs: %v", got)
+	}
+
+	sent := requests()
+	if len(sent) != 2 || sent[1].Get("PrefixListId") != "pl-1" || sent[1].Get("TargetVersion") != "3" {
+		t.Errorf("Expected the entries of version 3 to be requested, got %v", sent)
+	}
+
+	// An unchanged version does not fetch the entries again.
+	version, cidrs, err = getManagedPrefixList(context.Background(), "us-east-1", "pl-1", 3)
+	if err != nil || version != 3 || cidrs != nil {
+		t.Errorf("Expected version 3 without entries, got %d, %v, %v", version, cidrs, err)
+	}
+	if sent := requests(); len(sent) != 3 || sent[2].Get("Action") != "DescribeManagedPrefixLists" {
+		t.Errorf("Expected only the prefix list to be described, got %v", sent)
+	}
+}
+
+func TestParsePrefixList(t *testing.T) {
+	list, err := parsePrefixList([]string{"pl-1", "us-east-1/onprem", "30s"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if list.id != "pl-1" || list.zone != "us-east-1/onprem" || list.interval != 30*time.Second {
+		t.Errorf("Unexpected prefix list: %+v", list)
+	}
+	for _, args := range [][]string{{"pl-1", "dc1//rack1"}, {"pl-1", "use1-az1", "-1s"}, {"pl-1", "use1-az1", "1m", "extra"}} {
+		if _, err := parsePrefixList(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestStartPrefixLists(t *testing.T) {
+	var mu sync.Mutex
+	version := int64(1)
+	entries := map[int64][]string{1: {"172.16.0.0/16"}, 2: {"172.17.0.0/16"}}
+	getList := func(ctx context.Context, region string, id string, since int64) (int64, []*net.IPNet, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if version == since {
+			return version, nil, nil
+		}
+		var cidrs []*net.IPNet
+		for _, s := range entries[version] {
+			_, cidr, _ := net.ParseCIDR(s)
+			cidrs = append(cidrs, cidr)
+		}
+		return version, cidrs, nil
+	}
+
+	za := &Zoneawareness{Zones: make(map[string]*Zone), currentAvailabilityZoneId: "use1-az1", topology: []string{"us-east-1", "use1-az1"}}
+	za.setProviderPrefixes("ec2", []Prefix{{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Zone: "use1-az1"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	provider := &prefixListProvider{list: prefixList{id: "pl-1", zone: "us-east-1/onprem", interval: 10 * time.Millisecond}, getList: getList}
+	loc := Location{Cloud: CloudAWS, Region: "us-east-1"}
+	if err := provider.Watch(ctx, loc, func(prefixes []Prefix) { za.setProviderPrefixes(provider.source(), prefixes) }); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	rank := func(ip string) int {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.rankIP(net.ParseIP(ip), za.localPath())
+	}
+	for ip, expected := range map[string]int{"10.0.1.5": 2, "172.16.0.1": 1, "172.17.0.1": 0} {
+		if got := rank(ip); got != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, got)
+		}
+	}
+
+	mu.Lock()
+	version = 2
+	mu.Unlock()
+	waitFor(t, "the new prefix list version", func() bool { return rank("172.17.0.1") == 1 && rank("172.16.0.1") == 0 })
+	if got := rank("10.0.1.5"); got != 2 {
+		t.Errorf("Expected the subnet to keep rank 2, got %d", got)
+	}
+}
+
+func TestPrefixListNeedsRegion(t *testing.T) {
+	provider := &prefixListProvider{
+		list: prefixList{id: "pl-1", zone: "onprem", interval: time.Millisecond},
+		getList: func(ctx context.Context, region string, id string, since int64) (int64, []*net.IPNet, error) {
+			t.Errorf("Expected no prefix list to be described without a region, got region '%s'", region)
+			return 0, nil, nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	loc := Location{Zone: "us-central1-a", Region: "us-central1", Cloud: CloudGCP}
+	if err := provider.Watch(ctx, loc, func(prefixes []Prefix) { t.Errorf("Expected no update, got %v", prefixes) }); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+}
@@ -0,0 +1,621 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Clouds a Location can be in. Discovery through the AWS APIs only runs for locations in AWS.
+const (
+	CloudAWS   = "aws"
+	CloudGCP   = "gcp"
+	CloudAzure = "azure"
+)
+
+// Location is where the node CoreDNS runs on is placed, as found by a Provider.
+type Location struct {
+	// Zone is the zone of the node, e.g. an AWS Zone ID.
+	Zone string
+	// Region is the region of the zone, if known.
+	Region string
+	// Cloud is the cloud the node runs in, e.g. CloudAWS, or empty if unknown.
+	Cloud string
+	// Path is the topology path of the node from the outermost level inwards, used unless a topology is
+	// configured. When empty the path is derived from Zone.
+	Path []string
+}
+
+// awsRegion returns the region of loc if the node runs in AWS. The AWS APIs are only asked about nodes in AWS whose
+// region is known.
+func (loc Location) awsRegion() string {
+	if loc.Cloud != CloudAWS {
+		return ""
+	}
+	return loc.Region
+}
+
+// Prefix is a CIDR or single address and the zone it belongs to.
+type Prefix struct {
+	Prefix netip.Prefix
+	// Zone is the name of the zone, e.g. an AWS Zone ID, or its topology path written with "/".
+	Zone string
+	// Metadata describes where the prefix comes from. The keys MetadataName, MetadataParent, MetadataRegion and
+	// MetadataLocal are understood by the plugin, others are informational.
+	Metadata map[string]string
+}
+
+// Metadata keys of a Prefix.
+const (
+	// MetadataName names the resource the prefix belongs to in log messages, e.g. "subnet subnet-0123".
+	MetadataName = "name"
+	// MetadataParent is the zone containing the zone of the prefix, e.g. the parent Availability Zone of a Local
+	// Zone. The zone is placed below its parent in the topology.
+	MetadataParent = "parent"
+	// MetadataRegion is the region of the zone of the prefix. A zone that is not part of the local topology is
+	// placed below its region.
+	MetadataRegion = "region"
+	// MetadataLocal marks a prefix of the network the node itself is in. Unless a topology is configured, its zone
+	// is the innermost level of the local path, e.g. the Outpost of an instance running on one.
+	MetadataLocal = "local"
+)
+
+// Provider discovers the location of the node CoreDNS runs on and the prefixes of the zones around it.
+type Provider interface {
+	// Locate returns the location of the node, or an error if the provider can't tell where it runs.
+	Locate(ctx context.Context) (Location, error)
+	// Prefixes returns the prefixes the provider knows of with their zones. loc is the location found by the
+	// first provider that could locate the node, which need not be this one.
+	Prefixes(ctx context.Context, loc Location) ([]Prefix, error)
+}
+
+// Watcher is implemented by providers whose prefixes change at runtime. Watch starts watching and returns; until
+// ctx is done it calls update with the complete set of prefixes whenever they change, replacing those passed before.
+type Watcher interface {
+	Watch(ctx context.Context, loc Location, update func([]Prefix)) error
+}
+
+// regionalProvider is implemented by providers that may place prefixes below their region. Unless a topology is
+// configured, the region of the node is then the outermost level of the local path.
+type regionalProvider interface {
+	regional() bool
+}
+
+// errNotLocating is returned by providers that only discover prefixes and don't know where the node runs.
+var errNotLocating = errors.New("does not know where the node runs")
+
+// ProviderFactory creates a provider from the arguments of its provider directive in the Corefile.
+type ProviderFactory func(args []string) (Provider, error)
+
+var (
+	providersMu       sync.RWMutex
+	providerFactories = make(map[string]ProviderFactory)
+)
+
+// RegisterProvider makes a provider available to the provider directive under name. It panics if name is already
+// registered, so it is meant to be called from init functions.
+func RegisterProvider(name string, factory ProviderFactory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if factory == nil {
+		panic("zoneawareness: RegisterProvider factory is nil")
+	}
+	if _, dup := providerFactories[name]; dup {
+		panic("zoneawareness: RegisterProvider called twice for provider " + name)
+	}
+	providerFactories[name] = factory
+}
+
+// Providers returns the names of the registered providers, sorted.
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := slices.Collect(maps.Keys(providerFactories))
+	sort.Strings(names)
+	return names
+}
+
+// newProvider creates the provider registered as name.
+func newProvider(name string, args []string) (Provider, error) {
+	providersMu.RLock()
+	factory, ok := providerFactories[name]
+	providersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown provider '%s', expected one of %v", name, Providers())
+	}
+	return factory(args)
+}
+
+// namedProvider is a provider and the name it was selected by.
+type namedProvider struct {
+	name     string
+	provider Provider
+}
+
+// newNamedProvider creates the provider registered as name. Providers that can be configured more than once, such
+// as prefix lists, are named by their source instead.
+func newNamedProvider(name string, args []string) (namedProvider, error) {
+	provider, err := newProvider(name, args)
+	if err != nil {
+		return namedProvider{}, err
+	}
+	if s, ok := provider.(interface{ source() string }); ok {
+		name = s.source()
+	}
+	return namedProvider{name: name, provider: provider}, nil
+}
+
+// defaultProvider creates the provider registered as name without arguments, for the providers used when the
+// Corefile lists none. These providers take no arguments, so this only fails if one is not registered.
+func defaultProvider(name string) namedProvider {
+	p, err := newNamedProvider(name, nil)
+	if err != nil {
+		panic("zoneawareness: default provider " + name + ": " + err.Error())
+	}
+	return p
+}
+
+func init() {
+	RegisterProvider("aws", func(args []string) (Provider, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("expected no arguments")
+		}
+		return &awsProvider{
+			getConfig:      getConfigFromIMDSv2,
+			getSubnetID:    getSubnetIDFromIMDSv2,
+			getSubnets:     getSubnetsFromEC2,
+			getParentZones: getParentZonesFromEC2,
+		}, nil
+	})
+	RegisterProvider("ecs", func(args []string) (Provider, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("expected no arguments")
+		}
+		return &ecsProvider{zoneID: getZoneIDFromEC2, getConfig: getConfigFromECS}, nil
+	})
+	RegisterProvider("kubernetes_node", func(args []string) (Provider, error) {
+		if len(args) > 1 {
+			return nil, fmt.Errorf("expected at most a label")
+		}
+		p := &kubernetesNodeProvider{newClient: newInClusterKubeClient, zoneID: getZoneIDFromEC2, getConfig: getConfigFromKubernetesNode}
+		if len(args) == 1 {
+			p.label = args[0]
+		}
+		return p, nil
+	})
+	RegisterProvider("gcp", func(args []string) (Provider, error) {
+		opts, err := parseGCPOptions(args)
+		if err != nil {
+			return nil, err
+		}
+		return &gcpProvider{opts: opts, getConfig: getConfigFromGCPMetadata, getAddresses: getGCPAddresses}, nil
+	})
+	RegisterProvider("azure", func(args []string) (Provider, error) {
+		opts, err := parseAzureOptions(args)
+		if err != nil {
+			return nil, err
+		}
+		return &azureProvider{opts: opts, getConfig: getConfigFromAzureIMDS, getAddresses: getAzureAddresses}, nil
+	})
+	RegisterProvider("netbox", func(args []string) (Provider, error) {
+		opts, err := parseNetBoxOptions(args)
+		if err != nil {
+			return nil, err
+		}
+		return &netboxProvider{opts: opts, getPrefixes: getNetBoxPrefixes}, nil
+	})
+	RegisterProvider("env", func(args []string) (Provider, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("expected no arguments")
+		}
+		return envProvider{}, nil
+	})
+
+	// The AWS sources discovering more prefixes once the node is located in AWS, enabled by their options.
+	RegisterProvider("regions", func(args []string) (Provider, error) {
+		return &regionsProvider{regions: args, getParentZones: getParentZonesFromEC2, getSubnets: getRegionSubnetsFromEC2}, nil
+	})
+	RegisterProvider("assume_role", func(args []string) (Provider, error) {
+		role, err := parseAssumeRole(args)
+		if err != nil {
+			return nil, err
+		}
+		return &assumeRoleProvider{role: role, getSubnets: getSubnetsFromRole}, nil
+	})
+	RegisterProvider("ipam_pools", func(args []string) (Provider, error) {
+		opts, err := parseIPAMOptions(args)
+		if err != nil {
+			return nil, err
+		}
+		return &ipamProvider{opts: opts, zoneID: getZoneIDFromEC2, getAllocations: getIPAMAllocations}, nil
+	})
+	RegisterProvider("network_interfaces", func(args []string) (Provider, error) {
+		opts, err := parseENIOptions(args)
+		if err != nil {
+			return nil, err
+		}
+		return &eniProvider{opts: opts, getInterfaces: getNetworkInterfacesFromEC2}, nil
+	})
+	RegisterProvider("load_balancers", func(args []string) (Provider, error) {
+		opts, err := parseZonalAddressOptions(args)
+		if err != nil {
+			return nil, err
+		}
+		return &loadBalancerProvider{opts: opts, zoneID: getZoneIDFromEC2, getAddresses: getLoadBalancerAddresses}, nil
+	})
+	RegisterProvider("vpc_endpoints", func(args []string) (Provider, error) {
+		opts, err := parseZonalAddressOptions(args)
+		if err != nil {
+			return nil, err
+		}
+		return &vpcEndpointProvider{opts: opts, getAddresses: getVPCEndpointAddresses}, nil
+	})
+	RegisterProvider("managed_services", func(args []string) (Provider, error) {
+		opts, err := parseManagedOptions(args)
+		if err != nil {
+			return nil, err
+		}
+		return &managedProvider{
+			opts:         opts,
+			zoneID:       getZoneIDFromEC2,
+			lookupNetIP:  net.DefaultResolver.LookupNetIP,
+			getVPCID:     getVPCIDFromIMDSv2,
+			getAddresses: getManagedServiceAddresses,
+		}, nil
+	})
+	RegisterProvider("aws_ip_ranges", func(args []string) (Provider, error) {
+		opts, err := parseAWSIPRangesOptions(args)
+		if err != nil {
+			return nil, err
+		}
+		return &awsIPRangesProvider{opts: opts}, nil
+	})
+	RegisterProvider("prefix_list", func(args []string) (Provider, error) {
+		list, err := parsePrefixList(args)
+		if err != nil {
+			return nil, err
+		}
+		return &prefixListProvider{list: list, getList: getManagedPrefixList}, nil
+	})
+
+	// The zone maps loaded from files, URLs, SSM parameters and S3 objects, enabled by their options.
+	for _, option := range []string{"file", "terraform_state"} {
+		RegisterProvider(option, func(args []string) (Provider, error) {
+			file, err := parseMapFile(args)
+			if err != nil {
+				return nil, err
+			}
+			file.option = option
+			return &mapFileProvider{file: file}, nil
+		})
+	}
+	RegisterProvider("url", func(args []string) (Provider, error) {
+		u, err := parseMapURL(args)
+		if err != nil {
+			return nil, err
+		}
+		return &mapURLProvider{url: u}, nil
+	})
+	for _, option := range []string{"ssm_parameter", "s3_object"} {
+		RegisterProvider(option, func(args []string) (Provider, error) {
+			m, err := parseAWSMap(option, args)
+			if err != nil {
+				return nil, err
+			}
+			return &awsMapProvider{m: m}, nil
+		})
+	}
+
+	// The Kubernetes sources watching the cluster, enabled by their options.
+	RegisterProvider("kubernetes_endpoints", func(args []string) (Provider, error) {
+		sources, err := parseKubernetesEndpoints(args)
+		if err != nil {
+			return nil, err
+		}
+		return &kubeEndpointProvider{sources: sources, newClient: newInClusterKubeClient, zoneID: getZoneIDFromEC2}, nil
+	})
+	RegisterProvider("kubernetes_pod_cidrs", func(args []string) (Provider, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("expected no arguments")
+		}
+		return &kubePodCIDRProvider{newClient: newInClusterKubeClient, zoneID: getZoneIDFromEC2}, nil
+	})
+}
+
+// locate returns the location found by the first of providers that can locate the node, and the name of that provider.
+func locate(ctx context.Context, providers []namedProvider) (Location, string) {
+	for _, p := range providers {
+		loc, err := p.provider.Locate(ctx)
+		if err == nil && loc.Zone == "" {
+			err = fmt.Errorf("no zone found")
+		}
+		if err != nil {
+			log.Infof("Could not locate with provider %s: %v. Will rely on other configuration methods.", p.name, err)
+			continue
+		}
+		log.Infof("Successfully located zone '%s' and region '%s' with provider %s.", loc.Zone, loc.Region, p.name)
+		return loc, p.name
+	}
+	return Location{}, ""
+}
+
+// addPrefixes adds prefixes from source at setup. The zones are rebuilt from them once discovery is done.
+func (e *Zoneawareness) addPrefixes(source string, prefixes []Prefix) {
+	hosts := 0
+	for _, p := range prefixes {
+		if p.Prefix.IsSingleIP() {
+			hosts++
+			continue
+		}
+		from := p.Metadata[MetadataName]
+		if from == "" {
+			from = source
+		}
+		log.Infof("%s added to zone '%s' from %s", p.Prefix.Masked(), p.Zone, from)
+	}
+	if hosts > 0 {
+		log.Infof("Mapped %d address(es) from %s to zones", hosts, source)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.sources == nil {
+		e.sources = make(map[string][]Prefix)
+	}
+	if !slices.Contains(e.order, source) {
+		e.order = append(e.order, source)
+	}
+	e.sources[source] = append(e.sources[source], prefixes...)
+}
+
+// setProviderPrefixes replaces the prefixes contributed by source at runtime. They are merged with the same
+// precedence and parent zones as the prefixes added at setup.
+func (e *Zoneawareness) setProviderPrefixes(source string, prefixes []Prefix) {
+	e.rebuildMu.Lock()
+	defer e.rebuildMu.Unlock()
+	e.mu.Lock()
+	if e.sources == nil {
+		e.sources = make(map[string][]Prefix)
+	}
+	e.sources[source] = prefixes
+	e.mu.Unlock()
+	e.rebuild()
+	log.Debugf("Mapped %d prefix(es) from %s to zones", len(prefixes), source)
+}
+
+// prefixIPNet converts a prefix to a net.IPNet, with a 4 byte IP for IPv4 as net.ParseCIDR returns.
+func prefixIPNet(prefix netip.Prefix) *net.IPNet {
+	addr := prefix.Addr().Unmap()
+	return &net.IPNet{IP: net.IP(addr.AsSlice()), Mask: net.CIDRMask(prefix.Bits(), addr.BitLen())}
+}
+
+// ipNetPrefix converts a net.IPNet to a prefix.
+func ipNetPrefix(cidr *net.IPNet) netip.Prefix {
+	addr, _ := netip.AddrFromSlice(cidr.IP)
+	ones, _ := cidr.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), ones)
+}
+
+// awsProvider locates the node through EC2 IMDSv2 and describes the subnets in its zone with the EC2 API.
+type awsProvider struct {
+	filter *subnetFilter
+
+	getConfig      func() (string, string, error)
+	getSubnetID    func() (string, error)
+	getSubnets     func(ctx context.Context, azID string, region string) ([]types.Subnet, error)
+	getParentZones func(ctx context.Context, region string) (map[string]string, error)
+}
+
+func (p *awsProvider) Locate(ctx context.Context) (Location, error) {
+	azID, region, err := p.getConfig()
+	if err != nil {
+		return Location{}, err
+	}
+	if azID == "" || region == "" {
+		return Location{}, fmt.Errorf("IMDSv2 returned no zone or region")
+	}
+	return Location{Zone: azID, Region: region, Cloud: CloudAWS}, nil
+}
+
+func (p *awsProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	region := loc.awsRegion()
+	if region == "" {
+		return nil, nil
+	}
+	subnets, err := p.getSubnets(ctx, loc.Zone, region)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := ec2SubnetPrefixes(loc.Zone, subnets, p.filter)
+
+	// An instance on an Outpost ranks its Outpost first and the zone it is anchored to second
+	markOutpost(prefixes, p.getSubnetID)
+
+	// Local Zones and Wavelength Zones rank their parent zone right behind themselves, so the subnets of the parent
+	// zones are described too
+	parents, err := p.getParentZones(ctx, region)
+	if err != nil {
+		log.Infof("Could not describe the zones of region '%s': %v. Local Zones will not be related to their parent zone.", region, err)
+	}
+	setParentZones(prefixes, parents)
+	chain := []string{loc.Zone}
+	for parent := parents[loc.Zone]; parent != "" && !slices.Contains(chain, parent); parent = parents[parent] {
+		chain = append(chain, parent)
+	}
+	for _, parent := range chain[1:] {
+		subnets, err := p.getSubnets(ctx, parent, region)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe subnets of parent zone '%s': %w", parent, err)
+		}
+		parentPrefixes := ec2SubnetPrefixes(parent, subnets, p.filter)
+		setParentZones(parentPrefixes, parents)
+		prefixes = append(prefixes, parentPrefixes...)
+	}
+	return prefixes, nil
+}
+
+// ecsProvider locates ECS tasks (e.g. on Fargate) through the task metadata endpoint, which also reports the
+// subnets of the task.
+type ecsProvider struct {
+	subnets []types.Subnet
+
+	zoneID    zoneIDFunc
+	getConfig func(zoneID zoneIDFunc) (string, string, []types.Subnet, error)
+}
+
+func (p *ecsProvider) Locate(ctx context.Context) (Location, error) {
+	azID, region, subnets, err := p.getConfig(p.zoneID)
+	if err != nil {
+		return Location{}, err
+	}
+	p.subnets = subnets
+	return Location{Zone: azID, Region: region, Cloud: CloudAWS}, nil
+}
+
+func (p *ecsProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return ec2SubnetPrefixes(loc.Zone, p.subnets, nil), nil
+}
+
+// kubernetesNodeProvider locates pods that can't reach IMDS through the labels of the node they run on.
+type kubernetesNodeProvider struct {
+	label string
+
+	newClient func() (*kubeClient, error)
+	zoneID    zoneIDFunc
+	getConfig func(label string, newClient func() (*kubeClient, error), zoneID zoneIDFunc) (Location, error)
+}
+
+func (p *kubernetesNodeProvider) Locate(ctx context.Context) (Location, error) {
+	return p.getConfig(p.label, p.newClient, p.zoneID)
+}
+
+func (p *kubernetesNodeProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+// gcpProvider locates GCE instances and GKE nodes through the metadata server and watches the addresses of the
+// instances in the project.
+type gcpProvider struct {
+	opts *gcpOptions
+
+	getConfig    func() (string, string, error)
+	getAddresses func(ctx context.Context, opts *gcpOptions) ([]zonalAddress, []zonalCIDR, error)
+}
+
+func (p *gcpProvider) Locate(ctx context.Context) (Location, error) {
+	zone, region, err := p.getConfig()
+	if err != nil {
+		return Location{}, err
+	}
+	// Subnets are regional on GCP, so the region is the outermost level of the local topology.
+	return Location{Zone: zone, Region: region, Cloud: CloudGCP, Path: []string{region, zone}}, nil
+}
+
+func (p *gcpProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *gcpProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	return startGCP(ctx, p.opts, p.getAddresses, update)
+}
+
+// azureProvider locates Azure VMs through IMDS and maps the private IPs of the VMs and VMSS instances in the
+// configured resource groups to their zones, refreshing them periodically.
+type azureProvider struct {
+	opts     *azureOptions
+	instance *azureInstance
+
+	getConfig    func() (*azureInstance, error)
+	getAddresses func(ctx context.Context, instance *azureInstance, opts *azureOptions) ([]zonalAddress, error)
+}
+
+func (p *azureProvider) Locate(ctx context.Context) (Location, error) {
+	instance, err := p.getConfig()
+	if err != nil {
+		return Location{}, err
+	}
+	p.instance = instance
+	path := strings.Split(azureZone(instance.Location, instance.Zone), "/")
+	return Location{Zone: path[len(path)-1], Region: instance.Location, Cloud: CloudAzure, Path: path}, nil
+}
+
+func (p *azureProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+func (p *azureProvider) Watch(ctx context.Context, loc Location, update func([]Prefix)) error {
+	if loc.Cloud != "" && loc.Cloud != CloudAzure {
+		return nil
+	}
+	// The VMs are listed with the subscription and resource group of the instance, which is read from IMDS when
+	// another provider located the node.
+	getInstance := p.getConfig
+	if p.instance != nil {
+		instance := p.instance
+		getInstance = func() (*azureInstance, error) { return instance, nil }
+	}
+	return startAzure(ctx, getInstance, p.opts, p.getAddresses, update)
+}
+
+// envProvider reads the zone from the AWS_ZONE_ID environment variable.
+type envProvider struct{}
+
+func (envProvider) Locate(ctx context.Context) (Location, error) {
+	azID := os.Getenv("AWS_ZONE_ID")
+	if !awsZoneIDPattern.MatchString(azID) {
+		return Location{}, fmt.Errorf("AWS_ZONE_ID is not set to a valid zone ID")
+	}
+	return Location{Zone: azID, Cloud: CloudAWS}, nil
+}
+
+func (envProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return nil, nil
+}
+
+// ec2SubnetPrefixes returns the CIDRs of EC2 subnets found in zoneName, in the zones the filter assigns them to.
+// Subnets on an Outpost that keep zoneName are placed in a zone named by the Outpost ID, below zoneName.
+func ec2SubnetPrefixes(zoneName string, subnets []types.Subnet, filter *subnetFilter) []Prefix {
+	var prefixes []Prefix
+	for zone, zoneSubnets := range filter.apply(zoneName, subnets) {
+		if zone != zoneName {
+			log.Infof("Mapping %d subnet(s) of zone '%s' to zone '%s' by tag", len(zoneSubnets), zoneName, zone)
+		}
+		for _, subnet := range zoneSubnets {
+			metadata := map[string]string{MetadataName: subnetLabel(subnet), "subnet-id": aws.ToString(subnet.SubnetId)}
+			subnetZone := zone
+			if outpost := outpostID(subnet); outpost != "" && zone == zoneName {
+				subnetZone = outpost
+				metadata["outpost"] = outpost
+				metadata[MetadataParent] = zoneName
+			}
+
+			cidrs := []string{aws.ToString(subnet.CidrBlock)}
+			for _, ipv6Assoc := range subnet.Ipv6CidrBlockAssociationSet {
+				cidrs = append(cidrs, aws.ToString(ipv6Assoc.Ipv6CidrBlock))
+			}
+			for _, cidr := range cidrs {
+				if cidr == "" {
+					continue
+				}
+				prefix, err := netip.ParsePrefix(cidr)
+				if err != nil {
+					log.Warningf("Invalid CIDR format for subnet %s (%s): %v", aws.ToString(subnet.SubnetId), cidr, err)
+					continue
+				}
+				prefixes = append(prefixes, Prefix{Prefix: prefix, Zone: subnetZone, Metadata: metadata})
+			}
+		}
+	}
+	return prefixes
+}
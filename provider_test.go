@@ -0,0 +1,181 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+// fakeProvider locates the node in zone, unless zone is empty, and reports fixed prefixes.
+type fakeProvider struct {
+	zone     string
+	prefixes []Prefix
+}
+
+// newFakeProvider creates a fake provider from the arguments ZONE|none [CIDR=ZONE...].
+func newFakeProvider(args []string) (Provider, error) {
+	if len(args) == 0 {
+		return nil, errors.New("expected a zone")
+	}
+	p := &fakeProvider{}
+	if args[0] != "none" {
+		p.zone = args[0]
+	}
+	for _, arg := range args[1:] {
+		cidr, zone, _ := strings.Cut(arg, "=")
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		p.prefixes = append(p.prefixes, Prefix{Prefix: prefix, Zone: zone})
+	}
+	return p, nil
+}
+
+func (p *fakeProvider) Locate(ctx context.Context) (Location, error) {
+	if p.zone == "" {
+		return Location{}, errors.New("not located")
+	}
+	return Location{Zone: p.zone}, nil
+}
+
+func (p *fakeProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	return p.prefixes, nil
+}
+
+func init() {
+	RegisterProvider("test_first", newFakeProvider)
+	RegisterProvider("test_second", newFakeProvider)
+}
+
+func TestRegisterProvider(t *testing.T) {
+	names := Providers()
+	for _, name := range []string{"aws", "ecs", "kubernetes_node", "gcp", "azure", "env", "test_first"} {
+		if !slices.Contains(names, name) {
+			t.Errorf("Expected provider %s to be registered, got %v", name, names)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a provider twice to panic")
+		}
+	}()
+	RegisterProvider("aws", newFakeProvider)
+}
+
+func TestResolveProviders(t *testing.T) {
+	tests := []struct {
+		corefile string
+		expected []string
+	}{
+		{"zoneawareness", []string{"aws", "ecs", "env"}},
+		{"zoneawareness {\n\tazure\n\tkubernetes_node\n}", []string{"aws", "ecs", "kubernetes_node", "azure", "env"}},
+		{"zoneawareness {\n\tprovider gcp\n\tprovider aws\n}", []string{"gcp", "aws"}},
+		{"zoneawareness {\n\tprovider env\n\tgcp\n}", []string{"env", "gcp"}},
+		// Providers of the options that can be repeated are named by their source, like the options
+		{"zoneawareness {\n\tprovider prefix_list pl-1 use1-az1\n\tprovider prefix_list pl-2 use1-az2\n}", []string{"prefix_list/pl-1", "prefix_list/pl-2"}},
+		{"zoneawareness {\n\tprovider env\n\tprovider file zones.yaml\n\tfile zones.yaml\n}", []string{"env", "file:zones.yaml"}},
+	}
+	for _, tt := range tests {
+		opts, err := parse(caddy.NewTestController("dns", tt.corefile))
+		if err != nil {
+			t.Fatalf("Expected no error for %q, but got: %v", tt.corefile, err)
+		}
+		if names := opts.providerNames(); !slices.Equal(names, tt.expected) {
+			t.Errorf("Expected providers %v for %q, got %v", tt.expected, tt.corefile, names)
+		}
+	}
+}
+
+func TestSetupProviders(t *testing.T) {
+	setupTest(t)
+
+	// The second provider locates the node; on overlapping CIDRs the first provider wins.
+	c := caddy.NewTestController("dns", `zoneawareness {
+	provider test_first none 10.0.0.0/24=use1-az1 10.0.1.0/24=use1-az2
+	provider test_second use1-az1 10.0.1.0/24=use1-az1 10.0.2.0/24=use1-az1 10.0.3.4/32=use1-az1
+}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+	if za.currentAvailabilityZoneId != "use1-az1" {
+		t.Errorf("Expected current zone use1-az1, got %s", za.currentAvailabilityZoneId)
+	}
+	for ip, expected := range map[string]int{"10.0.0.1": 1, "10.0.1.1": 0, "10.0.2.1": 1, "10.0.3.4": 1} {
+		if rank := za.rankIP(net.ParseIP(ip), za.localPath()); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+}
+
+func TestSetProviderPrefixes(t *testing.T) {
+	za := &Zoneawareness{
+		currentAvailabilityZoneId: "use1-az1",
+		topology:                  []string{"us-east-1", "use1-az1"},
+		order:                     []string{"test_first", "test_second"},
+	}
+	za.setProviderPrefixes("test_first", []Prefix{{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Zone: "use1-az1"}})
+
+	// Prefixes set at runtime by a later source don't take a CIDR from an earlier one, and zones with a parent zone
+	// are placed below it.
+	za.setProviderPrefixes("test_second", []Prefix{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Zone: "use1-az2"},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Zone: "rack1", Metadata: map[string]string{MetadataParent: "use1-az1"}},
+	})
+	za.setProviderPrefixes("test_other", []Prefix{{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Zone: "use1-az2"}})
+
+	for ip, expected := range map[string]int{"10.0.0.1": 2, "10.0.1.1": 3} {
+		if rank := za.rankIP(net.ParseIP(ip), []string{"us-east-1", "use1-az1", "rack1"}); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+	if path := za.zonePath("rack1"); !slices.Equal(path, []string{"us-east-1", "use1-az1", "rack1"}) {
+		t.Errorf("Expected rack1 below use1-az1, got %v", path)
+	}
+	if _, ok := za.Zones["use1-az2"]; ok {
+		t.Errorf("Expected no CIDRs in use1-az2, got %v", za.Zones["use1-az2"].CIDRs)
+	}
+
+	// A source dropping a CIDR hands it to the next source reporting it.
+	za.setProviderPrefixes("test_first", nil)
+	if zone, ok := za.Zones["use1-az2"]; !ok || len(zone.CIDRs) != 1 || zone.CIDRs[0].String() != "10.0.0.0/24" {
+		t.Errorf("Expected 10.0.0.0/24 to move to use1-az2, got %v", za.Zones["use1-az2"])
+	}
+}
+
+func TestSetProviderPrefixesManyCIDRs(t *testing.T) {
+	za := &Zoneawareness{currentAvailabilityZoneId: "use1-az1"}
+
+	// Thousands of CIDRs in one zone, each reported twice, are merged quickly and only once
+	var prefixes []Prefix
+	for i := range 8000 {
+		prefix := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24)
+		prefixes = append(prefixes, Prefix{Prefix: prefix, Zone: "use1-az1"}, Prefix{Prefix: prefix, Zone: "use1-az1"})
+	}
+	start := time.Now()
+	za.setProviderPrefixes("test_first", prefixes)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected 8000 CIDRs to be merged quickly, took %s", elapsed)
+	}
+	if n := len(za.Zones["use1-az1"].CIDRs); n != 8000 {
+		t.Errorf("Expected 8000 CIDRs in use1-az1, got %d", n)
+	}
+	if rank := za.rankIP(net.ParseIP("10.31.63.1"), za.localPath()); rank != 1 {
+		t.Errorf("Expected 10.31.63.1 in the local zone, got rank %d", rank)
+	}
+}
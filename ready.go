@@ -2,6 +2,13 @@ package zoneawareness
 
 // Ready implements the ready.Readiness interface, once this flips to true CoreDNS
 // assumes this plugin is ready for queries; it is not checked again.
-func (e Zoneawareness) Ready() bool {
+func (e *Zoneawareness) Ready() bool {
+	return e.passthrough || e.synced()
+}
+
+// synced reports whether discovery completed.
+func (e *Zoneawareness) synced() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	return e.HasSynced
 }
@@ -13,3 +13,10 @@ func TestZoneawarenessReady(t *testing.T) {
 		t.Errorf("Expected Ready() to be true when HasSynced is true")
 	}
 }
+
+func TestZoneawarenessReadyPassthrough(t *testing.T) {
+	za := Zoneawareness{passthrough: true}
+	if !za.Ready() {
+		t.Errorf("Expected Ready() to be true before syncing in passthrough mode")
+	}
+}
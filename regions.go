@@ -0,0 +1,94 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// getRegionSubnetsFromEC2 fetches all subnets of a region from the AWS EC2 API.
+func getRegionSubnetsFromEC2(ctx context.Context, region string) ([]types.Subnet, error) {
+	subnets, err := describeSubnets(ctx, region, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe subnets in region '%s': %w", region, err)
+	}
+	return subnets, nil
+}
+
+// regionsProvider describes the subnets of every zone in the region of the node and in other regions. Each subnet is
+// placed in the topology below its region and, for Local Zones and Wavelength Zones, below its parent zone. This tags
+// every CIDR with its region, so answers in other zones of the local region share one topology level with the local
+// node while answers in other regions share none.
+type regionsProvider struct {
+	regions []string
+	filter  *subnetFilter
+
+	getParentZones func(ctx context.Context, region string) (map[string]string, error)
+	getSubnets     func(ctx context.Context, region string) ([]types.Subnet, error)
+}
+
+func (p *regionsProvider) Locate(ctx context.Context) (Location, error) {
+	return Location{}, errNotLocating
+}
+
+func (p *regionsProvider) Prefixes(ctx context.Context, loc Location) ([]Prefix, error) {
+	region := loc.awsRegion()
+	if region == "" {
+		return nil, nil
+	}
+
+	var (
+		prefixes []Prefix
+		errs     []error
+	)
+	seen := make(map[string]bool)
+	for _, r := range append([]string{region}, p.regions...) {
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+
+		parents, err := p.getParentZones(ctx, r)
+		if err != nil {
+			log.Infof("Could not describe the zones of region '%s': %v", r, err)
+		}
+		subnets, err := p.getSubnets(ctx, r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to describe subnets in region '%s': %w", r, err))
+			continue
+		}
+		log.Infof("Found %d subnet(s) in region '%s'", len(subnets), r)
+		prefixes = append(prefixes, regionSubnetPrefixes(r, subnets, parents, p.filter)...)
+	}
+	// The regions that were described are returned with the error, as one region may not be enabled for the account
+	return prefixes, errors.Join(errs...)
+}
+
+func (p *regionsProvider) regional() bool { return true }
+
+// regionSubnetPrefixes returns the CIDRs of subnets in region in the zone of each subnet, tagged with the region and
+// the parent zone of their zone. Subnets are selected and assigned to zones by filter first.
+func regionSubnetPrefixes(region string, subnets []types.Subnet, parents map[string]string, filter *subnetFilter) []Prefix {
+	byZone := make(map[string][]types.Subnet)
+	for _, subnet := range subnets {
+		zone := aws.ToString(subnet.AvailabilityZoneId)
+		if zone == "" {
+			continue
+		}
+		byZone[zone] = append(byZone[zone], subnet)
+	}
+
+	var prefixes []Prefix
+	for zoneName, zoneSubnets := range byZone {
+		zonePrefixes := ec2SubnetPrefixes(zoneName, zoneSubnets, filter)
+		for _, p := range zonePrefixes {
+			p.Metadata[MetadataRegion] = region
+		}
+		setParentZones(zonePrefixes, parents)
+		prefixes = append(prefixes, zonePrefixes...)
+	}
+	return prefixes
+}
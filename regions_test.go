@@ -0,0 +1,126 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+func TestGetRegionSubnetsFromEC2(t *testing.T) {
+	requests := newFakeAWSAPI(t, "EC2", map[string]string{
+		"DescribeSubnets": `<DescribeSubnetsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>1</requestId>
+  <subnetSet>
+    <item><subnetId>subnet-1</subnetId><availabilityZoneId>euw1-az1</availabilityZoneId><cidrBlock>10.1.1.0/24</cidrBlock></item>
+    <item><subnetId>subnet-2</subnetId><availabilityZoneId>euw1-az2</availabilityZoneId><cidrBlock>10.1.2.0/24</cidrBlock></item>
+  </subnetSet>
+</DescribeSubnetsResponse>`,
+	})
+
+	subnets, err := getRegionSubnetsFromEC2(context.Background(), "eu-west-1")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(subnets) != 2 {
+		t.Errorf("Expected 2 subnets, got %v", subnets)
+	}
+	if got := requests(); len(got) != 1 || got[0].Get("Filter.1.Name") != "" {
+		t.Errorf("Expected one unfiltered DescribeSubnets call, got %v", got)
+	}
+}
+
+func TestSetupRegions(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return []types.Subnet{{SubnetId: aws.String("subnet-a"), AvailabilityZoneId: aws.String("use1-az1"), CidrBlock: aws.String("10.0.1.0/24")}}, nil
+		}
+	})
+
+	var described []string
+	patchProvider(t, "regions", func(p *regionsProvider) {
+		p.getSubnets = func(ctx context.Context, region string) ([]types.Subnet, error) {
+			described = append(described, region)
+			switch region {
+			case "us-east-1":
+				return []types.Subnet{
+					{SubnetId: aws.String("subnet-a"), AvailabilityZoneId: aws.String("use1-az1"), CidrBlock: aws.String("10.0.1.0/24")},
+					{SubnetId: aws.String("subnet-b"), AvailabilityZoneId: aws.String("use1-az2"), CidrBlock: aws.String("10.0.2.0/24")},
+				}, nil
+			case "eu-west-1":
+				return []types.Subnet{
+					{SubnetId: aws.String("subnet-c"), AvailabilityZoneId: aws.String("euw1-az1"), CidrBlock: aws.String("10.1.1.0/24")},
+				}, nil
+			}
+			return nil, errors.New("region not enabled")
+		}
+	})
+	patchProvider(t, "load_balancers", func(p *loadBalancerProvider) {
+		p.getAddresses = func(ctx context.Context, region string, vpcIDs []string, zoneID zoneIDFunc) ([]zonalAddress, error) {
+			return []zonalAddress{{addr: netip.MustParseAddr("198.51.100.20"), zone: "use1-az2"}}, nil
+		}
+	})
+
+	corefile := "zoneawareness {\n\tregions eu-west-1 us-east-1 ap-east-1\n\tload_balancers\n}"
+	c := caddy.NewTestController("dns", corefile)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !slices.Equal(described, []string{"us-east-1", "eu-west-1", "ap-east-1"}) {
+		t.Errorf("Expected each region to be described once, got %v", described)
+	}
+
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+	startTestWatchers(t, corefile, za, Location{Zone: "use1-az1", Region: "us-east-1", Cloud: CloudAWS})
+
+	if got := strings.Join(za.localPath(), "/"); got != "us-east-1/use1-az1" {
+		t.Errorf("Expected local path 'us-east-1/use1-az1', got '%s'", got)
+	}
+	for ip, expected := range map[string]int{
+		"10.0.1.5":      2, // local zone
+		"10.0.2.5":      1, // same region
+		"198.51.100.20": 1, // load balancer in the same region
+		"10.1.1.5":      0, // other region
+		"192.0.2.1":     0, // unknown
+	} {
+		if rank := za.rankIP(net.ParseIP(ip), za.localPath()); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+}
+
+func TestRegionsProviderReturnsRegionErrors(t *testing.T) {
+	p := &regionsProvider{
+		regions:        []string{"eu-west-1", "ap-east-1"},
+		getParentZones: func(ctx context.Context, region string) (map[string]string, error) { return nil, nil },
+		getSubnets: func(ctx context.Context, region string) ([]types.Subnet, error) {
+			if region == "ap-east-1" {
+				return nil, errors.New("region not enabled")
+			}
+			return []types.Subnet{{SubnetId: aws.String("subnet-" + region), AvailabilityZoneId: aws.String(region + "-az1"), CidrBlock: aws.String("10.0.0.0/24")}}, nil
+		},
+	}
+
+	prefixes, err := p.Prefixes(context.Background(), Location{Zone: "use1-az1", Region: "us-east-1", Cloud: CloudAWS})
+	if err == nil || !strings.Contains(err.Error(), "ap-east-1") {
+		t.Errorf("Expected the failed region in the error, got %v", err)
+	}
+	// The regions that were described are still returned
+	if len(prefixes) != 2 {
+		t.Errorf("Expected the subnets of the other regions, got %v", prefixes)
+	}
+}
@@ -0,0 +1,207 @@
+package zoneawareness
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryInitial = time.Second
+	defaultRetryMax     = 5 * time.Minute
+)
+
+// retryOptions configures retrying failed discovery in the background, which is done with the defaults unless the
+// retry option is given.
+type retryOptions struct {
+	initial time.Duration // delay before the first retry, doubled after every failed attempt
+	max     time.Duration // longest delay between attempts
+	// passthrough makes the plugin ready before discovery succeeded, passing answers through unchanged until then.
+	// Otherwise it is not ready until then.
+	passthrough bool
+}
+
+// parseRetryOptions parses the arguments of the retry option: initial=DURATION, max=DURATION and passthrough.
+func parseRetryOptions(args []string) (*retryOptions, error) {
+	opts := &retryOptions{initial: defaultRetryInitial, max: defaultRetryMax}
+	for _, arg := range args {
+		if arg == "passthrough" {
+			opts.passthrough = true
+			continue
+		}
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("expected KEY=VALUE or passthrough, got '%s'", arg)
+		}
+		switch key {
+		case "initial", "max":
+			delay, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			if delay <= 0 {
+				return nil, fmt.Errorf("%s delay must be positive, got %s", key, delay)
+			}
+			if key == "initial" {
+				opts.initial = delay
+			} else {
+				opts.max = delay
+			}
+		default:
+			return nil, fmt.Errorf("unknown argument '%s'", key)
+		}
+	}
+	if opts.initial > opts.max {
+		return nil, fmt.Errorf("initial delay %s is longer than the max delay %s", opts.initial, opts.max)
+	}
+	return opts, nil
+}
+
+// backoff returns the delays between attempts, growing exponentially from initial up to max.
+type backoff struct {
+	initial, max time.Duration
+	attempts     int
+}
+
+// next returns the delay before the next attempt. Half of it is random, so that nodes that failed together, e.g.
+// when the EC2 API was throttled, don't retry together.
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempts < 32 {
+		if d := b.initial << b.attempts; d > 0 && d < b.max {
+			delay = d
+		}
+	}
+	b.attempts++
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retry calls attempt until it succeeds, waiting with exponential backoff and jitter in between. It returns false
+// if ctx is done first.
+func retry(ctx context.Context, opts *retryOptions, what string, attempt func(ctx context.Context) error) bool {
+	b := backoff{initial: opts.initial, max: opts.max}
+	for {
+		err := attempt(ctx)
+		if err == nil {
+			return true
+		}
+		delay := b.next()
+		log.Infof("Failed %s: %v. Retrying in %s.", what, err, delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryDiscovery discovers the location and zones of the node again, the same way as at setup, until a provider
+// located the node and discovered its prefixes, then marks e as synced and retries the other providers that failed
+// on their own. Every attempt that locates the node is taken over. The sources updating the zones at runtime are
+// started for loc if the node is already located, or once an attempt locates it, and started again if an attempt
+// locates it elsewhere.
+func (e *Zoneawareness) retryDiscovery(ctx context.Context, opts *options, loc Location) {
+	var (
+		watching Location
+		stop     context.CancelFunc
+		failed   []namedProvider
+	)
+	watch := func(loc Location) {
+		if stop != nil && loc.Zone == watching.Zone && loc.Region == watching.Region && loc.Cloud == watching.Cloud {
+			return
+		}
+		if stop != nil {
+			stop()
+		}
+		var watchCtx context.Context
+		watchCtx, stop = context.WithCancel(ctx)
+		opts.startWatchers(watchCtx, e, loc)
+		watching = loc
+	}
+	if e.located() {
+		watch(loc)
+	}
+
+	ok := retry(ctx, opts.retry, "to discover the zones", func(ctx context.Context) error {
+		next := &Zoneawareness{Zones: make(map[string]*Zone), topology: opts.topology}
+		var err error
+		loc, failed, err = next.discover(ctx, opts)
+		if next.located() {
+			if !e.located() {
+				log.Infof("Located zone '%s' with %d CIDR(s).", strings.Join(next.localPath(), "/"), next.rankable())
+			}
+			e.adopt(next, opts)
+			watch(loc)
+		}
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	e.mu.Lock()
+	e.HasSynced = true
+	log.Infof("Discovery synced for zone '%s' with %d CIDR(s).", strings.Join(e.localPath(), "/"), e.rankable())
+	e.mu.Unlock()
+
+	e.retryProviders(ctx, opts, loc, failed)
+}
+
+// retryProviders gets the prefixes of the providers that failed to discover them for the node at loc again, each on
+// its own with backoff until it succeeds or ctx is done, so that one failing source doesn't hold up the others. The
+// prefixes replace those the provider contributed before, e.g. from the cache.
+func (e *Zoneawareness) retryProviders(ctx context.Context, opts *options, loc Location, failed []namedProvider) {
+	for _, p := range failed {
+		go retry(ctx, opts.retry, "to get prefixes from provider "+p.name, func(ctx context.Context) error {
+			prefixes, err := p.provider.Prefixes(ctx, loc)
+			if err != nil {
+				return err
+			}
+			opts.cache.store(p.name, prefixes)
+			if err := opts.cache.save(); err != nil {
+				log.Errorf("Failed to write cache: %v", err)
+			}
+			e.setProviderPrefixes(p.name, prefixes)
+			log.Infof("Got %d prefix(es) from provider %s.", len(prefixes), p.name)
+			return nil
+		})
+	}
+}
+
+// adopt takes over the location and zones discovered by next, which is not used anymore. The prefixes the sources
+// updating the zones at runtime passed to e are kept, as next only has those that were cached.
+func (e *Zoneawareness) adopt(next *Zoneawareness, opts *options) {
+	e.rebuildMu.Lock()
+	defer e.rebuildMu.Unlock()
+	e.mu.RLock()
+	for _, p := range opts.providers {
+		if _, ok := p.provider.(Watcher); !ok {
+			continue
+		}
+		if prefixes, ok := e.sources[p.name]; ok {
+			if next.sources == nil {
+				next.sources = make(map[string][]Prefix)
+			}
+			next.sources[p.name] = prefixes
+		}
+	}
+	e.mu.RUnlock()
+	next.rebuildMu.Lock()
+	next.rebuild()
+	next.rebuildMu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Zones = next.Zones
+	e.currentAvailabilityZoneId = next.currentAvailabilityZoneId
+	e.topology = next.topology
+	e.parents = next.parents
+	e.sources = next.sources
+	e.order = next.order
+	e.static = next.static
+	e.regions = next.regions
+	e.hosts = next.hosts
+	e.index = next.index
+}
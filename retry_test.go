@@ -0,0 +1,353 @@
+package zoneawareness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestParseRetryOptions(t *testing.T) {
+	opts, err := parseRetryOptions([]string{"initial=500ms", "max=1m", "passthrough"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if opts.initial != 500*time.Millisecond || opts.max != time.Minute || !opts.passthrough {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+	if opts, _ := parseRetryOptions(nil); opts.initial != defaultRetryInitial || opts.max != defaultRetryMax || opts.passthrough {
+		t.Errorf("Expected the default options, got %+v", opts)
+	}
+	for _, args := range [][]string{{"initial=0s"}, {"max=soon"}, {"initial=10m"}, {"wait"}, {"jitter=1s"}} {
+		if _, err := parseRetryOptions(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{initial: time.Second, max: 10 * time.Second}
+	for i, limit := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if delay := b.next(); delay < limit/2 || delay > limit {
+			t.Errorf("Expected delay %d between %s and %s, got %s", i, limit/2, limit, delay)
+		}
+	}
+	b.attempts = 100
+	if delay := b.next(); delay < 5*time.Second || delay > 10*time.Second {
+		t.Errorf("Expected the delay to stay capped after many attempts, got %s", delay)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	ok := retry(ctx, &retryOptions{initial: time.Hour, max: time.Hour}, "in test", func(ctx context.Context) error {
+		attempts++
+		cancel()
+		return errors.New("unavailable")
+	})
+	if ok || attempts != 1 {
+		t.Errorf("Expected retrying to stop when canceled after 1 attempt, got %v after %d", ok, attempts)
+	}
+}
+
+func TestSetupRetryDiscovery(t *testing.T) {
+	setupTest(t)
+	attempts := 0
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) {
+			attempts++
+			if attempts < 3 {
+				return "", "", errors.New("IMDS timed out")
+			}
+			return "use1-az1", "us-east-1", nil
+		}
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return []types.Subnet{{SubnetId: aws.String("subnet-1"), CidrBlock: aws.String("10.0.1.0/24")}}, nil
+		}
+	})
+
+	corefile := "zoneawareness {\n\tretry initial=1ms max=4ms\n}"
+	c := caddy.NewTestController("dns", corefile)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added while discovery is retried, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+	if za.Ready() {
+		t.Error("Expected the plugin not to be ready before discovery succeeded")
+	}
+
+	// The server starts retrying; the node is located by the third attempt.
+	opts, err := parse(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	za.retryDiscovery(context.Background(), opts, Location{})
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts to locate the node, got %d", attempts)
+	}
+	if !za.Ready() {
+		t.Error("Expected the plugin to be ready once discovery succeeded")
+	}
+	za.mu.RLock()
+	defer za.mu.RUnlock()
+	if za.currentAvailabilityZoneId != "use1-az1" {
+		t.Errorf("Expected current zone use1-az1, got %s", za.currentAvailabilityZoneId)
+	}
+	if rank := za.rankIP(net.ParseIP("10.0.1.5"), za.localPath()); rank != 1 {
+		t.Errorf("Expected 10.0.1.5 to be in the local zone, got rank %d", rank)
+	}
+}
+
+func TestSetupRetryPrefixesPassthrough(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+	})
+	attempts := 0
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			attempts++
+			if attempts < 3 {
+				return nil, errors.New("RequestLimitExceeded")
+			}
+			return []types.Subnet{{SubnetId: aws.String("subnet-1"), CidrBlock: aws.String("10.0.1.0/24")}}, nil
+		}
+	})
+
+	corefile := "zoneawareness use1-az1 10.0.2.0/24 {\n\tretry initial=1ms max=4ms passthrough\n}"
+	c := caddy.NewTestController("dns", corefile)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+
+	// Until the subnets are discovered the plugin is ready but passes answers through unchanged.
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{test.A("example.org. 300 IN A 192.168.1.1"), test.A("example.org. 300 IN A 10.0.2.1")}
+	za := plugins[0](&mockHandler{msg: m}).(*Zoneawareness)
+	if !za.Ready() || za.synced() {
+		t.Errorf("Expected the plugin to be ready but not synced, got ready %v and synced %v", za.Ready(), za.synced())
+	}
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := za.ServeDNS(context.Background(), rec, r); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if first := rec.Msg.Answer[0].(*dns.A).A.String(); first != "192.168.1.1" {
+		t.Errorf("Expected answers to pass through unchanged, got %s first", first)
+	}
+
+	opts, err := parse(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	za.retryDiscovery(context.Background(), opts, Location{Zone: "use1-az1", Region: "us-east-1", Cloud: CloudAWS})
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts to describe the subnets, got %d", attempts)
+	}
+	if !za.synced() {
+		t.Error("Expected the plugin to be synced once the subnets were discovered")
+	}
+	za.mu.RLock()
+	rank := za.rankIP(net.ParseIP("10.0.1.5"), za.localPath())
+	za.mu.RUnlock()
+	if rank != 1 {
+		t.Errorf("Expected 10.0.1.5 to be in the local zone, got rank %d", rank)
+	}
+
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := za.ServeDNS(context.Background(), rec, r); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if first := rec.Msg.Answer[0].(*dns.A).A.String(); first != "10.0.2.1" {
+		t.Errorf("Expected answers to be reordered once synced, got %s first", first)
+	}
+}
+
+func TestSetupRetryCache(t *testing.T) {
+	setupTest(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.json")
+	mapPath := filepath.Join(dir, "map.yaml")
+	if err := os.WriteFile(mapPath, []byte("zones:\n  use1-az1:\n    cidrs: [10.0.9.0/24]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	corefile := "zoneawareness {\n\tcache " + path + "\n\tfile " + mapPath + "\n\tretry initial=1ms max=4ms\n}"
+
+	// A previous run located the node and discovered its subnets.
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return []types.Subnet{{SubnetId: aws.String("subnet-1"), CidrBlock: aws.String("10.0.1.0/24")}}, nil
+		}
+	})
+	if err := setup(caddy.NewTestController("dns", corefile)); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	// After a restart IMDS times out twice, and the cached location and subnets are used meanwhile.
+	attempts := 0
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) {
+			attempts++
+			if attempts < 3 {
+				return "", "", errors.New("IMDS timed out")
+			}
+			return "use1-az1", "us-east-1", nil
+		}
+	})
+	c := caddy.NewTestController("dns", corefile)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added from the cache, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+	if za.Ready() {
+		t.Error("Expected the plugin not to be ready while only the cache located the node")
+	}
+	if rank := za.rankIP(net.ParseIP("10.0.1.5"), za.localPath()); rank != 1 {
+		t.Errorf("Expected the cached subnet to be in the local zone, got rank %d", rank)
+	}
+
+	opts, err := parse(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := opts.cache.load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	za.retryDiscovery(ctx, opts, Location{Zone: "use1-az1", Region: "us-east-1", Cloud: CloudAWS})
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts to locate the node, got %d", attempts)
+	}
+	if !za.Ready() {
+		t.Error("Expected the plugin to be ready once a provider located the node")
+	}
+	// The zone map loaded when the sources were started for the cached location is kept by the later attempts.
+	za.mu.RLock()
+	rank := za.rankIP(net.ParseIP("10.0.9.5"), za.localPath())
+	za.mu.RUnlock()
+	if rank != 1 {
+		t.Errorf("Expected the zone map to be kept, got rank %d", rank)
+	}
+
+	// The next start uses the cached zone map until the file is loaded again.
+	c = caddy.NewTestController("dns", corefile)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	za = dnsserver.GetConfig(c).Plugin[0](nil).(*Zoneawareness)
+	if rank := za.rankIP(net.ParseIP("10.0.9.5"), za.localPath()); rank != 1 {
+		t.Errorf("Expected the cached zone map to be used, got rank %d", rank)
+	}
+}
+
+func TestSetupRetriesByDefault(t *testing.T) {
+	setupTest(t)
+
+	c := caddy.NewTestController("dns", "zoneawareness")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added while discovery is retried, but it wasn't")
+	}
+	if za := plugins[0](nil).(*Zoneawareness); za.Ready() {
+		t.Error("Expected the plugin not to be ready before discovery succeeded")
+	}
+
+	opts, err := parse(caddy.NewTestController("dns", "zoneawareness"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if opts.retry == nil || opts.retry.initial != defaultRetryInitial || opts.retry.max != defaultRetryMax || opts.retry.passthrough {
+		t.Errorf("Expected discovery to be retried with the defaults, got %+v", opts.retry)
+	}
+}
+
+func TestRetryFailedProviders(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return []types.Subnet{{SubnetId: aws.String("subnet-1"), CidrBlock: aws.String("10.0.1.0/24")}}, nil
+		}
+	})
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	patchProvider(t, "assume_role", func(p *assumeRoleProvider) {
+		p.getSubnets = func(ctx context.Context, azID string, region string, role assumeRole) ([]types.Subnet, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if attempts < 3 {
+				return nil, errors.New("access denied")
+			}
+			return []types.Subnet{{SubnetId: aws.String("subnet-remote"), CidrBlock: aws.String("10.20.1.0/24")}}, nil
+		}
+	})
+
+	corefile := "zoneawareness {\n\tassume_role arn:aws:iam::111111111111:role/dns\n\tretry initial=1ms max=4ms\n}"
+	opts, err := parse(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	za := &Zoneawareness{Zones: make(map[string]*Zone), topology: opts.topology}
+	loc, failed, err := za.discover(context.Background(), opts)
+	// The provider that located the node discovered its subnets, so discovery is complete without the other account
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(failed) != 1 || failed[0].name != "assume_role/111111111111" {
+		t.Fatalf("Expected the assume_role provider to have failed, got %v", failed)
+	}
+
+	rank := func(ip string) int {
+		za.mu.RLock()
+		defer za.mu.RUnlock()
+		return za.rankIP(net.ParseIP(ip), za.localPath())
+	}
+	if rank("10.0.1.5") != 1 || rank("10.20.1.5") != 0 {
+		t.Errorf("Expected only the local subnet before the other account was retried")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	za.retryProviders(ctx, opts, loc, failed)
+	waitFor(t, "the other account to be retried", func() bool { return rank("10.20.1.5") == 1 })
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts to describe the subnets of the other account, got %d", attempts)
+	}
+}
@@ -2,12 +2,14 @@ package zoneawareness
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -36,10 +38,12 @@ var log = clog.NewWithPlugin(pluginName)
 // init registers this plugin.
 func init() { plugin.Register(pluginName, setup) }
 
-// Regex pattern for AWS Availability Zone IDs (e.g., use2-az1, euw1-az2, apse1-az3)
+// Regex pattern for AWS Availability Zone IDs (e.g., use2-az1, euw1-az2, apse1-az3), Local Zone IDs (e.g.,
+// use1-bos1-az1) and Wavelength Zone IDs (e.g., use1-wl1-bos-wlz1)
 // https://docs.aws.amazon.com/global-infrastructure/latest/regions/aws-availability-zones.html
 // https://docs.aws.amazon.com/local-zones/latest/ug/available-local-zones.html
-var awsZoneIDPattern = regexp.MustCompile(`^[a-z]{2,4}[0-9](-[a-z]{3}[0-9])?-az[0-9]$`)
+// https://docs.aws.amazon.com/wavelength/latest/developerguide/available-wavelength-zones.html
+var awsZoneIDPattern = regexp.MustCompile(`^[a-z]{2,4}[0-9](-[a-z]{3}[0-9])?-az[0-9]$|^[a-z]{2,4}[0-9]-wl[0-9]-[a-z]{3}-wlz[0-9]$`)
 
 const pluginName = "zoneawareness"
 
@@ -50,99 +54,378 @@ const pluginName = "zoneawareness"
 // zoneawareness use2-az3 100.111.97.0/24
 // zoneawareness use2-az2 100.111.98.0/24 100.111.99.0/24
 // zoneawareness use2-az1 23.192.228.0/24
+//
+// Zones can also be written as a topology path, and the path of the local node set with the topology option:
+//
+//	zoneawareness eu-central-1/euc1-az1/rack12 10.1.2.0/24
+//	zoneawareness eu-central-1/euc1-az2 10.2.0.0/16 {
+//	    topology eu-central-1/euc1-az1/rack12/host3
+//	}
+//
+// Other options in the block enable additional ways to discover the current zone and its CIDRs:
+//
+//	zoneawareness {
+//	    provider NAME [ARGS...]
+//	    kubernetes_node [LABEL]
+//	    kubernetes_endpoints [endpointslices] [pods]
+//	    kubernetes_pod_cidrs
+//	    network_interfaces [VPC-ID...] [KEY=VALUE...] [interval=INTERVAL]
+//	    load_balancers [VPC-ID...] [interval=INTERVAL]
+//	    vpc_endpoints [VPC-ID...] [interval=INTERVAL]
+//	    managed_services [rds] [elasticache] [msk] [interval=INTERVAL] [vpc=VPC-ID]
+//	    assume_role ROLE-ARN [external_id=ID] [region=REGION]
+//	    regions [REGION...]
+//	    aws_ip_ranges [SOURCE] [INTERVAL]
+//	    prefix_list PREFIX-LIST-ID ZONE [INTERVAL]
+//	    file PATH [INTERVAL]
+//	    terraform_state PATH [INTERVAL]
+//	    ssm_parameter NAME [region=REGION] [endpoint=URL] [interval=INTERVAL]
+//	    s3_object s3://BUCKET/KEY [region=REGION] [endpoint=URL] [interval=INTERVAL]
+//	    url URL [interval=INTERVAL] [token_file=PATH] [items=PATH] [prefix=FIELD] [zone=FIELD] [labels=FIELD,...]
+//	    ipam_pools [IPAM-POOL-ID...] [tag=KEY] [region=REGION]
+//	    subnet_include KEY[=VALUE]...
+//	    subnet_exclude KEY[=VALUE]...
+//	    subnet_zone_tag [KEY]
+//	    gcp [forwarding_rules] [project=PROJECT] [interval=INTERVAL]
+//	    azure [RESOURCE-GROUP...] [subscription=ID] [interval=INTERVAL]
+//	    netbox URL [token_file=PATH] [tag=TAG...] [role=ROLE...] [zone=FIELD] [interval=INTERVAL]
+//	    cache PATH [max_age=DURATION]
+//	    retry [initial=DURATION] [max=DURATION] [passthrough]
+//	}
 func setup(c *caddy.Controller) error {
-	l := &Zoneawareness{Zones: make(map[string]*Zone), currentAvailabilityZoneId: ""}
-
-	// Attempt to fetch Availability Zone ID and Region from EC2 IMDSv2
-	instanceAvailabilityZoneId, instanceRegion, err := getConfigFromIMDSv2Func()
+	opts, err := parse(c)
 	if err != nil {
-		log.Infof("Could not fetch AZ and Region from IMDSv2: %v. Will rely on other configuration methods.", err)
-	} else if instanceAvailabilityZoneId != "" && instanceRegion != "" {
-		l.currentAvailabilityZoneId = instanceAvailabilityZoneId
-		log.Infof("Successfully fetched placement/availability-zone-id '%s' and region '%s' from EC2 IMDSv2.", l.currentAvailabilityZoneId, instanceRegion)
+		return plugin.Error(pluginName, err)
+	}
+	if opts.cache != nil {
+		if err := opts.cache.load(); err != nil {
+			log.Errorf("Failed to read cache: %v", err)
+		}
+	}
 
-		// Describe subnets using the discovered AZ and Region
-		subnets, err := getSubnetsFromEC2Func(context.Background(), l.currentAvailabilityZoneId, instanceRegion)
-		if err != nil {
-			log.Errorf("Failed to describe subnets: %v", err)
-			// Do not return error, just log and continue without subnets
-			// This means the plugin will still be active, but without auto-discovered subnets.
-		} else {
-			// Add subnets to the zone
-			for _, subnet := range subnets {
-				// Process IPv4 CIDR block
-				if subnet.CidrBlock != nil && *subnet.CidrBlock != "" {
-					cidrStr := *subnet.CidrBlock
-					_, parsedCIDR, parseErr := net.ParseCIDR(cidrStr)
-					if parseErr != nil {
-						log.Warningf("Invalid IPv4 CIDR format for subnet %s (%s): %v", *subnet.SubnetId, cidrStr, parseErr)
-					} else {
-						zone, exists := l.Zones[l.currentAvailabilityZoneId]
-						if !exists {
-							log.Infof("Adding new zone '%s'", l.currentAvailabilityZoneId)
-							zone = &Zone{}
-							l.Zones[l.currentAvailabilityZoneId] = zone
-						}
-						zone.CIDRs = append(zone.CIDRs, parsedCIDR)
-						log.Infof("%s added to zone '%s' from subnet %s", cidrStr, l.currentAvailabilityZoneId, *subnet.SubnetId)
-					}
+	l := &Zoneawareness{Zones: make(map[string]*Zone), currentAvailabilityZoneId: "", topology: opts.topology}
+	loc, failed, err := l.discover(context.Background(), opts)
+	if !l.located() {
+		log.Infof("No valid zone found by providers %s. Retrying in the background.", opts.providerNames())
+	}
+
+	// Discovery is complete once a provider rather than the cache located the node and that provider discovered its
+	// prefixes. Until then it is retried in the background. The prefixes of other providers that failed are
+	// retried on their own, without holding up discovery.
+	l.HasSynced = err == nil
+	l.passthrough = opts.retry.passthrough
+
+	// Sources that keep updating the zones at runtime are started with the server, or once the node is located.
+	if opts.watches() || !l.HasSynced || len(failed) > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		c.OnStartup(func() error {
+			if l.HasSynced {
+				opts.startWatchers(ctx, l, loc)
+				l.retryProviders(ctx, opts, loc, failed)
+				return nil
+			}
+			go l.retryDiscovery(ctx, opts, loc)
+			return nil
+		})
+		c.OnShutdown(func() error {
+			cancel()
+			return nil
+		})
+	}
+
+	// Conditionally add the plugin to the chain.
+	if n := l.rankable(); n > 0 || opts.watches() || !l.HasSynced {
+		dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+			log.Infof("Plugin added for current zone '%s' with %d CIDR(s).", strings.Join(l.localPath(), "/"), n)
+			l.Next = next
+			for name, zone := range l.Zones {
+				for _, cidr := range zone.CIDRs {
+					log.Debugf("%s (%s)", cidr.String(), name)
 				}
+			}
+			return l
+		})
+	} else {
+		log.Infof("Zoneawareness plugin NOT added: No CIDRs were configured or found for the current operational zone '%s'.", strings.Join(l.localPath(), "/"))
+	}
+	return nil
+}
 
-				// Process IPv6 CIDR blocks
-				for _, ipv6Assoc := range subnet.Ipv6CidrBlockAssociationSet {
-					if ipv6Assoc.Ipv6CidrBlock != nil && *ipv6Assoc.Ipv6CidrBlock != "" {
-						cidrStr := *ipv6Assoc.Ipv6CidrBlock
-						_, parsedCIDR, parseErr := net.ParseCIDR(cidrStr)
-						if parseErr != nil {
-							log.Warningf("Invalid IPv6 CIDR format for subnet %s (%s): %v", *subnet.SubnetId, cidrStr, parseErr)
-						} else {
-							zone, exists := l.Zones[l.currentAvailabilityZoneId]
-							if !exists {
-								log.Infof("Adding new zone '%s'", l.currentAvailabilityZoneId)
-								zone = &Zone{}
-								l.Zones[l.currentAvailabilityZoneId] = zone
-							}
-							zone.CIDRs = append(zone.CIDRs, parsedCIDR)
-							log.Infof("%s added to zone '%s' from subnet %s", cidrStr, l.currentAvailabilityZoneId, *subnet.SubnetId)
-						}
-					}
+// located reports whether the zone or the topology path of the node is known.
+func (e *Zoneawareness) located() bool {
+	return e.currentAvailabilityZoneId != "" || len(e.topology) > 0
+}
+
+// discover locates the node and adds the prefixes of the providers and the Corefile to the zones. It returns the
+// location, the other providers that failed to discover their prefixes and, unless a provider located the node and
+// discovered its prefixes, an error naming what was missing or only read from the cache.
+func (e *Zoneawareness) discover(ctx context.Context, opts *options) (Location, []namedProvider, error) {
+	// The node is located by the first provider that can tell where it runs, e.g. EC2 IMDSv2, then ECS task
+	// metadata, Kubernetes node labels, the GCP metadata server, Azure IMDS and the AWS_ZONE_ID environment variable.
+	// Without a provider locating the node, the location cached when it was last located is used.
+	live, locatedBy := locate(ctx, opts.providers)
+	loc := opts.cache.locate(live)
+	e.currentAvailabilityZoneId = loc.Zone
+	if len(e.topology) == 0 && len(loc.Path) > 0 {
+		e.topology = loc.Path
+	}
+	var (
+		missing []string
+		failed  []namedProvider
+	)
+	if live.Zone == "" && loc.Zone != "" {
+		missing = append(missing, "no provider located the node, using the cached location")
+	}
+
+	// The prefixes of every provider are merged in the order of the providers; a CIDR reported by more than one
+	// provider belongs to the zone the first of them reports.
+	e.order = opts.providerNames()
+	var located []Prefix
+	if loc.Zone != "" {
+		for _, p := range opts.providers {
+			if _, ok := p.provider.(Watcher); ok {
+				// Sources updating the zones at runtime pass their prefixes once started. Until then the prefixes
+				// they passed last are used, if they are cached.
+				if cached, ok := opts.cache.prefixes(p.name); ok {
+					e.addPrefixes(p.name, cached)
+					located = append(located, cached...)
 				}
+				continue
+			}
+			prefixes, err := p.provider.Prefixes(ctx, loc)
+			if err != nil {
+				// Do not return early, just log and continue with the prefixes this provider discovered last, if
+				// they are cached, or with the ones it discovered before failing. This means the plugin will still
+				// be active, but without some auto-discovered subnets.
+				log.Errorf("Failed to get prefixes from provider %s: %v", p.name, err)
+				if p.name == locatedBy {
+					missing = append(missing, fmt.Sprintf("provider %s: %v", p.name, err))
+				} else {
+					failed = append(failed, p)
+				}
+				if cached, ok := opts.cache.prefixes(p.name); ok {
+					prefixes = cached
+				} else if len(prefixes) == 0 {
+					continue
+				}
+			} else {
+				opts.cache.store(p.name, prefixes)
+			}
+			e.addPrefixes(p.name, prefixes)
+			located = append(located, prefixes...)
+		}
+	}
+	if err := opts.cache.save(); err != nil {
+		log.Errorf("Failed to write cache: %v", err)
+	}
+	// Parent zones are known once the prefixes are merged
+	e.merge()
+
+	if loc.Zone != "" {
+		// A node on an Outpost ranks its Outpost first and the zone it is anchored to second
+		localZone := loc.Zone
+		if i := slices.IndexFunc(located, func(p Prefix) bool { return p.Metadata[MetadataLocal] != "" }); i >= 0 {
+			localZone = located[i].Zone
+			log.Infof("Running in zone '%s' below zone '%s'", localZone, loc.Zone)
+		}
+
+		// The local topology is the local zone below its parent zones and, for providers that place prefixes below
+		// their region, below the region, unless a topology is configured.
+		if len(e.topology) == 0 {
+			path := e.parentChain(localZone)
+			if region := loc.awsRegion(); region != "" && opts.regional() {
+				path = append([]string{region}, path...)
+			}
+			if len(path) > 1 {
+				e.topology = path
 			}
 		}
 	}
 
-	// Alternatively, check environment variable AWS_ZONE_ID
-	if l.currentAvailabilityZoneId == "" {
-		if awsZoneIDPattern.MatchString(os.Getenv("AWS_ZONE_ID")) {
-			l.currentAvailabilityZoneId = os.Getenv("AWS_ZONE_ID")
-			log.Infof("Using AWS_ZONE_ID environment variable: %s", l.currentAvailabilityZoneId)
+	if e.located() {
+		if e.currentAvailabilityZoneId != "" && len(e.topology) > 0 && !slices.Contains(e.topology, e.currentAvailabilityZoneId) {
+			log.Warningf("Current zone '%s' is not part of topology '%s'; discovered subnets will not be preferred.", e.currentAvailabilityZoneId, strings.Join(e.topology, "/"))
+		}
+		e.static = e.localStaticZones(opts.zones)
+	} else {
+		missing = append(missing, fmt.Sprintf("no valid zone found by providers %s", opts.providerNames()))
+	}
+	e.merge()
+	if len(missing) > 0 {
+		return loc, failed, errors.New(strings.Join(missing, "; "))
+	}
+	return loc, failed, nil
+}
+
+// merge rebuilds the zones from the Corefile zones and the prefixes of the sources.
+func (e *Zoneawareness) merge() {
+	e.rebuildMu.Lock()
+	defer e.rebuildMu.Unlock()
+	e.rebuild()
+}
+
+// startWatchers starts the sources that keep updating the zones of za at runtime until ctx is done. They are
+// started for the node at loc.
+func (o *options) startWatchers(ctx context.Context, za *Zoneawareness, loc Location) {
+	var watchers []func(ctx context.Context) error
+	for _, p := range o.providers {
+		if watcher, ok := p.provider.(Watcher); ok {
+			name := p.name
+			watchers = append(watchers, func(ctx context.Context) error {
+				return watcher.Watch(ctx, loc, func(prefixes []Prefix) {
+					za.setProviderPrefixes(name, prefixes)
+					o.cache.store(name, prefixes)
+					if err := o.cache.save(); err != nil {
+						log.Errorf("Failed to write cache: %v", err)
+					}
+				})
+			})
+		}
+	}
+	for _, start := range watchers {
+		if err := start(ctx); err != nil {
+			// Like failed discovery at setup, this does not stop the server.
+			log.Errorf("Failed to start watching: %v", err)
+		}
+	}
+}
+
+// staticZone is a zone and its CIDRs as written in the Corefile.
+type staticZone struct {
+	name  string
+	path  []string // nil for a bare zone name
+	cidrs []*net.IPNet
+}
+
+// options holds everything parsed from the Corefile.
+type options struct {
+	topology []string
+	zones    []staticZone
+
+	// providers lists the providers locating the node and discovering prefixes, in order of precedence.
+	providers []namedProvider
+
+	// kubernetesNode reads the zone from the labels of the Kubernetes node. Like gcp and azure it is enabled by its
+	// option and added to providers unless a provider directive lists it.
+	kubernetesNode Provider
+
+	// sources lists the providers that only discover prefixes enabled by their options, such as regions, prefix_list
+	// or the zone maps of file and url, in the order they are listed. They are added to providers unless a provider
+	// directive lists them.
+	sources []namedProvider
+
+	// subnetFilter, when set, selects the EC2 subnets that count and the zone their CIDRs belong to by tags.
+	subnetFilter *subnetFilter
+
+	// gcp, when set, reads the zone from the GCP metadata server and maps the addresses of the instances in the
+	// project to their zones.
+	gcp Provider
+
+	// azure, when set, reads the zone from Azure IMDS and maps the private IPs of VMs and VMSS instances to their
+	// zones.
+	azure Provider
+
+	// netbox, when set, maps the prefixes in NetBox to the zone of their site, location, region or custom field.
+	netbox Provider
+
+	// cache, when set, keeps the location of the node and the prefixes of the providers in a file, used when they
+	// can't be discovered at setup.
+	cache *mapCache
+
+	// retry configures retrying failed discovery in the background until it succeeds.
+	retry *retryOptions
+}
+
+// watches reports whether any source updating the zones at runtime is configured.
+func (o *options) watches() bool {
+	return slices.ContainsFunc(o.providers, func(p namedProvider) bool {
+		_, ok := p.provider.(Watcher)
+		return ok
+	})
+}
+
+// regional reports whether any of the providers places prefixes below their region.
+func (o *options) regional() bool {
+	return slices.ContainsFunc(o.providers, func(p namedProvider) bool {
+		r, ok := p.provider.(regionalProvider)
+		return ok && r.regional()
+	})
+}
+
+// providerNames returns the names of the providers in order of precedence.
+func (o *options) providerNames() []string {
+	names := make([]string, 0, len(o.providers))
+	for _, p := range o.providers {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+// hasProvider reports whether a provider directive lists name.
+func (o *options) hasProvider(name string) bool {
+	return slices.Contains(o.providerNames(), name)
+}
+
+// resolveProviders completes the providers once the block is parsed. Without provider directives the node is
+// located with EC2 IMDSv2, ECS task metadata, the providers enabled by their options and the AWS_ZONE_ID environment
+// variable, in that order. With provider directives the providers enabled by options and not listed are added last.
+func (o *options) resolveProviders() {
+	explicit := len(o.providers) > 0
+	if !explicit {
+		o.providers = []namedProvider{defaultProvider("aws"), defaultProvider("ecs")}
+	}
+	if o.kubernetesNode != nil && !o.hasProvider("kubernetes_node") {
+		o.providers = append(o.providers, namedProvider{name: "kubernetes_node", provider: o.kubernetesNode})
+	}
+	if o.gcp != nil && !o.hasProvider("gcp") {
+		o.providers = append(o.providers, namedProvider{name: "gcp", provider: o.gcp})
+	}
+	if o.azure != nil && !o.hasProvider("azure") {
+		o.providers = append(o.providers, namedProvider{name: "azure", provider: o.azure})
+	}
+	if o.netbox != nil && !o.hasProvider("netbox") {
+		o.providers = append(o.providers, namedProvider{name: "netbox", provider: o.netbox})
+	}
+	if !explicit {
+		o.providers = append(o.providers, defaultProvider("env"))
+	}
+	for _, p := range o.sources {
+		if !o.hasProvider(p.name) {
+			o.providers = append(o.providers, p)
 		}
 	}
 
-	if l.currentAvailabilityZoneId == "" {
-		log.Infof("No valid AWS Zone ID found from IMDSv2 or environment variable. Zoneawareness plugin will not be active.")
-		return nil
+	// Subnet filters apply to the discovered EC2 subnets wherever they are listed in the block.
+	for _, p := range o.providers {
+		switch p := p.provider.(type) {
+		case *awsProvider:
+			p.filter = o.subnetFilter
+		case *regionsProvider:
+			p.filter = o.subnetFilter
+		case *assumeRoleProvider:
+			p.filter = o.subnetFilter
+		}
 	}
+}
+
+// parse reads the zoneawareness directives of a server block.
+func parse(c *caddy.Controller) (*options, error) {
+	opts := &options{}
 
-	// Parse arguments from Corefile if present
 	for c.Next() {
 		args := c.RemainingArgs()
 
 		if len(args) >= 2 {
 			zoneName := args[0]
+			zone := staticZone{name: zoneName}
 
-			// If the zone name is not the current zone, skip adding it
-			// Should reduces lookup time
-			if zoneName != l.currentAvailabilityZoneId {
-				log.Infof("Zone %s ignored", zoneName)
-				continue
-			}
-
-			// Validate the zone name against the AWS Zone ID pattern
-			if !awsZoneIDPattern.MatchString(zoneName) {
-				log.Warningf("Invalid AWS Zone ID format for '%s'. Expected format like 'use2-az1'.", zoneName)
-				continue
-				// return plugin.Error("zoneawareness", c.Errf("invalid AWS Zone ID format for '%s'. Expected format like 'use2-az1'.", zoneName))
+			if strings.Contains(zoneName, "/") {
+				path, err := parseTopologyPath(zoneName)
+				if err != nil {
+					log.Warningf("Invalid topology path for zone '%s': %v", zoneName, err)
+					continue
+				}
+				zone.path = path
 			}
 
 			cidrArgs := args[1:] // All remaining arguments are potential CIDRs
@@ -154,40 +437,195 @@ func setup(c *caddy.Controller) error {
 					continue
 					//return plugin.Error("zoneawareness", c.Errf("invalid CIDR format for zone '%s': %v", zoneName, err))
 				}
+				zone.cidrs = append(zone.cidrs, cidr)
+			}
+			opts.zones = append(opts.zones, zone)
+		}
 
-				zone, exists := l.Zones[zoneName]
-				if !exists {
-					log.Infof("Adding new zone '%s'", zoneName)
-					zone = &Zone{}
-					l.Zones[zoneName] = zone
+		for c.NextBlock() {
+			switch c.Val() {
+			case "topology":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				path, err := parseTopologyPath(args[0])
+				if err != nil {
+					return nil, c.Errf("invalid topology '%s': %v", args[0], err)
+				}
+				opts.topology = path
+			case "provider":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				// Named like the option of the provider, so that e.g. two prefix lists don't collide and a source
+				// listed both here and as its option is only loaded once
+				p, err := newNamedProvider(args[0], args[1:])
+				if err != nil {
+					return nil, c.Errf("invalid provider: %v", err)
+				}
+				if opts.hasProvider(p.name) {
+					return nil, c.Errf("provider '%s' is listed twice", p.name)
+				}
+				opts.providers = append(opts.providers, p)
+			case "kubernetes_node":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return nil, c.ArgErr()
+				}
+				kubernetesNode, err := newProvider("kubernetes_node", args)
+				if err != nil {
+					return nil, c.Errf("invalid kubernetes_node: %v", err)
+				}
+				opts.kubernetesNode = kubernetesNode
+			case "kubernetes_endpoints", "kubernetes_pod_cidrs", "network_interfaces", "load_balancers", "vpc_endpoints",
+				"managed_services", "assume_role", "regions", "aws_ip_ranges", "prefix_list", "ipam_pools",
+				"file", "terraform_state", "url", "ssm_parameter", "s3_object":
+				option := c.Val()
+				p, err := newNamedProvider(option, c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid %s: %v", option, err)
+				}
+				if slices.ContainsFunc(opts.sources, func(s namedProvider) bool { return s.name == p.name }) {
+					return nil, c.Errf("%s is listed twice", p.name)
+				}
+				opts.sources = append(opts.sources, p)
+			case "subnet_include", "subnet_exclude":
+				option := c.Val()
+				matches, err := parseTagMatches(c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid %s: %v", option, err)
+				}
+				if opts.subnetFilter == nil {
+					opts.subnetFilter = &subnetFilter{}
+				}
+				if option == "subnet_include" {
+					opts.subnetFilter.include = append(opts.subnetFilter.include, matches...)
+				} else {
+					opts.subnetFilter.exclude = append(opts.subnetFilter.exclude, matches...)
+				}
+			case "gcp":
+				gcp, err := newProvider("gcp", c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid gcp: %v", err)
+				}
+				opts.gcp = gcp
+			case "azure":
+				azure, err := newProvider("azure", c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid azure: %v", err)
+				}
+				opts.azure = azure
+			case "netbox":
+				netbox, err := newProvider("netbox", c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid netbox: %v", err)
+				}
+				opts.netbox = netbox
+			case "cache":
+				cache, err := parseCacheOptions(c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid cache: %v", err)
+				}
+				opts.cache = cache
+			case "retry":
+				retry, err := parseRetryOptions(c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid retry: %v", err)
+				}
+				opts.retry = retry
+			case "subnet_zone_tag":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return nil, c.ArgErr()
+				}
+				if opts.subnetFilter == nil {
+					opts.subnetFilter = &subnetFilter{}
+				}
+				opts.subnetFilter.zoneTag = defaultZoneTag
+				if len(args) == 1 {
+					opts.subnetFilter.zoneTag = args[0]
 				}
-				zone.CIDRs = append(zone.CIDRs, cidr)
-				log.Infof("Added %s to zone '%s'", cidrStr, zoneName)
+			default:
+				return nil, c.Errf("unknown property '%s'", c.Val())
 			}
 		}
 	}
 
-	// Conditionally add the plugin to the chain.
-	if currentZoneData, ok := l.Zones[l.currentAvailabilityZoneId]; ok && len(currentZoneData.CIDRs) > 0 {
-		dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-			log.Infof("Plugin added for current zone '%s' with %d CIDR(s).", l.currentAvailabilityZoneId, len(currentZoneData.CIDRs))
-			l.HasSynced = true // Mark as synced now that it's successfully configured and being added
-			l.Next = next
-			for _, cidr := range currentZoneData.CIDRs {
-				log.Debugf("%s", cidr.String())
+	if opts.retry == nil {
+		opts.retry = &retryOptions{initial: defaultRetryInitial, max: defaultRetryMax}
+	}
+	opts.resolveProviders()
+	return opts, nil
+}
+
+// parseTopologyPath splits a slash separated topology path such as "eu-central-1/euc1-az1/rack12" into its labels.
+func parseTopologyPath(s string) ([]string, error) {
+	labels := strings.Split(s, "/")
+	for _, label := range labels {
+		if label == "" {
+			return nil, fmt.Errorf("empty label in path '%s'", s)
+		}
+	}
+	return labels, nil
+}
+
+// localStaticZones returns the zones parsed from the Corefile that apply to the node. Bare zone names must be valid
+// AWS Zone IDs and are only kept for the current zone and its parent zones, zones written as a topology path are
+// always kept.
+func (e *Zoneawareness) localStaticZones(zones []staticZone) []staticZone {
+	var local []staticZone
+	for _, sz := range zones {
+		if sz.path == nil {
+			// If the zone name is not the current zone or one of its parent zones, skip adding it
+			// Should reduces lookup time
+			if !slices.Contains(e.parentChain(e.currentAvailabilityZoneId), sz.name) {
+				log.Infof("Zone %s ignored", sz.name)
+				continue
 			}
-			return l
-		})
-	} else {
-		log.Infof("Zoneawareness plugin NOT added: No CIDRs were configured or found for the current operational zone '%s'.", l.currentAvailabilityZoneId)
+
+			// Validate the zone name against the AWS Zone ID pattern
+			if !awsZoneIDPattern.MatchString(sz.name) {
+				log.Warningf("Invalid AWS Zone ID format for '%s'. Expected format like 'use2-az1'.", sz.name)
+				continue
+				// return plugin.Error("zoneawareness", c.Errf("invalid AWS Zone ID format for '%s'. Expected format like 'use2-az1'.", zoneName))
+			}
+		}
+
+		for _, cidr := range sz.cidrs {
+			log.Infof("Added %s to zone '%s'", cidr.String(), sz.name)
+		}
+		local = append(local, sz)
 	}
-	return nil
+	return local
 }
 
-var (
-	getConfigFromIMDSv2Func = getConfigFromIMDSv2
-	getSubnetsFromEC2Func   = getSubnetsFromEC2
-)
+// subnetLabel names a subnet in log messages, including the account owning it if known.
+func subnetLabel(subnet types.Subnet) string {
+	if subnet.OwnerId == nil {
+		return "subnet " + aws.ToString(subnet.SubnetId)
+	}
+	return fmt.Sprintf("subnet %s in account %s", aws.ToString(subnet.SubnetId), *subnet.OwnerId)
+}
+
+// rankable returns the number of CIDRs and addresses in zones that share at least one topology level with the
+// local node.
+func (e *Zoneawareness) rankable() int {
+	local := e.localPath()
+	n := 0
+	for name, zone := range e.Zones {
+		if sharedLevels(e.zonePath(name), local) > 0 {
+			n += len(zone.CIDRs)
+		}
+	}
+	for _, name := range e.hosts {
+		if sharedLevels(e.zonePath(name), local) > 0 {
+			n++
+		}
+	}
+	return n
+}
 
 // getConfigFromIMDSv2 fetches the availability zone from AWS EC2 IMDSv2.
 func getConfigFromIMDSv2() (string, string, error) {
@@ -245,6 +683,20 @@ func getConfigFromIMDSv2() (string, string, error) {
 
 // getSubnetsFromEC2 fetches subnets from the AWS EC2 API, filtered by Availability Zone ID.
 func getSubnetsFromEC2(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+	subnets, err := describeSubnets(ctx, region, []types.Filter{
+		{
+			Name:   aws.String("availability-zone-id"),
+			Values: []string{azID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe subnets for AZ ID '%s': %w", azID, err)
+	}
+	return subnets, nil
+}
+
+// describeSubnets fetches the subnets in region matching filters from the AWS EC2 API.
+func describeSubnets(ctx context.Context, region string, filters []types.Filter) ([]types.Subnet, error) {
 	// Load default AWS configuration. This will automatically try to use IMDS for credentials and region.
 	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
 	if err != nil {
@@ -254,18 +706,97 @@ func getSubnetsFromEC2(ctx context.Context, azID string, region string) ([]types
 	// Create an EC2 client
 	ec2Client := ec2.NewFromConfig(cfg)
 
-	// Describe subnets, filtering by the provided Availability Zone ID
-	output, err := ec2Client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
-		Filters: []types.Filter{
-			{
-				Name:   aws.String("availability-zone-id"),
-				Values: []string{azID},
-			},
-		},
+	var subnets []types.Subnet
+	paginator := ec2.NewDescribeSubnetsPaginator(ec2Client, &ec2.DescribeSubnetsInput{Filters: filters})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, page.Subnets...)
+	}
+	return subnets, nil
+}
+
+// zoneIDFunc translates an availability zone name in region to its zone ID, like getZoneIDFromEC2.
+type zoneIDFunc func(ctx context.Context, zoneName string, region string) (string, error)
+
+// getZoneIDFromEC2 translates an Availability Zone name such as "us-east-1a", which differs between accounts,
+// to its Zone ID such as "use1-az1".
+func getZoneIDFromEC2(ctx context.Context, zoneName string, region string) (string, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return "", fmt.Errorf("failed to load AWS SDK config: %w", err)
+	}
+
+	ec2Client := ec2.NewFromConfig(cfg)
+
+	output, err := ec2Client.DescribeAvailabilityZones(ctx, &ec2.DescribeAvailabilityZonesInput{
+		ZoneNames: []string{zoneName},
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to describe subnets for AZ ID '%s': %w", azID, err)
+		return "", fmt.Errorf("failed to describe availability zone '%s': %w", zoneName, err)
+	}
+	if len(output.AvailabilityZones) == 0 || output.AvailabilityZones[0].ZoneId == nil {
+		return "", fmt.Errorf("availability zone '%s' not found in region '%s'", zoneName, region)
 	}
 
-	return output.Subnets, nil
+	return *output.AvailabilityZones[0].ZoneId, nil
+}
+
+const (
+	// zoneResolveTimeout bounds a single translation of a zone name to its zone ID.
+	zoneResolveTimeout = 5 * time.Second
+	// zoneResolveRetryInterval is how long a zone name that couldn't be translated is used as is before asking again.
+	zoneResolveRetryInterval = time.Minute
+)
+
+// zoneResolver translates availability zone names, as found in Kubernetes labels or ELB descriptions, to zone IDs.
+// Translations are remembered. Names that can't be translated are used as they are, and translated again once
+// zoneResolveRetryInterval has passed.
+type zoneResolver struct {
+	region string
+	zoneID zoneIDFunc
+
+	mu     sync.Mutex
+	ids    map[string]string
+	failed map[string]time.Time // when a name that couldn't be translated is asked about again
+}
+
+func newZoneResolver(region string, zoneID zoneIDFunc) *zoneResolver {
+	return &zoneResolver{region: region, zoneID: zoneID, ids: make(map[string]string), failed: make(map[string]time.Time)}
+}
+
+// resolve returns the zone ID of zone. The EC2 API is called without holding the lock, so lookups of other zones
+// aren't blocked while it is slow.
+func (r *zoneResolver) resolve(ctx context.Context, zone string) string {
+	if awsZoneIDPattern.MatchString(zone) || r.region == "" {
+		return zone
+	}
+
+	r.mu.Lock()
+	id, ok := r.ids[zone]
+	retryAt, failed := r.failed[zone]
+	r.mu.Unlock()
+	if ok {
+		return id
+	}
+	if failed && time.Now().Before(retryAt) {
+		return zone
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, zoneResolveTimeout)
+	defer cancel()
+	azID, err := r.zoneID(ctx, zone, r.region)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		log.Warningf("Could not translate zone '%s' to a zone ID, using it as is: %v", zone, err)
+		r.failed[zone] = time.Now().Add(zoneResolveRetryInterval)
+		return zone
+	}
+	delete(r.failed, zone)
+	r.ids[zone] = azID
+	return azID
 }
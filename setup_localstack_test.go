@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +14,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 )
@@ -50,19 +54,14 @@ func TestSetupWithLocalStack(t *testing.T) {
 
 	// --- Mock Dependencies & Run Plugin Setup ---
 
-	// 1. Mock the IMDS call to return our test AZ and Region
-	originalIMDSFunc := getConfigFromIMDSv2Func
-	getConfigFromIMDSv2Func = func() (string, string, error) {
-		return azID, region, nil
-	}
-	// 2. Ensure the real EC2 function is used
-	originalEC2Func := getSubnetsFromEC2Func
-	getSubnetsFromEC2Func = getSubnetsFromEC2
+	// Mock the IMDS call to return our test AZ and Region, and keep the real EC2 function
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) {
+			return azID, region, nil
+		}
+	})
 
 	t.Cleanup(func() {
-		// Restore original functions after the test
-		getConfigFromIMDSv2Func = originalIMDSFunc
-		getSubnetsFromEC2Func = originalEC2Func
 		// Clean up AWS resources from LocalStack
 		cleanupVPCAndSubnet(context.Background(), t, ec2Client, vpcID, subnetID)
 	})
@@ -166,17 +165,13 @@ func TestSetupWithLocalStack_MultiAZ(t *testing.T) {
 	ignoredSubnet3ID := setupSubnet(ctx, t, ec2Client, vpc3ID, "2001:db8:1:2::/64", otherAZ1, true)
 
 	// --- Mock Dependencies & Run Plugin Setup ---
-	originalIMDSFunc := getConfigFromIMDSv2Func
-	getConfigFromIMDSv2Func = func() (string, string, error) {
-		return executionAZ, region, nil
-	}
-	originalEC2Func := getSubnetsFromEC2Func
-	getSubnetsFromEC2Func = getSubnetsFromEC2
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) {
+			return executionAZ, region, nil
+		}
+	})
 
 	t.Cleanup(func() {
-		getConfigFromIMDSv2Func = originalIMDSFunc
-		getSubnetsFromEC2Func = originalEC2Func
-
 		cleanupCtx := context.Background()
 		// Cleanup is LIFO: subnets first, then VPCs
 		cleanupSubnet(cleanupCtx, t, ec2Client, subnet1ID)
@@ -291,6 +286,75 @@ func newLocalStackEC2Client(ctx context.Context, region string) (*ec2.Client, er
 	return client, nil
 }
 
+// TestAWSMapsWithLocalStack loads a zone map from an SSM SecureString parameter and an S3 object in LocalStack,
+// using the endpoint override of the ssm_parameter and s3_object options.
+func TestAWSMapsWithLocalStack(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode.")
+	}
+
+	const (
+		region   = "us-east-1"
+		endpoint = "http://localhost:4566"
+		bucket   = "zoneawareness-maps"
+		key      = "prod/map.yaml"
+		param    = "/zoneawareness/prod/map"
+		document = "zones:\n  use1-az1:\n    cidrs: [10.0.0.0/16]\n"
+	)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		t.Fatalf("Failed to load AWS SDK config: %v", err)
+	}
+	ssmClient := ssm.NewFromConfig(cfg, func(o *ssm.Options) { o.BaseEndpoint = aws.String(endpoint) })
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+		o.UsePathStyle = true
+	})
+
+	_, err = ssmClient.PutParameter(ctx, &ssm.PutParameterInput{Name: aws.String(param), Value: aws.String(document), Type: ssmtypes.ParameterTypeSecureString, Overwrite: aws.Bool(true)})
+	if err != nil {
+		t.Fatalf("LocalStack not reachable or SSM not enabled: %v", err)
+	}
+	if _, err := s3Client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	if _, err := s3Client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(key), Body: strings.NewReader(document)}); err != nil {
+		t.Fatalf("Failed to put object: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		ssmClient.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(param)})
+		s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		s3Client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+	})
+
+	for _, m := range []awsMap{
+		{option: "ssm_parameter", name: param, endpoint: endpoint},
+		{option: "s3_object", name: "s3://" + bucket + "/" + key, endpoint: endpoint},
+	} {
+		load, err := m.loader(region)
+		if err != nil {
+			t.Fatalf("Failed to create the loader of %s: %v", m.source(), err)
+		}
+		prefixes, changed, err := load(ctx)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", m.source(), err)
+		}
+		if !changed || len(prefixes) != 1 || prefixes[0].Zone != "use1-az1" || prefixes[0].Prefix.String() != "10.0.0.0/16" {
+			t.Errorf("Unexpected map from %s: %v", m.source(), prefixes)
+		}
+		if _, changed, err := load(ctx); err != nil || changed {
+			t.Errorf("Expected %s not to be loaded again, got %t, %v", m.source(), changed, err)
+		}
+	}
+}
+
 // setupVPCAndSubnet creates a VPC and a subnet in LocalStack.
 func setupVPCAndSubnet(ctx context.Context, t *testing.T, client *ec2.Client, vpcCIDR, subnetCIDR, azID string) (string, string) {
 	t.Helper()
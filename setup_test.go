@@ -3,6 +3,8 @@ package zoneawareness
 import (
 	"context"
 	"errors"
+	"maps"
+	"net"
 	"strings"
 	"testing"
 
@@ -12,46 +14,151 @@ import (
 	"github.com/coredns/coredns/core/dnsserver"
 )
 
-// setupTest replaces the external dependency functions with mocks for the duration of a test.
-func setupTest(t *testing.T) {
-	// Store original functions
-	origIMDS := getConfigFromIMDSv2
-	origEC2 := getSubnetsFromEC2
-
-	// Set default mock behavior
-	getConfigFromIMDSv2Func = func() (string, string, error) {
-		return "", "", errors.New("IMDS not available in test")
+// patchProvider wraps the factory registered as name for the duration of a test, so that patch can replace the
+// dependencies of every provider it creates, e.g. the AWS APIs with mocks. The test gets its own copy of the registry,
+// so the registered factories are left untouched and restored when it ends.
+func patchProvider[P Provider](t *testing.T, name string, patch func(P)) {
+	t.Helper()
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	factory, ok := providerFactories[name]
+	if !ok {
+		t.Fatalf("Provider %s is not registered", name)
 	}
-	getSubnetsFromEC2Func = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
-		return nil, errors.New("EC2 not available in test")
+	registered := providerFactories
+	providerFactories = maps.Clone(registered)
+	providerFactories[name] = func(args []string) (Provider, error) {
+		p, err := factory(args)
+		if err == nil {
+			patch(p.(P))
+		}
+		return p, err
 	}
-
-	// The t.Cleanup function registers a function to be called when the test
-	// and all its subtests complete. This is a perfect way to ensure our
-	// original functions are restored.
 	t.Cleanup(func() {
-		getConfigFromIMDSv2Func = origIMDS
-		getSubnetsFromEC2Func = origEC2
+		providersMu.Lock()
+		defer providersMu.Unlock()
+		providerFactories = registered
 	})
 }
 
-func TestSetup(t *testing.T) {
-	// Store original functions before any tests run
-	origIMDS := getConfigFromIMDSv2Func
-	origEC2 := getSubnetsFromEC2Func
+// startTestWatchers starts the sources of corefile that update the zones at runtime for za and the node at loc, as the
+// server does once it started, until the test ends. Sources loading periodically have loaded once when it returns.
+func startTestWatchers(t *testing.T, corefile string, za *Zoneawareness, loc Location) {
+	t.Helper()
+	opts, err := parse(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	opts.startWatchers(ctx, za, loc)
+}
 
-	// Restore original functions when all tests in this file are done
-	t.Cleanup(func() {
-		getConfigFromIMDSv2Func = origIMDS
-		getSubnetsFromEC2Func = origEC2
+// setupTest replaces the external dependencies of the providers with mocks failing as if they were unreachable, for
+// the duration of a test.
+func setupTest(t *testing.T) {
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) {
+			return "", "", errors.New("IMDS not available in test")
+		}
+		p.getSubnetID = func() (string, error) {
+			return "", errors.New("IMDS not available in test")
+		}
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return nil, errors.New("EC2 not available in test")
+		}
+		p.getParentZones = func(ctx context.Context, region string) (map[string]string, error) {
+			return nil, errors.New("EC2 not available in test")
+		}
+	})
+	patchProvider(t, "ecs", func(p *ecsProvider) {
+		p.getConfig = func(zoneID zoneIDFunc) (string, string, []types.Subnet, error) {
+			return "", "", nil, errors.New("ECS not available in test")
+		}
+	})
+	patchProvider(t, "kubernetes_node", func(p *kubernetesNodeProvider) {
+		p.getConfig = func(label string, newClient func() (*kubeClient, error), zoneID zoneIDFunc) (Location, error) {
+			return Location{}, errors.New("Kubernetes not available in test")
+		}
+	})
+	patchProvider(t, "network_interfaces", func(p *eniProvider) {
+		p.getInterfaces = func(ctx context.Context, region string, opts *eniOptions) ([]types.NetworkInterface, error) {
+			return nil, errors.New("EC2 not available in test")
+		}
+	})
+	patchProvider(t, "load_balancers", func(p *loadBalancerProvider) {
+		p.getAddresses = func(ctx context.Context, region string, vpcIDs []string, zoneID zoneIDFunc) ([]zonalAddress, error) {
+			return nil, errors.New("ELB not available in test")
+		}
 	})
+	patchProvider(t, "vpc_endpoints", func(p *vpcEndpointProvider) {
+		p.getAddresses = func(ctx context.Context, region string, vpcIDs []string) ([]zonalAddress, error) {
+			return nil, errors.New("EC2 not available in test")
+		}
+	})
+	patchProvider(t, "managed_services", func(p *managedProvider) {
+		p.getVPCID = func() (string, error) {
+			return "", errors.New("IMDS not available in test")
+		}
+		p.getAddresses = func(ctx context.Context, region string, vpcID string, services []string, zoneID zoneIDFunc, lookupNetIP lookupNetIPFunc) ([]zonalAddress, error) {
+			return nil, errors.New("managed services not available in test")
+		}
+	})
+	patchProvider(t, "assume_role", func(p *assumeRoleProvider) {
+		p.getSubnets = func(ctx context.Context, azID string, region string, role assumeRole) ([]types.Subnet, error) {
+			return nil, errors.New("STS not available in test")
+		}
+	})
+	patchProvider(t, "regions", func(p *regionsProvider) {
+		p.getParentZones = func(ctx context.Context, region string) (map[string]string, error) {
+			return nil, errors.New("EC2 not available in test")
+		}
+		p.getSubnets = func(ctx context.Context, region string) ([]types.Subnet, error) {
+			return nil, errors.New("EC2 not available in test")
+		}
+	})
+	patchProvider(t, "ipam_pools", func(p *ipamProvider) {
+		p.getAllocations = func(ctx context.Context, region string, opts *ipamOptions, zoneID zoneIDFunc) ([]zonalCIDR, error) {
+			return nil, errors.New("IPAM not available in test")
+		}
+	})
+	patchProvider(t, "prefix_list", func(p *prefixListProvider) {
+		p.getList = func(ctx context.Context, region string, id string, since int64) (int64, []*net.IPNet, error) {
+			return 0, nil, errors.New("EC2 not available in test")
+		}
+	})
+	patchProvider(t, "gcp", func(p *gcpProvider) {
+		p.getConfig = func() (string, string, error) {
+			return "", "", errors.New("GCP metadata server not available in test")
+		}
+		p.getAddresses = func(ctx context.Context, opts *gcpOptions) ([]zonalAddress, []zonalCIDR, error) {
+			return nil, nil, errors.New("GCP not available in test")
+		}
+	})
+	patchProvider(t, "azure", func(p *azureProvider) {
+		p.getConfig = func() (*azureInstance, error) {
+			return nil, errors.New("Azure IMDS not available in test")
+		}
+		p.getAddresses = func(ctx context.Context, instance *azureInstance, opts *azureOptions) ([]zonalAddress, error) {
+			return nil, errors.New("Azure not available in test")
+		}
+	})
+	patchProvider(t, "netbox", func(p *netboxProvider) {
+		p.getPrefixes = func(ctx context.Context, opts *netboxOptions) ([]Prefix, error) {
+			return nil, errors.New("NetBox not available in test")
+		}
+	})
+}
 
+func TestSetup(t *testing.T) {
 	tests := []struct {
 		name          string
 		corefile      string
 		awsZoneIDEnv  string // To mock os.Getenv("AWS_ZONE_ID")
 		mockIMDS      func() (string, string, error)
 		mockEC2       func(ctx context.Context, azID string, region string) ([]types.Subnet, error)
+		mockECS       func() (string, string, []types.Subnet, error)
+		mockKubeNode  func(label string) (Location, error)
 		expectedErr   string
 		expectPlugin  bool
 		expectedCIDRs []string
@@ -138,6 +245,73 @@ func TestSetup(t *testing.T) {
 				"10.0.2.0/24",
 			},
 		},
+		{
+			name:     "No IMDS, ECS task metadata and EC2 discovery are combined",
+			corefile: `zoneawareness`,
+			mockIMDS: func() (string, string, error) { return "", "", errors.New("no imds") },
+			mockECS: func() (string, string, []types.Subnet, error) {
+				return "use1-az1", "us-east-1", []types.Subnet{
+					{SubnetId: aws.String("ecs-task"), CidrBlock: aws.String("10.0.1.0/24")},
+				}, nil
+			},
+			mockEC2: func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+				return []types.Subnet{
+					{SubnetId: aws.String("subnet-1"), CidrBlock: aws.String("10.0.1.0/24")},
+					{SubnetId: aws.String("subnet-2"), CidrBlock: aws.String("10.0.3.0/24")},
+				}, nil
+			},
+			expectPlugin: true,
+			expectedCIDRs: []string{
+				"10.0.1.0/24",
+				"10.0.3.0/24",
+			},
+		},
+		{
+			name:         "ECS task metadata takes precedence over AWS_ZONE_ID",
+			corefile:     `zoneawareness use1-az2 10.0.2.0/24`,
+			awsZoneIDEnv: "use1-az1",
+			mockIMDS:     func() (string, string, error) { return "", "", errors.New("no imds") },
+			mockECS: func() (string, string, []types.Subnet, error) {
+				return "use1-az2", "us-east-1", nil, nil
+			},
+			expectPlugin: true,
+			expectedCIDRs: []string{
+				"10.0.2.0/24",
+			},
+		},
+		{
+			name:     "No IMDS, Kubernetes node labels with custom label",
+			corefile: "zoneawareness use1-az3 10.0.3.0/24 {\n\tkubernetes_node example.com/zone-id\n}",
+			mockIMDS: func() (string, string, error) { return "", "", errors.New("no imds") },
+			mockKubeNode: func(label string) (Location, error) {
+				if label != "example.com/zone-id" {
+					return Location{}, errors.New("unexpected label " + label)
+				}
+				return Location{Zone: "use1-az3", Region: "us-east-1", Cloud: CloudAWS}, nil
+			},
+			mockEC2: func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+				return []types.Subnet{{SubnetId: aws.String("subnet-3"), CidrBlock: aws.String("10.0.4.0/24")}}, nil
+			},
+			expectPlugin: true,
+			expectedCIDRs: []string{
+				"10.0.4.0/24",
+				"10.0.3.0/24",
+			},
+		},
+		{
+			name:     "Kubernetes node labels are not read unless enabled",
+			corefile: `zoneawareness use1-az3 10.0.3.0/24`,
+			mockIMDS: func() (string, string, error) { return "", "", errors.New("no imds") },
+			mockKubeNode: func(label string) (Location, error) {
+				return Location{Zone: "use1-az3", Region: "us-east-1", Cloud: CloudAWS}, nil
+			},
+			expectPlugin: false,
+		},
+		{
+			name:        "Kubernetes node with too many arguments",
+			corefile:    "zoneawareness {\n\tkubernetes_node a b\n}",
+			expectedErr: "Wrong argument count",
+		},
 		{
 			name:         "Empty config block, no IMDS, no env var",
 			corefile:     `zoneawareness`,
@@ -173,11 +347,25 @@ func TestSetup(t *testing.T) {
 			setupTest(t) // Setup mocks
 
 			// Apply test-case specific mocks
-			if tc.mockIMDS != nil {
-				getConfigFromIMDSv2Func = tc.mockIMDS
+			patchProvider(t, "aws", func(p *awsProvider) {
+				if tc.mockIMDS != nil {
+					p.getConfig = tc.mockIMDS
+				}
+				if tc.mockEC2 != nil {
+					p.getSubnets = tc.mockEC2
+				}
+			})
+			if tc.mockECS != nil {
+				patchProvider(t, "ecs", func(p *ecsProvider) {
+					p.getConfig = func(zoneIDFunc) (string, string, []types.Subnet, error) { return tc.mockECS() }
+				})
 			}
-			if tc.mockEC2 != nil {
-				getSubnetsFromEC2Func = tc.mockEC2
+			if tc.mockKubeNode != nil {
+				patchProvider(t, "kubernetes_node", func(p *kubernetesNodeProvider) {
+					p.getConfig = func(label string, newClient func() (*kubeClient, error), zoneID zoneIDFunc) (Location, error) {
+						return tc.mockKubeNode(label)
+					}
+				})
 			}
 			if tc.awsZoneIDEnv != "" {
 				t.Setenv("AWS_ZONE_ID", tc.awsZoneIDEnv)
@@ -217,8 +405,9 @@ func TestSetup(t *testing.T) {
 			}
 
 			if !tc.expectPlugin {
-				if za != nil {
-					t.Fatal("Expected no plugin to be added, but it was")
+				// Failed discovery is retried in the background, with the plugin added but not ready meanwhile
+				if za != nil && (za.Ready() || za.rankable() > 0) {
+					t.Fatal("Expected no active plugin to be added, but it was")
 				}
 				return // Test finished
 			}
@@ -251,3 +440,245 @@ func TestSetup(t *testing.T) {
 		})
 	}
 }
+
+func TestSetupOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		corefile      string
+		mockIMDS      func() (string, string, error)
+		expectedErr   string
+		expectPlugin  bool
+		expectedPaths map[string]string // zone name -> topology path
+	}{
+		{
+			name: "On-prem topology without AWS zone",
+			corefile: `zoneawareness dc1/rack1 10.1.0.0/24
+zoneawareness dc1/rack2 10.2.0.0/24 {
+	topology dc1/rack1/host7
+}`,
+			expectPlugin: true,
+			expectedPaths: map[string]string{
+				"dc1/rack1": "dc1/rack1",
+				"dc1/rack2": "dc1/rack2",
+			},
+		},
+		{
+			name: "Bare current zone is placed in the topology",
+			corefile: `zoneawareness use1-az1 10.0.0.0/24
+zoneawareness us-east-1/use1-az2 10.1.0.0/24 {
+	topology us-east-1/use1-az1/rack4
+}`,
+			mockIMDS:     func() (string, string, error) { return "use1-az1", "us-east-1", nil },
+			expectPlugin: true,
+			expectedPaths: map[string]string{
+				"use1-az1":           "us-east-1/use1-az1",
+				"us-east-1/use1-az2": "us-east-1/use1-az2",
+			},
+		},
+		{
+			name:         "Topology sharing nothing with configured zones",
+			corefile:     "zoneawareness dc2/rack1 10.1.0.0/24 {\n\ttopology dc1/rack1\n}",
+			expectPlugin: false,
+		},
+		{
+			name:        "Topology with empty label",
+			corefile:    "zoneawareness {\n\ttopology dc1//rack1\n}",
+			expectedErr: "empty label",
+		},
+		{
+			name:        "Topology without argument",
+			corefile:    "zoneawareness {\n\ttopology\n}",
+			expectedErr: "Wrong argument count",
+		},
+		{
+			name:         "Kubernetes endpoints activate the plugin without CIDRs",
+			corefile:     "zoneawareness {\n\tkubernetes_endpoints endpointslices pods\n}",
+			mockIMDS:     func() (string, string, error) { return "use1-az1", "us-east-1", nil },
+			expectPlugin: true,
+		},
+		{
+			name:         "Kubernetes pod CIDRs activate the plugin without CIDRs",
+			corefile:     "zoneawareness {\n\tkubernetes_pod_cidrs\n}",
+			mockIMDS:     func() (string, string, error) { return "use1-az1", "us-east-1", nil },
+			expectPlugin: true,
+		},
+		{
+			name:        "Kubernetes pod CIDRs with arguments",
+			corefile:    "zoneawareness {\n\tkubernetes_pod_cidrs nodes\n}",
+			expectedErr: "invalid kubernetes_pod_cidrs: expected no arguments",
+		},
+		{
+			name:        "Kubernetes endpoints with unknown source",
+			corefile:    "zoneawareness {\n\tkubernetes_endpoints services\n}",
+			expectedErr: "invalid kubernetes_endpoints: unknown source 'services'",
+		},
+		{
+			name:        "Managed services with unknown service",
+			corefile:    "zoneawareness {\n\tmanaged_services dynamodb\n}",
+			expectedErr: "invalid managed_services: unknown service 'dynamodb'",
+		},
+		{
+			name:        "Assume role without ARN",
+			corefile:    "zoneawareness {\n\tassume_role\n}",
+			expectedErr: "missing role ARN",
+		},
+		{
+			name:        "Assume role with a user ARN",
+			corefile:    "zoneawareness {\n\tassume_role arn:aws:iam::123456789012:user/bob\n}",
+			expectedErr: "is not an IAM role ARN",
+		},
+		{
+			name:        "Assume role with unknown argument",
+			corefile:    "zoneawareness {\n\tassume_role arn:aws:iam::123456789012:role/dns duration=1h\n}",
+			expectedErr: "unknown argument 'duration'",
+		},
+		{
+			name:        "AWS IP ranges with invalid interval",
+			corefile:    "zoneawareness {\n\taws_ip_ranges /etc/ip-ranges.json soon\n}",
+			expectedErr: "invalid aws_ip_ranges",
+		},
+		{
+			name:         "Prefix lists activate the plugin without CIDRs",
+			corefile:     "zoneawareness {\n\tprefix_list pl-0123456789abcdef0 onprem/dc1\n}",
+			mockIMDS:     func() (string, string, error) { return "use1-az1", "us-east-1", nil },
+			expectPlugin: true,
+		},
+		{
+			name:        "Prefix list without zone",
+			corefile:    "zoneawareness {\n\tprefix_list pl-0123456789abcdef0\n}",
+			expectedErr: "invalid prefix_list",
+		},
+		{
+			name:        "Prefix list with invalid ID",
+			corefile:    "zoneawareness {\n\tprefix_list sg-0123456789abcdef0 use1-az1\n}",
+			expectedErr: "is not a prefix list ID",
+		},
+		{
+			name:        "Subnet include without tags",
+			corefile:    "zoneawareness {\n\tsubnet_include\n}",
+			expectedErr: "invalid subnet_include",
+		},
+		{
+			name:        "Subnet exclude with empty key",
+			corefile:    "zoneawareness {\n\tsubnet_exclude =tgw\n}",
+			expectedErr: "empty tag key",
+		},
+		{
+			name:        "Subnet zone tag with several keys",
+			corefile:    "zoneawareness {\n\tsubnet_zone_tag zone logical-zone\n}",
+			expectedErr: "Wrong argument count",
+		},
+		{
+			name:        "GCP with unknown argument",
+			corefile:    "zoneawareness {\n\tgcp instances\n}",
+			expectedErr: "invalid gcp",
+		},
+		{
+			name:        "Azure with unknown argument",
+			corefile:    "zoneawareness {\n\tazure tenant=abc\n}",
+			expectedErr: "invalid azure",
+		},
+		{
+			name:        "Map file without path",
+			corefile:    "zoneawareness {\n\tfile\n}",
+			expectedErr: "invalid file",
+		},
+		{
+			name:        "Map URL with unknown scheme",
+			corefile:    "zoneawareness {\n\turl ftp://ipam.example.com/zones.json\n}",
+			expectedErr: "invalid url",
+		},
+		{
+			name:        "NetBox with unknown zone field",
+			corefile:    "zoneawareness {\n\tnetbox https://netbox.example.com zone=tenant\n}",
+			expectedErr: "invalid netbox",
+		},
+		{
+			name:        "Terraform state with invalid interval",
+			corefile:    "zoneawareness {\n\tterraform_state terraform.tfstate soon\n}",
+			expectedErr: "invalid terraform_state",
+		},
+		{
+			name:        "S3 object without key",
+			corefile:    "zoneawareness {\n\ts3_object s3://zone-maps\n}",
+			expectedErr: "invalid s3_object",
+		},
+		{
+			name:        "Cache with invalid max age",
+			corefile:    "zoneawareness {\n\tcache /var/cache/zoneawareness.json max_age=-1h\n}",
+			expectedErr: "invalid cache",
+		},
+		{
+			name:        "Retry with initial delay over max",
+			corefile:    "zoneawareness {\n\tretry initial=10m max=1m\n}",
+			expectedErr: "invalid retry",
+		},
+		{
+			name:        "Unknown provider",
+			corefile:    "zoneawareness {\n\tprovider openstack\n}",
+			expectedErr: "unknown provider 'openstack'",
+		},
+		{
+			name:        "Provider listed twice",
+			corefile:    "zoneawareness {\n\tprovider aws\n\tprovider aws\n}",
+			expectedErr: "provider 'aws' is listed twice",
+		},
+		{
+			name:        "Provider source listed twice",
+			corefile:    "zoneawareness {\n\tprovider url https://example.com/zones.yaml\n\tprovider url https://example.com/zones.yaml\n}",
+			expectedErr: "provider 'url:https://example.com/zones.yaml' is listed twice",
+		},
+		{
+			name:        "Provider without name",
+			corefile:    "zoneawareness {\n\tprovider\n}",
+			expectedErr: "Wrong argument count",
+		},
+		{
+			name:        "Unknown property",
+			corefile:    "zoneawareness {\n\tbogus\n}",
+			expectedErr: "unknown property 'bogus'",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			setupTest(t)
+			if tc.mockIMDS != nil {
+				patchProvider(t, "aws", func(p *awsProvider) { p.getConfig = tc.mockIMDS })
+			}
+
+			c := caddy.NewTestController("dns", tc.corefile)
+			err := setup(c)
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Fatalf("Expected error containing '%s', but got: %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+
+			plugins := dnsserver.GetConfig(c).Plugin
+			if !tc.expectPlugin {
+				if len(plugins) != 0 {
+					t.Fatal("Expected no plugin to be added, but it was")
+				}
+				return
+			}
+			if len(plugins) == 0 {
+				t.Fatal("Expected plugin to be added, but it wasn't")
+			}
+			za := plugins[0](nil).(*Zoneawareness)
+
+			for name, expected := range tc.expectedPaths {
+				if _, ok := za.Zones[name]; !ok {
+					t.Fatalf("Expected zone '%s' to be configured", name)
+				}
+				if got := strings.Join(za.zonePath(name), "/"); got != expected {
+					t.Errorf("Expected zone '%s' to have path '%s', got '%s'", name, expected, got)
+				}
+			}
+		})
+	}
+}
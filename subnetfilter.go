@@ -0,0 +1,112 @@
+package zoneawareness
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// tagMatch matches a tag key, and the value unless anyValue is set.
+type tagMatch struct {
+	key      string
+	value    string
+	anyValue bool
+}
+
+// parseTagMatches parses KEY or KEY=VALUE arguments.
+func parseTagMatches(args []string) ([]tagMatch, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected at least one KEY or KEY=VALUE")
+	}
+	var matches []tagMatch
+	for _, arg := range args {
+		key, value, hasValue := strings.Cut(arg, "=")
+		if key == "" {
+			return nil, fmt.Errorf("empty tag key in '%s'", arg)
+		}
+		matches = append(matches, tagMatch{key: key, value: value, anyValue: !hasValue})
+	}
+	return matches, nil
+}
+
+// matches reports whether one of tags matches m.
+func (m tagMatch) matches(tags []types.Tag) bool {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == m.key && (m.anyValue || aws.ToString(tag.Value) == m.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m tagMatch) String() string {
+	if m.anyValue {
+		return m.key
+	}
+	return m.key + "=" + m.value
+}
+
+// subnetFilter selects the EC2 subnets that count by their tags, and optionally reads the zone of a subnet from a tag.
+type subnetFilter struct {
+	include []tagMatch // a subnet must match one of these, if any
+	exclude []tagMatch // a subnet matching one of these is skipped
+	zoneTag string     // tag overriding the zone of a subnet, if set
+
+	// skipped remembers the subnets already logged as skipped.
+	skipped map[string]bool
+}
+
+// apply groups subnets found in zoneName by the zone their CIDRs belong to, leaving out the subnets that don't count.
+// A nil filter keeps every subnet in zoneName.
+func (f *subnetFilter) apply(zoneName string, subnets []types.Subnet) map[string][]types.Subnet {
+	zones := make(map[string][]types.Subnet)
+	if f == nil {
+		zones[zoneName] = subnets
+		return zones
+	}
+
+	for _, subnet := range subnets {
+		if reason := f.skipReason(subnet); reason != "" {
+			id := aws.ToString(subnet.SubnetId)
+			if !f.skipped[id] {
+				if f.skipped == nil {
+					f.skipped = make(map[string]bool)
+				}
+				f.skipped[id] = true
+				log.Infof("Skipping %s: %s", subnetLabel(subnet), reason)
+			}
+			continue
+		}
+
+		zone := zoneName
+		if f.zoneTag != "" {
+			for _, tag := range subnet.Tags {
+				if aws.ToString(tag.Key) == f.zoneTag && aws.ToString(tag.Value) != "" {
+					zone = aws.ToString(tag.Value)
+				}
+			}
+		}
+		zones[zone] = append(zones[zone], subnet)
+	}
+	return zones
+}
+
+// skipReason returns why subnet does not count, or an empty string if it does.
+func (f *subnetFilter) skipReason(subnet types.Subnet) string {
+	for _, m := range f.exclude {
+		if m.matches(subnet.Tags) {
+			return fmt.Sprintf("excluded by tag %s", m)
+		}
+	}
+	if len(f.include) == 0 {
+		return ""
+	}
+	for _, m := range f.include {
+		if m.matches(subnet.Tags) {
+			return ""
+		}
+	}
+	return "no included tag"
+}
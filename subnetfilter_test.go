@@ -0,0 +1,104 @@
+package zoneawareness
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+// taggedSubnet returns a subnet with the given CIDR and KEY, VALUE tag pairs.
+func taggedSubnet(id, cidr string, tags ...string) types.Subnet {
+	subnet := types.Subnet{SubnetId: aws.String(id), CidrBlock: aws.String(cidr)}
+	for i := 0; i+1 < len(tags); i += 2 {
+		subnet.Tags = append(subnet.Tags, types.Tag{Key: aws.String(tags[i]), Value: aws.String(tags[i+1])})
+	}
+	return subnet
+}
+
+func TestSubnetFilter(t *testing.T) {
+	subnets := []types.Subnet{
+		taggedSubnet("subnet-app", "10.0.1.0/24", "tier", "app"),
+		taggedSubnet("subnet-tgw", "10.0.2.0/28", "tier", "app", "purpose", "tgw-attachment"),
+		taggedSubnet("subnet-fw", "10.0.3.0/28", "purpose", "firewall"),
+		taggedSubnet("subnet-mirror", "10.0.4.0/24", "tier", "app", "zoneawareness/zone", "onprem/dc1"),
+		taggedSubnet("subnet-untagged", "10.0.5.0/24"),
+	}
+
+	include, _ := parseTagMatches([]string{"tier=app", "purpose=firewall"})
+	exclude, _ := parseTagMatches([]string{"purpose=tgw-attachment"})
+	filter := &subnetFilter{include: include, exclude: exclude, zoneTag: defaultZoneTag}
+
+	ids := func(subnets []types.Subnet) []string {
+		var ids []string
+		for _, subnet := range subnets {
+			ids = append(ids, aws.ToString(subnet.SubnetId))
+		}
+		return ids
+	}
+
+	zones := filter.apply("use1-az1", subnets)
+	if len(zones) != 2 {
+		t.Errorf("Expected 2 zones, got %v", zones)
+	}
+	if got := ids(zones["use1-az1"]); !slices.Equal(got, []string{"subnet-app", "subnet-fw"}) {
+		t.Errorf("Unexpected subnets in the current zone: %v", got)
+	}
+	if got := ids(zones["onprem/dc1"]); !slices.Equal(got, []string{"subnet-mirror"}) {
+		t.Errorf("Unexpected subnets in the overridden zone: %v", got)
+	}
+	if len(filter.skipped) != 2 || !filter.skipped["subnet-tgw"] || !filter.skipped["subnet-untagged"] {
+		t.Errorf("Expected the skipped subnets to be remembered, got %v", filter.skipped)
+	}
+
+	// Without a zone tag, tagged subnets stay in their zone.
+	filter = &subnetFilter{}
+	if got := ids(filter.apply("use1-az1", subnets)["use1-az1"]); len(got) != len(subnets) {
+		t.Errorf("Expected all subnets to be kept, got %v", got)
+	}
+
+	var none *subnetFilter
+	if got := none.apply("use1-az1", subnets); len(got) != 1 || len(got["use1-az1"]) != len(subnets) {
+		t.Errorf("Expected a nil filter to keep all subnets, got %v", got)
+	}
+}
+
+func TestSetupSubnetFilter(t *testing.T) {
+	setupTest(t)
+	patchProvider(t, "aws", func(p *awsProvider) {
+		p.getConfig = func() (string, string, error) { return "use1-az1", "us-east-1", nil }
+		p.getSubnets = func(ctx context.Context, azID string, region string) ([]types.Subnet, error) {
+			return []types.Subnet{
+				taggedSubnet("subnet-app", "10.0.1.0/24", "Name", "app"),
+				taggedSubnet("subnet-tgw", "10.0.2.0/28", "Name", "tgw"),
+				taggedSubnet("subnet-mirror", "10.0.4.0/24", "logical-zone", "use1-az1/mirror"),
+			}, nil
+		}
+	})
+
+	c := caddy.NewTestController("dns", `zoneawareness {
+	topology use1-az1/mirror
+	subnet_exclude Name=tgw
+	subnet_zone_tag logical-zone
+}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	plugins := dnsserver.GetConfig(c).Plugin
+	if len(plugins) == 0 {
+		t.Fatal("Expected plugin to be added, but it wasn't")
+	}
+	za := plugins[0](nil).(*Zoneawareness)
+
+	for ip, expected := range map[string]int{"10.0.1.5": 1, "10.0.2.5": 0, "10.0.4.5": 2} {
+		if rank := za.rankIP(net.ParseIP(ip), za.localPath()); rank != expected {
+			t.Errorf("Expected %s to have rank %d, got %d", ip, expected, rank)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package zoneawareness
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+)
+
+// terraformState is the subset of a Terraform state file (format version 4) used by this plugin.
+// https://developer.hashicorp.com/terraform/internals/json-format
+type terraformState struct {
+	Version   int `json:"version"`
+	Resources []struct {
+		Module    string `json:"module"`
+		Mode      string `json:"mode"`
+		Type      string `json:"type"`
+		Name      string `json:"name"`
+		Instances []struct {
+			IndexKey   any `json:"index_key"`
+			Attributes struct {
+				ID                 string `json:"id"`
+				CIDRBlock          string `json:"cidr_block"`
+				IPv6CIDRBlock      string `json:"ipv6_cidr_block"`
+				AvailabilityZoneID string `json:"availability_zone_id"`
+			} `json:"attributes"`
+		} `json:"instances"`
+	} `json:"resources"`
+}
+
+// ParseTerraformState returns the IPv4 and IPv6 CIDRs of the aws_subnet resources in a Terraform state file, in the
+// zone of their availability_zone_id. Subnets without a zone ID are skipped.
+func ParseTerraformState(data []byte) ([]Prefix, error) {
+	var state terraformState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Version != 4 {
+		return nil, fmt.Errorf("unsupported state format version %d", state.Version)
+	}
+
+	var prefixes []Prefix
+	for _, resource := range state.Resources {
+		if resource.Mode != "managed" || resource.Type != "aws_subnet" {
+			continue
+		}
+		for _, instance := range resource.Instances {
+			address := resourceAddress(resource.Module, resource.Type, resource.Name, instance.IndexKey)
+			attributes := instance.Attributes
+			if attributes.AvailabilityZoneID == "" {
+				log.Debugf("Skipping %s without availability_zone_id", address)
+				continue
+			}
+			metadata := map[string]string{MetadataName: address, "subnet-id": attributes.ID}
+			for _, cidr := range []string{attributes.CIDRBlock, attributes.IPv6CIDRBlock} {
+				if cidr == "" {
+					continue
+				}
+				prefix, err := netip.ParsePrefix(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("invalid CIDR of %s: %w", address, err)
+				}
+				prefixes = append(prefixes, Prefix{Prefix: prefix, Zone: attributes.AvailabilityZoneID, Metadata: metadata})
+			}
+		}
+	}
+	return prefixes, nil
+}
+
+// resourceAddress returns the address of a resource instance as Terraform writes it, e.g.
+// module.vpc.aws_subnet.private["a"].
+func resourceAddress(module string, resourceType string, name string, indexKey any) string {
+	address := resourceType + "." + name
+	if module != "" {
+		address = module + "." + address
+	}
+	switch key := indexKey.(type) {
+	case string:
+		address += fmt.Sprintf("[%q]", key)
+	case float64:
+		address += fmt.Sprintf("[%d]", int(key))
+	}
+	return address
+}
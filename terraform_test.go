@@ -0,0 +1,96 @@
+package zoneawareness
+
+import (
+	"strings"
+	"testing"
+)
+
+const testTerraformState = `{
+  "version": 4,
+  "terraform_version": "1.9.5",
+  "resources": [
+    {
+      "module": "module.vpc",
+      "mode": "managed",
+      "type": "aws_subnet",
+      "name": "private",
+      "instances": [
+        {"index_key": 0, "attributes": {"id": "subnet-a", "cidr_block": "10.0.1.0/24", "ipv6_cidr_block": "2001:db8:0:1::/64", "availability_zone_id": "use1-az1"}},
+        {"index_key": 1, "attributes": {"id": "subnet-b", "cidr_block": "10.0.2.0/24", "ipv6_cidr_block": "", "availability_zone_id": "use1-az2"}}
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_subnet",
+      "name": "edge",
+      "instances": [
+        {"index_key": "bos", "attributes": {"id": "subnet-c", "cidr_block": "10.0.3.0/24", "availability_zone_id": "use1-bos1-az1"}},
+        {"attributes": {"id": "subnet-d", "cidr_block": "10.0.4.0/24", "availability_zone_id": ""}}
+      ]
+    },
+    {
+      "mode": "data",
+      "type": "aws_subnet",
+      "name": "shared",
+      "instances": [{"attributes": {"id": "subnet-e", "cidr_block": "10.9.0.0/24", "availability_zone_id": "use1-az1"}}]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_vpc",
+      "name": "main",
+      "instances": [{"attributes": {"id": "vpc-1", "cidr_block": "10.0.0.0/16"}}]
+    }
+  ]
+}`
+
+func TestParseTerraformState(t *testing.T) {
+	prefixes, err := ParseTerraformState([]byte(testTerraformState))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	expected := []struct{ prefix, zone, name string }{
+		{"10.0.1.0/24", "use1-az1", "module.vpc.aws_subnet.private[0]"},
+		{"2001:db8:0:1::/64", "use1-az1", "module.vpc.aws_subnet.private[0]"},
+		{"10.0.2.0/24", "use1-az2", "module.vpc.aws_subnet.private[1]"},
+		{"10.0.3.0/24", "use1-bos1-az1", `aws_subnet.edge["bos"]`},
+	}
+	if len(prefixes) != len(expected) {
+		t.Fatalf("Expected %d prefixes, got %v", len(expected), prefixes)
+	}
+	for i, e := range expected {
+		p := prefixes[i]
+		if p.Prefix.String() != e.prefix || p.Zone != e.zone || p.Metadata[MetadataName] != e.name {
+			t.Errorf("Expected %s in zone '%s' from %s, got %s in '%s' from %s", e.prefix, e.zone, e.name, p.Prefix, p.Zone, p.Metadata[MetadataName])
+		}
+	}
+
+	for _, data := range []string{`{"version": 3, "modules": []}`, `{"version": 4, "resources": [{"mode": "managed", "type": "aws_subnet", "name": "x", "instances": [{"attributes": {"cidr_block": "10.0.0.0/33", "availability_zone_id": "use1-az1"}}]}]}`, `{`} {
+		if _, err := ParseTerraformState([]byte(data)); err == nil {
+			t.Errorf("Expected an error for %s", data)
+		}
+	}
+}
+
+func TestMarshalZoneMap(t *testing.T) {
+	prefixes, err := ParseTerraformState([]byte(testTerraformState))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	data, err := MarshalZoneMap(prefixes)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !strings.Contains(string(data), "use1-az1:\n        cidrs:\n            - 10.0.1.0/24\n            - 2001:db8:0:1::/64\n") {
+		t.Errorf("Unexpected zone map:\n%s", data)
+	}
+
+	// The converted map reads back as the same prefixes.
+	converted, err := parseZoneMap(data)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(converted) != len(prefixes) {
+		t.Errorf("Expected %d prefixes, got %v", len(prefixes), converted)
+	}
+}
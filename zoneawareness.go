@@ -5,7 +5,12 @@ package zoneawareness
 
 import (
 	"context"
+	"maps"
 	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -14,20 +19,65 @@ import (
 	"github.com/miekg/dns"
 )
 
+// Zone is a set of CIDRs sharing one position in the topology.
 type Zone struct {
 	CIDRs []*net.IPNet
+	// Path is the topology path of the zone from the outermost level inwards, e.g. region, zone, rack and host.
+	// When empty the zone name is its only label.
+	Path []string
 }
 
 type Zoneawareness struct {
 	Next                      plugin.Handler
 	Zones                     map[string]*Zone
 	currentAvailabilityZoneId string
-	HasSynced                 bool
+	// topology is the path of the local node. When empty the current availability zone ID is used.
+	topology []string
+	// HasSynced is set once discovery completed. Discovery retried in the background sets it when it succeeds.
+	HasSynced bool
+	// passthrough makes the plugin ready before it synced, passing answers through unchanged until then.
+	passthrough bool
+	// parents maps Local Zones, Wavelength Zones and Outposts to the zone they are part of. Zones without a path
+	// of their own are placed in the topology below their parent.
+	parents map[string]string
+
+	mu sync.RWMutex
+	// rebuildMu serializes the rebuilds of Zones, hosts and index, which are built without holding mu so that
+	// lookups are only blocked while the result is swapped in.
+	rebuildMu sync.Mutex
+	// sources holds the prefixes of every source by name, and order the names of the sources in order of
+	// precedence. Zones, hosts and index are rebuilt from them and the Corefile zones in static whenever a source
+	// changes, so a CIDR or address reported by more than one source belongs to the zone the first of them reports.
+	sources map[string][]Prefix
+	order   []string
+	static  []staticZone
+	// regions maps zones to the region they are in, from the MetadataRegion of their prefixes.
+	regions map[string]string
+	// hosts maps single addresses to the name of their zone. An address found here is more specific than any CIDR.
+	hosts map[netip.Addr]string
+	// index maps the CIDRs of all zones to their topology paths. Zones that were not rebuilt from sources have no
+	// index and are scanned instead.
+	index *prefixIndex
+}
+
+// localPath returns the topology path of the node CoreDNS is running on.
+func (e *Zoneawareness) localPath() []string {
+	if len(e.topology) > 0 {
+		return e.topology
+	}
+	if e.currentAvailabilityZoneId == "" {
+		return nil
+	}
+	return []string{e.currentAvailabilityZoneId}
 }
 
 // ServeDNS implements the plugin.Handler interface. This method gets called when zoneawareness is used
 // in a Server.
-func (e Zoneawareness) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+func (e *Zoneawareness) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if e.passthrough && !e.synced() {
+		return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
+	}
+
 	pw := NewResponsePrinter(w)
 
 	rcode, err := plugin.NextOrFailure(e.Name(), e.Next, ctx, pw, r)
@@ -49,43 +99,48 @@ func (e Zoneawareness) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dn
 		return writeFinalResponse(w, pw.msg)
 	}
 
-	var preferredAnswers []dns.RR
-	var otherAnswers []dns.RR
-
-	// --- Start of reordering logzic to time ---
+	// --- Start of reordering logic to time ---
 	reorderTimeStart := time.Now()
 
-	for _, rr := range pw.msg.Answer {
+	e.mu.RLock()
+	local := e.localPath()
+	ranks := make([]int, len(pw.msg.Answer))
+	preferred := 0
+	for i, rr := range pw.msg.Answer {
 		ip := extractRRIP(rr)
-		if ip != nil && ipMatchesCIDRs(ip, e.Zones[e.currentAvailabilityZoneId].CIDRs) {
-			log.Debugf("Matched preferred IP %s in zone %s", ip, e.currentAvailabilityZoneId)
-			preferredAnswers = append(preferredAnswers, rr)
-		} else {
-			otherAnswers = append(otherAnswers, rr)
+		if ip == nil {
+			continue
+		}
+		if rank := e.rankIP(ip, local); rank > 0 {
+			log.Debugf("Matched preferred IP %s sharing %d level(s) with zone %s", ip, rank, strings.Join(local, "/"))
+			ranks[i] = rank
+			preferred++
 		}
 	}
+	e.mu.RUnlock()
 
 	// --- End of reordering logic to time ---
 	// We only record the latency it took to reorder the answers
 	reorderLatency.WithLabelValues(metrics.WithServer(ctx)).Observe(time.Since(reorderTimeStart).Seconds())
 
 	// If no preferred answers are found, return the original message
-	if len(preferredAnswers) == 0 {
-		log.Debugf("No preferred answers found in zone %s for query %+v (answer: %s)", e.currentAvailabilityZoneId, pw.msg.Question, pw.msg.Answer)
+	if preferred == 0 {
+		log.Debugf("No preferred answers found in zone %s for query %+v (answer: %s)", strings.Join(local, "/"), pw.msg.Question, pw.msg.Answer)
 		return writeFinalResponse(w, pw.msg)
 	}
 
-	// Overwrite the original message with the reordered answers
+	// Overwrite the original message with the reordered answers, answers sharing more topology levels
+	// with the local node first. The sort is stable so answers of the same rank keep their upstream order.
 	pw.msg = pw.msg.Copy() /* Is this needed ? https://github.com/coredns/coredns/blob/master/plugin.md?#mutating-a-response */
-	pw.msg.Answer = append(preferredAnswers, otherAnswers...)
+	pw.msg.Answer = rankAnswers(pw.msg.Answer, ranks)
 
 	// Increase counter to indicate a query was reordered
 	reorderedQueriesCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
 
 	// Increase reorder count by the number of preferred answers
-	reorderCount.WithLabelValues(metrics.WithServer(ctx)).Add(float64(len(preferredAnswers)))
+	reorderCount.WithLabelValues(metrics.WithServer(ctx)).Add(float64(preferred))
 
-	log.Debugf("Reordered %d answers for query %s", len(preferredAnswers), pw.msg.Question[0].Name)
+	log.Debugf("Reordered %d answers for query %s", preferred, pw.msg.Question[0].Name)
 
 	return writeFinalResponse(w, pw.msg)
 }
@@ -99,6 +154,21 @@ func writeFinalResponse(w dns.ResponseWriter, msg *dns.Msg) (int, error) {
 	return dns.RcodeSuccess, nil
 }
 
+// rankAnswers returns the answers ordered by rank, highest first. Answers of equal rank keep their upstream order.
+func rankAnswers(answers []dns.RR, ranks []int) []dns.RR {
+	order := make([]int, len(answers))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return ranks[b] - ranks[a] })
+
+	sorted := make([]dns.RR, len(answers))
+	for i, j := range order {
+		sorted[i] = answers[j]
+	}
+	return sorted
+}
+
 // extractRRIP extracts the IP address from a DNS resource record.
 func extractRRIP(rr dns.RR) net.IP {
 	switch rr := rr.(type) {
@@ -111,18 +181,184 @@ func extractRRIP(rr dns.RR) net.IP {
 	}
 }
 
-// ipMatchesCIDRs checks if the given IP address matches any of the CIDRs.
-func ipMatchesCIDRs(ip net.IP, cidrs []*net.IPNet) bool {
-	for _, cidr := range cidrs {
-		if cidr.Contains(ip) {
-			return true
+// rankIP returns the number of topology levels the zone containing ip shares with the local path. When ip is
+// covered by CIDRs of several zones the most specific CIDR decides, so host routes win over broader subnets.
+func (e *Zoneawareness) rankIP(ip net.IP, local []string) int {
+	addr, isAddr := netip.AddrFromSlice(ip)
+	if isAddr {
+		if name, ok := e.hosts[addr.Unmap()]; ok {
+			return sharedLevels(e.zonePath(name), local)
+		}
+		if e.index != nil {
+			_, path, _ := e.index.lookup(addr)
+			return sharedLevels(path, local)
+		}
+	}
+
+	bestOnes, rank := -1, 0
+	for name, zone := range e.Zones {
+		for _, cidr := range zone.CIDRs {
+			if !cidr.Contains(ip) {
+				continue
+			}
+			ones, _ := cidr.Mask.Size()
+			if ones < bestOnes {
+				continue
+			}
+			if r := sharedLevels(e.zonePath(name), local); ones > bestOnes || r > rank {
+				bestOnes, rank = ones, r
+			}
+		}
+	}
+	return rank
+}
+
+// zonePath returns the topology path of the named zone. Zones without an explicit path that are part of the local
+// topology are placed at their level in it, zones with a parent zone below their innermost parent in it, and zones
+// with a region below their region.
+func (e *Zoneawareness) zonePath(name string) []string {
+	if zone, ok := e.Zones[name]; ok && len(zone.Path) > 0 {
+		return zone.Path
+	}
+	if i := slices.Index(e.topology, name); i >= 0 {
+		return e.topology[:i+1]
+	}
+	chain := e.parentChain(name)
+	for i := len(chain) - 2; i >= 0; i-- {
+		zone, ok := e.Zones[chain[i]]
+		if slices.Contains(e.topology, chain[i]) || (ok && len(zone.Path) > 0) || e.regions[chain[i]] != "" {
+			return append(slices.Clone(e.zonePath(chain[i])), chain[i+1:]...)
+		}
+	}
+	if region := e.regions[name]; region != "" && region != name {
+		if i := slices.Index(e.topology, region); i >= 0 {
+			return append(slices.Clone(e.topology[:i+1]), chain...)
+		}
+		return append([]string{region}, chain...)
+	}
+	if len(chain) > 1 {
+		return chain
+	}
+	if strings.Contains(name, "/") {
+		// Zones added by sources are named by their topology path.
+		return strings.Split(name, "/")
+	}
+	return []string{name}
+}
+
+// sharedLevels returns the number of leading labels a and b have in common.
+func sharedLevels(a, b []string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// rebuild merges the Corefile zones and the prefixes of all sources into Zones, hosts and index. The Corefile zones
+// come first, then the sources in order of precedence; a CIDR or address already claimed is skipped. Parent zones
+// and regions are taken from the metadata of every prefix, including those that are skipped. The zones are built
+// from a copy of the sources, and e.mu is only held to take the copy and to swap in the result. e.rebuildMu must be
+// held, and e.mu must not be.
+func (e *Zoneawareness) rebuild() {
+	e.mu.RLock()
+	next := &Zoneawareness{
+		topology: e.topology,
+		sources:  maps.Clone(e.sources),
+		order:    e.sourceOrder(),
+		static:   e.static,
+	}
+	e.mu.RUnlock()
+
+	next.build()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Zones, e.hosts, e.parents, e.regions, e.index = next.Zones, next.hosts, next.parents, next.regions, next.index
+}
+
+// build sets Zones, hosts, parents, regions and index of e, which is not shared yet, from its Corefile zones and the
+// prefixes of its sources.
+func (e *Zoneawareness) build() {
+	parents := make(map[string]string)
+	regions := make(map[string]string)
+	for _, prefixes := range e.sources {
+		for _, p := range prefixes {
+			if parent := p.Metadata[MetadataParent]; parent != "" {
+				parents[p.Zone] = parent
+			}
+			if region := p.Metadata[MetadataRegion]; region != "" {
+				regions[p.Zone] = region
+			}
+		}
+	}
+
+	zones := make(map[string]*Zone)
+	hosts := make(map[netip.Addr]string)
+	claimed := make(map[netip.Prefix]string)
+	cidrs := make(map[string]map[netip.Prefix]struct{}) // the CIDRs of each zone, to skip those reported twice
+	add := func(source string, name string, prefix netip.Prefix) {
+		prefix = prefix.Masked()
+		if owner, ok := claimed[prefix]; ok && owner != source {
+			log.Debugf("%s from %s already added from %s", prefix, source, owner)
+			return
+		}
+		claimed[prefix] = source
+		if prefix.IsSingleIP() {
+			hosts[prefix.Addr().Unmap()] = name
+			return
+		}
+		zone, ok := zones[name]
+		if !ok {
+			zone = &Zone{}
+			zones[name] = zone
+			cidrs[name] = make(map[netip.Prefix]struct{})
+		}
+		if _, ok := cidrs[name][prefix]; !ok {
+			cidrs[name][prefix] = struct{}{}
+			zone.CIDRs = append(zone.CIDRs, prefixIPNet(prefix))
+		}
+	}
+
+	for _, sz := range e.static {
+		for _, cidr := range sz.cidrs {
+			add("Corefile", sz.name, ipNetPrefix(cidr))
+		}
+		if zone, ok := zones[sz.name]; ok && sz.path != nil {
+			zone.Path = sz.path
+		}
+	}
+	for _, source := range e.order {
+		for _, p := range e.sources[source] {
+			add(source, p.Zone, p.Prefix)
+		}
+	}
+
+	e.Zones, e.hosts, e.parents, e.regions = zones, hosts, parents, regions
+	index := newPrefixIndex()
+	for name, zone := range zones {
+		zone.Path = slices.Clone(e.zonePath(name))
+		for _, cidr := range zone.CIDRs {
+			index.add(ipNetPrefix(cidr), zone.Path)
+		}
+	}
+	e.index = index
+}
+
+// sourceOrder returns the names of the sources in order of precedence. Sources without a place in order follow,
+// sorted by name.
+func (e *Zoneawareness) sourceOrder() []string {
+	order := slices.Clone(e.order)
+	for _, source := range slices.Sorted(maps.Keys(e.sources)) {
+		if !slices.Contains(order, source) {
+			order = append(order, source)
 		}
 	}
-	return false
+	return order
 }
 
 // Name implements the Handler interface.
-func (e Zoneawareness) Name() string { return "zoneawareness" }
+func (e *Zoneawareness) Name() string { return "zoneawareness" }
 
 // ResponsePrinter wrap a dns.ResponseWriter and will write zoneawareness to standard output when WriteMsg is called.
 type ResponsePrinter struct {
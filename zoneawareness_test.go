@@ -263,3 +263,72 @@ func TestZoneawarenessCases(t *testing.T) {
 		})
 	}
 }
+
+func TestZoneawarenessTopology(t *testing.T) {
+	// Local node is host3 in rack12 of euc1-az1.
+	x := Zoneawareness{
+		Zones:    make(map[string]*Zone),
+		topology: []string{"eu-central-1", "euc1-az1", "rack12", "host3"},
+	}
+
+	_, hostCidr, _ := net.ParseCIDR("10.1.2.3/32")
+	_, rackCidr, _ := net.ParseCIDR("10.1.2.0/24")
+	_, azCidr, _ := net.ParseCIDR("10.1.0.0/16")
+	_, otherAzCidr, _ := net.ParseCIDR("10.2.0.0/16")
+	_, otherRegionCidr, _ := net.ParseCIDR("10.3.0.0/16")
+	x.Zones["eu-central-1/euc1-az1/rack12/host3"] = &Zone{CIDRs: []*net.IPNet{hostCidr}, Path: []string{"eu-central-1", "euc1-az1", "rack12", "host3"}}
+	x.Zones["eu-central-1/euc1-az1/rack12"] = &Zone{CIDRs: []*net.IPNet{rackCidr}, Path: []string{"eu-central-1", "euc1-az1", "rack12"}}
+	x.Zones["eu-central-1/euc1-az1"] = &Zone{CIDRs: []*net.IPNet{azCidr}, Path: []string{"eu-central-1", "euc1-az1"}}
+	x.Zones["eu-central-1/euc1-az2"] = &Zone{CIDRs: []*net.IPNet{otherAzCidr}, Path: []string{"eu-central-1", "euc1-az2"}}
+	x.Zones["eu-west-1/euw1-az1"] = &Zone{CIDRs: []*net.IPNet{otherRegionCidr}, Path: []string{"eu-west-1", "euw1-az1"}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = []dns.RR{
+		test.A("example.org. 300 IN A 192.0.2.1"), // Unknown
+		test.A("example.org. 300 IN A 10.3.0.1"),  // Other region
+		test.A("example.org. 300 IN A 10.2.0.1"),  // Same region
+		test.A("example.org. 300 IN A 10.1.9.1"),  // Same zone
+		test.A("example.org. 300 IN A 10.1.2.9"),  // Same rack
+		test.A("example.org. 300 IN A 10.1.2.3"),  // Same host
+	}
+	x.Next = &mockHandler{msg: m}
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := x.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	expected := []string{"10.1.2.3", "10.1.2.9", "10.1.9.1", "10.2.0.1", "192.0.2.1", "10.3.0.1"}
+	if len(rec.Msg.Answer) != len(expected) {
+		t.Fatalf("Expected %d answers, got %d", len(expected), len(rec.Msg.Answer))
+	}
+	for i, ip := range expected {
+		if got := rec.Msg.Answer[i].(*dns.A).A.String(); got != ip {
+			t.Errorf("Expected answer %d to be %s, got %s", i, ip, got)
+		}
+	}
+}
+
+func TestSharedLevels(t *testing.T) {
+	tests := []struct {
+		a, b     []string
+		expected int
+	}{
+		{nil, nil, 0},
+		{[]string{"use1-az1"}, []string{"use1-az1"}, 1},
+		{[]string{"use1-az1"}, []string{"use1-az2"}, 0},
+		{[]string{"us-east-1", "use1-az1"}, []string{"us-east-1", "use1-az2"}, 1},
+		{[]string{"us-east-1", "use1-az1", "rack1"}, []string{"us-east-1", "use1-az1"}, 2},
+		{[]string{"rack1"}, []string{"us-east-1", "rack1"}, 0},
+	}
+
+	for _, tc := range tests {
+		if got := sharedLevels(tc.a, tc.b); got != tc.expected {
+			t.Errorf("sharedLevels(%v, %v) = %d, expected %d", tc.a, tc.b, got, tc.expected)
+		}
+	}
+}